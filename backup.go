@@ -0,0 +1,328 @@
+package keystore
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Backup записывает в w копию хранилища и возвращает количество записанных
+// байт. Копия представляет из себя полноценный файл хранилища, который может
+// быть открыт с помощью Open, но содержит только действующие записи без
+// удаленных данных и свободного места между ними.
+//
+// Во время создания копии хранилище блокируется на запись, поэтому копия
+// всегда получается целостной, даже если параллельно с этим выполняется
+// изменение данных.
+func (db *DB) Backup(w io.Writer) (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.backup(w)
+}
+
+// backup записывает в w копию хранилища. Должна вызываться с установленной
+// блокировкой.
+func (db *DB) backup(w io.Writer) (int64, error) {
+	if db.closed {
+		return 0, ErrClosed
+	}
+	var cw = &countWriter{w: w}
+	var head = &header{Counter: db.counter, Flags: db.flags, Check: db.check}
+	if err := head.current().write(cw); err != nil {
+		return cw.n, err
+	}
+	// сохраняем записи в порядке ключей, чтобы копии одного и того же
+	// хранилища всегда совпадали
+	var keys = make([]string, 0, len(db.indexes))
+	for key := range db.indexes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var index = db.indexes[key]
+		data, err := db.read(index)
+		if err != nil {
+			return cw.n, err
+		}
+		err = writeRecord(cw, key, data, index.Time, index.Flags)
+		if err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, nil
+}
+
+// CopyTo записывает копию хранилища в файл filename и возвращает ее уже
+// открытой. Как и в случае Backup, копия содержит только действующие записи
+// без удаленных данных и свободного места между ними, а хранилище на время
+// копирования блокируется на запись. Зашифрованное хранилище копируется с
+// тем же ключом шифрования. Остальные настройки хранилища, такие как
+// сжатие или политика сброса данных, на копию не переносятся.
+//
+// Открытая копия добавляется в список открытых хранилищ, как при Open. Если
+// хранилище с таким именем уже открыто или файл существует и не пустой, то
+// возвращается ошибка.
+func (db *DB) CopyTo(filename string) (*DB, error) {
+	var name = canonical(filename)
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := dbs[name]; ok {
+		return nil, &os.PathError{Op: "copy", Path: filename, Err: os.ErrExist}
+	}
+	if info, err := os.Stat(filename); err == nil && info.Size() > 0 {
+		return nil, &os.PathError{Op: "copy", Path: filename, Err: os.ErrExist}
+	}
+	if dir := filepath.Dir(filename); dir != "." {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return nil, err
+		}
+	}
+	var tmpname = filename + ".copy"
+	file, err := os.OpenFile(tmpname, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+	db.mu.RLock()
+	_, err = db.backup(file)
+	var aead = db.aead
+	db.mu.RUnlock()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err2 := file.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmpname, filename)
+	}
+	if err != nil {
+		_ = os.Remove(tmpname)
+		return nil, &os.PathError{Op: "copy", Path: filename, Err: err}
+	}
+	clone, err := open(context.Background(), openOSFile, filename, false, aead)
+	if err != nil {
+		return nil, err
+	}
+	clone.name = name
+	dbs[name] = clone
+	return clone, nil
+}
+
+// MarshalBinary возвращает содержимое хранилища в виде копии, созданной так
+// же, как и с помощью Backup. Загрузить хранилище из такой копии можно с
+// помощью OpenBinary. Реализует интерфейс encoding.BinaryMarshaler.
+func (db *DB) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := db.Backup(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// OpenBinary открывает хранилище из копии, полученной с помощью
+// db.MarshalBinary или db.Backup. Копия сохраняется во временный файл, который
+// удаляется при закрытии хранилища. Такое хранилище не добавляется в список
+// открытых и закрывать его необходимо самостоятельно.
+//
+// Для копии зашифрованного хранилища используйте OpenBinaryWithOptions с
+// ключом шифрования.
+func OpenBinary(data []byte) (*DB, error) {
+	return OpenBinaryWithOptions(data, nil)
+}
+
+// OpenBinaryWithOptions открывает хранилище из копии так же, как OpenBinary,
+// с указанными параметрами. Ключ шифрования проверяется до сохранения копии.
+func OpenBinaryWithOptions(data []byte, opts *Options) (*DB, error) {
+	if opts == nil {
+		opts = new(Options)
+	}
+	aead, err := opts.cipher()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp("", "keystore-*.db")
+	if err != nil {
+		return nil, err
+	}
+	var filename = file.Name()
+	err = copyBackup(file, bytes.NewReader(data), aead)
+	if err2 := file.Close(); err == nil {
+		err = err2
+	}
+	var db *DB
+	if err == nil {
+		db, err = open(context.Background(), openOSFile, filename, false, aead)
+	}
+	if err == nil {
+		if err = opts.apply(db); err != nil {
+			_ = db.close()
+		}
+	}
+	if err != nil {
+		_ = os.Remove(filename)
+		return nil, err
+	}
+	db.temp = true
+	return db, nil
+}
+
+// writeRecord записывает в w запись хранилища с заголовком, ключом и данными
+// в текущей версии формата файла. Данные записываются как есть, поэтому флаги
+// записи должны им соответствовать.
+func writeRecord(w io.Writer, key string, value []byte, timestamp uint32,
+	flags uint8) error {
+	var buf = bufPool.Get().(*bytes.Buffer)
+	buf.Reset() // сбрасываем буфер от возможного предыдущего значения
+	defer bufPool.Put(buf)
+	_ = binary.Write(buf, binary.BigEndian, &storedIndex{
+		Time:     timestamp,
+		Flags:    flags,
+		KeySize:  uint8(len(key)),
+		DataSize: uint32(len(value)),
+	})
+	_ = binary.Write(buf, binary.BigEndian, checksum(key, value))
+	_, _ = io.WriteString(buf, key) // имя ключа
+	_, _ = buf.Write(value)         // данные
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// countWriter подсчитывает количество записанных байт.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// ErrTruncatedBackup возвращается при восстановлении хранилища из копии,
+// если данные копии неожиданно закончились.
+var ErrTruncatedBackup = errors.New("truncated backup")
+
+// Restore восстанавливает хранилище в файле filename из копии, созданной с
+// помощью db.Backup, и возвращает открытое хранилище.
+//
+// Если файл уже существует и не пустой, то возвращается ошибка. Для
+// перезаписи существующего хранилища необходимо указать force: в этом случае
+// оно будет закрыто, если было открыто, и заменено на восстановленное.
+//
+// Данные копии проверяются по мере чтения и сохраняются во временный файл,
+// который заменяет собой файл хранилища только после успешной проверки всей
+// копии. Поэтому поврежденная или обрезанная копия не приводит к появлению
+// наполовину записанного хранилища.
+//
+// Для копии зашифрованного хранилища используйте RestoreWithOptions с ключом
+// шифрования.
+func Restore(filename string, r io.Reader, force bool) (*DB, error) {
+	return RestoreWithOptions(filename, r, force, nil)
+}
+
+// RestoreWithOptions восстанавливает хранилище из копии так же, как Restore,
+// и открывает его с указанными параметрами. Ключ шифрования проверяется по
+// заголовку копии до того, как существующее хранилище будет закрыто или
+// заменено: без ключа для зашифрованной копии возвращается ошибка
+// ErrEncrypted, а с неверным ключом — ErrBadKey.
+func RestoreWithOptions(filename string, r io.Reader, force bool,
+	opts *Options) (*DB, error) {
+	if opts == nil {
+		opts = new(Options)
+	}
+	aead, err := opts.cipher()
+	if err != nil {
+		return nil, err
+	}
+	if !force {
+		if info, err := os.Stat(filename); err == nil && info.Size() > 0 {
+			return nil, &os.PathError{Op: "restore", Path: filename,
+				Err: os.ErrExist}
+		}
+	}
+	if dir := filepath.Dir(filename); dir != "." {
+		if err := os.MkdirAll(dir, opts.dirMode()); err != nil {
+			return nil, err
+		}
+	}
+	var tmpname = filename + ".restore"
+	file, err := os.OpenFile(tmpname, os.O_CREATE|os.O_TRUNC|os.O_WRONLY,
+		opts.fileMode())
+	if err != nil {
+		return nil, err
+	}
+	err = copyBackup(file, r, aead)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err2 := file.Close(); err == nil {
+		err = err2
+	}
+	if err == nil && force {
+		err = Close(filename)
+	}
+	if err == nil {
+		err = os.Rename(tmpname, filename)
+	}
+	if err != nil {
+		_ = os.Remove(tmpname)
+		return nil, &os.PathError{Op: "restore", Path: filename, Err: err}
+	}
+	return OpenWithOptions(filename, opts)
+}
+
+// copyBackup копирует данные копии хранилища из r в w, проверяя по ходу
+// формат и контрольные суммы записей. Записи сохраняются в текущей версии
+// формата файла. Перед копированием проверяет, что ключ шифрования подходит
+// к заголовку копии.
+func copyBackup(w io.Writer, r io.Reader, aead cipher.AEAD) error {
+	var head = new(header)
+	if err := head.read(r); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncatedBackup
+		}
+		return err
+	}
+	if err := verifyCheck(aead, head); err != nil {
+		return err
+	}
+	if err := head.current().write(w); err != nil {
+		return err
+	}
+	var (
+		reader = newRecordReader(r, head.Size(), head.Flags)
+		record = new(record)
+	)
+	reader.data = true
+	for {
+		err := reader.next(record)
+		if err == io.EOF {
+			return nil // копия закончилась на границе записи
+		}
+		if err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w at offset %d", ErrTruncatedBackup, record.Offset)
+		}
+		if err != nil {
+			return err
+		}
+		if !record.Valid {
+			return fmt.Errorf("%w at offset %d", ErrChecksum, record.Offset)
+		}
+		if record.Deleted() {
+			continue // удаленные записи не копируем
+		}
+		err = writeRecord(w, string(record.Key), record.Data, record.Time,
+			record.Flags)
+		if err != nil {
+			return err
+		}
+	}
+}
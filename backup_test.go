@@ -0,0 +1,207 @@
+package keystore
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestBackup(t *testing.T) {
+	var filename = "db/backup.db"
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(filename)
+	db.SetSync(false)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := db.Put(key, []byte("value "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("c", []byte("new value")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.NextSequence(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := db.Backup(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Fatalf("bad backup size: %d vs %d", n, buf.Len())
+	}
+
+	var backupname = "db/backup_copy.db"
+	if err := os.WriteFile(backupname, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(backupname)
+	restored, err := Open(backupname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Count() != 3 {
+		t.Fatalf("bad backup count: %d", restored.Count())
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		v1, err := db.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v2, err := restored.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v1, v2) {
+			t.Errorf("bad backup value for %q: %q", key, v2)
+		}
+	}
+	if restored.counter != db.counter {
+		t.Errorf("bad backup counter: %d", restored.counter)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	var filename = "db/restore_src.db"
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(filename)
+	db.SetSync(false)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Put(key, []byte("value "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := db.Backup(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var restorename = "db/restore.db"
+	defer Remove(restorename)
+	// обрезанная копия не должна приводить к созданию хранилища
+	_, err = Restore(restorename, bytes.NewReader(buf.Bytes()[:buf.Len()-3]), false)
+	if !errors.Is(err, ErrTruncatedBackup) {
+		t.Fatal("bad truncated restore:", err)
+	}
+	if _, err := os.Stat(restorename); !os.IsNotExist(err) {
+		t.Fatal("truncated backup restored")
+	}
+	restored, err := Restore(restorename, bytes.NewReader(buf.Bytes()), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Count() != 3 {
+		t.Fatalf("bad restored count: %d", restored.Count())
+	}
+	value, err := restored.Get("b")
+	if err != nil || string(value) != "value b" {
+		t.Fatalf("bad restored value: %q, %v", value, err)
+	}
+	// без force существующее хранилище не перезаписывается
+	if _, err := Restore(restorename, bytes.NewReader(buf.Bytes()), false); err == nil {
+		t.Fatal("restored over existing store")
+	}
+	restored, err = Restore(restorename, bytes.NewReader(buf.Bytes()), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Count() != 3 {
+		t.Fatalf("bad forced restore count: %d", restored.Count())
+	}
+}
+
+func TestCopyTo(t *testing.T) {
+	var filename, copyname = "db/copy_src.db", "db/copy_dst.db"
+	os.Remove(copyname)
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(filename)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Put(key, []byte("value "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	clone, err := db.CopyTo(copyname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(copyname)
+	if clone.Count() != 2 || clone.deleted.len() != 0 {
+		t.Fatal("bad copy:", clone.Count(), clone.deleted.len())
+	}
+	if value, err := clone.Get("c"); err != nil || string(value) != "value c" {
+		t.Fatalf("bad copy value: %q, %v", value, err)
+	}
+	if opened, err := Open(copyname); err != nil || opened != clone {
+		t.Fatal("copy is not registered:", err)
+	}
+	// копия не связана с исходным хранилищем
+	if err := clone.Put("a", []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("a"); err != nil || string(value) != "value a" {
+		t.Fatalf("bad source value: %q, %v", value, err)
+	}
+	if _, err := db.CopyTo(copyname); !errors.Is(err, os.ErrExist) {
+		t.Fatal("bad copy to opened store:", err)
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	var filename = "db/marshal.db"
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(filename)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Put(key, []byte("value "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.ReserveSequence(10); err != nil {
+		t.Fatal(err)
+	}
+	data, err := db.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := OpenBinary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tmpname = loaded.Path()
+	if loaded.counter != db.counter || loaded.Count() != db.Count() {
+		t.Fatal("bad loaded store:", loaded.counter, loaded.Count())
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if value, err := loaded.Get(key); err != nil || string(value) != "value "+key {
+			t.Fatalf("bad loaded value: %q, %v", value, err)
+		}
+	}
+	if err := loaded.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmpname); !os.IsNotExist(err) {
+		t.Fatal("temporary file is not removed:", err)
+	}
+	if _, err := OpenBinary(data[:len(data)-1]); !errors.Is(err, ErrTruncatedBackup) {
+		t.Fatal("bad truncated data error:", err)
+	}
+}
@@ -0,0 +1,92 @@
+package keystore
+
+// WriteBatch накапливает операции записи и удаления, которые затем
+// применяются к хранилищу в том же порядке с помощью db.Apply. В отличие от
+// db.Puts, порядок применения операций всегда определен.
+//
+// Пакет можно использовать повторно после вызова Reset: память, выделенная
+// под список операций, при этом сохраняется.
+type WriteBatch struct {
+	ops []batchOp
+}
+
+// batchOp описывает одну операцию пакета.
+type batchOp struct {
+	key    string
+	value  []byte
+	delete bool
+}
+
+// Put добавляет в пакет сохранение значения с указанным ключом. Значение не
+// копируется, поэтому его нельзя изменять до применения пакета.
+func (b *WriteBatch) Put(key string, value []byte) {
+	b.ops = append(b.ops, batchOp{key: key, value: value})
+}
+
+// Delete добавляет в пакет удаление ключа. Отсутствие ключа в хранилище при
+// применении пакета не считается ошибкой.
+func (b *WriteBatch) Delete(key string) {
+	b.ops = append(b.ops, batchOp{key: key, delete: true})
+}
+
+// Len возвращает количество операций в пакете.
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Reset очищает пакет для повторного использования.
+func (b *WriteBatch) Reset() {
+	for i := range b.ops {
+		b.ops[i] = batchOp{} // не удерживаем ссылки на значения
+	}
+	b.ops = b.ops[:0]
+}
+
+// Apply применяет операции пакета к хранилищу в порядке их добавления под
+// одной блокировкой и со сбросом данных в файл только после всех операций.
+//
+// Перед применением проверяются ключи и значения всех операций сохранения
+// (см. db.SetMaxValueSize и db.SetJSONOnly): если хотя бы одно из них не
+// может быть сохранено, то возвращается ошибка и ни одна из операций не
+// выполняется. Если же ошибка произошла во время записи, то уже выполненные
+// операции не отменяются.
+func (db *DB) Apply(b *WriteBatch) error {
+	for _, op := range b.ops {
+		if op.delete {
+			continue
+		}
+		if err := checkKey(op.key); err != nil {
+			return err
+		}
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if db.ro {
+		return ErrReadOnly
+	}
+	for _, op := range b.ops {
+		if op.delete {
+			continue
+		}
+		if err := db.checkValue(op.key, op.value); err != nil {
+			return err
+		}
+	}
+	for _, op := range b.ops {
+		var err error
+		if op.delete {
+			if err = db.delete(op.key); err == ErrNotFound {
+				err = nil
+			}
+		} else {
+			err = db.put(op.key, op.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return db.flush()
+}
@@ -0,0 +1,47 @@
+package keystore
+
+import (
+	"os"
+	"testing"
+)
+
+func TestWriteBatch(t *testing.T) {
+	os.RemoveAll(filename)
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("old", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	var batch = new(WriteBatch)
+	batch.Put("key", []byte("value1"))
+	batch.Delete("old")
+	batch.Put("key", []byte("value2"))
+	batch.Delete("missing")
+	batch.Put("other", nil)
+	batch.Delete("other")
+	if batch.Len() != 6 {
+		t.Fatal("bad batch length:", batch.Len())
+	}
+	if err := db.Apply(batch); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("key"); err != nil || string(value) != "value2" {
+		t.Fatalf("bad value: %q, %v", value, err)
+	}
+	if db.Has("old") || db.Has("other") || db.Count() != 1 {
+		t.Fatal("bad keys:", db.Keys("", "", 0, 0, true))
+	}
+	// пакет с неверным ключом не применяется совсем
+	batch.Reset()
+	batch.Put("new", nil)
+	batch.Put("", nil)
+	if err := db.Apply(batch); err != ErrEmptyKey {
+		t.Fatal("bad empty key error:", err)
+	}
+	if db.Has("new") {
+		t.Fatal("batch applied partially")
+	}
+}
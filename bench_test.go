@@ -0,0 +1,239 @@
+package keystore
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// Размеры значений, используемые в тестах производительности.
+const (
+	benchSize  = 256 // обычное значение
+	benchGrown = 640 // значение, которое не помещается на место обычного
+	benchKeys  = 1000
+)
+
+// benchKey возвращает ключ с указанным номером.
+func benchKey(i int) string {
+	return fmt.Sprintf("key%08d", i)
+}
+
+// openBench открывает хранилище во временном каталоге и загружает в него n
+// значений размером size. Хранилище закрывается, а его файл удаляется по
+// окончании теста.
+func openBench(b *testing.B, sync bool, n, size int) *DB {
+	b.Helper()
+	db, err := Open(filepath.Join(b.TempDir(), "bench.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+	var value = make([]byte, size)
+	err = db.BulkLoad(func(put func(key string, value []byte) error) error {
+		for i := 0; i < n; i++ {
+			if err := put(benchKey(i), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	db.SetSync(sync)
+	return db
+}
+
+// benchSync выполняет тест записи со сбросом кеша после каждой записи и без
+// него.
+func benchSync(b *testing.B, fn func(b *testing.B, sync bool)) {
+	for _, sync := range []bool{false, true} {
+		sync := sync
+		b.Run(fmt.Sprintf("sync=%v", sync), func(b *testing.B) {
+			fn(b, sync)
+		})
+	}
+}
+
+// BenchmarkPutNew записывает значения с новыми ключами.
+func BenchmarkPutNew(b *testing.B) {
+	benchSync(b, func(b *testing.B, sync bool) {
+		var (
+			db    = openBench(b, sync, 0, 0)
+			value = make([]byte, benchSize)
+		)
+		b.SetBytes(benchSize)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := db.Put(benchKey(i), value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkPutSameSize перезаписывает значения значениями того же размера,
+// которые записываются на прежнее место.
+func BenchmarkPutSameSize(b *testing.B) {
+	benchSync(b, func(b *testing.B, sync bool) {
+		var (
+			db    = openBench(b, sync, benchKeys, benchSize)
+			value = make([]byte, benchSize)
+		)
+		b.SetBytes(benchSize)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := db.Put(benchKey(i%benchKeys), value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkPutGrow перезаписывает значения значениями большего размера,
+// которые не помещаются на прежнее место. После перезаписи всех ключей
+// значения без учета времени возвращаются к прежнему размеру.
+func BenchmarkPutGrow(b *testing.B) {
+	benchSync(b, func(b *testing.B, sync bool) {
+		var (
+			db    = openBench(b, sync, benchKeys, benchSize)
+			value = make([]byte, benchGrown)
+			batch = new(WriteBatch)
+		)
+		b.SetBytes(benchGrown)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if i > 0 && i%benchKeys == 0 {
+				// удаление освобождает большое место, и значение прежнего
+				// размера записывается на освободившееся маленькое
+				b.StopTimer()
+				batch.Reset()
+				for j := 0; j < benchKeys; j++ {
+					batch.Delete(benchKey(j))
+					batch.Put(benchKey(j), value[:benchSize])
+				}
+				if err := db.Apply(batch); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+			if err := db.Put(benchKey(i%benchKeys), value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkPutResize перезаписывает значения значениями разного размера, не
+// превышающего исходный, и сообщает, насколько при этом вырос файл.
+func BenchmarkPutResize(b *testing.B) {
+	var (
+		db    = openBench(b, false, benchKeys, benchSize)
+		value = make([]byte, benchSize)
+		start = db.Stats().Size
+	)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var size = benchSize/2 + i*37%(benchSize/2+1)
+		if err := db.Put(benchKey(i%benchKeys), value[:size]); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(db.Stats().Size-start), "file-growth-bytes")
+}
+
+// BenchmarkGetHitMiss читает существующие и отсутствующие значения.
+func BenchmarkGetHitMiss(b *testing.B) {
+	var db = openBench(b, false, 10000, benchSize)
+	b.Run("hit", func(b *testing.B) {
+		b.SetBytes(benchSize)
+		for i := 0; i < b.N; i++ {
+			if _, err := db.Get(benchKey(i % 10000)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("miss", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.Get(benchKey(10000 + i)); err != ErrNotFound {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkDelete удаляет значения. Когда значения заканчиваются, они без
+// учета времени записываются заново.
+func BenchmarkDelete(b *testing.B) {
+	benchSync(b, func(b *testing.B, sync bool) {
+		var (
+			db     = openBench(b, sync, benchKeys, benchSize)
+			values = make(map[string][]byte, benchKeys)
+		)
+		for j := 0; j < benchKeys; j++ {
+			values[benchKey(j)] = make([]byte, benchSize)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if i > 0 && i%benchKeys == 0 {
+				b.StopTimer()
+				if err := db.Puts(values); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+			if err := db.Delete(benchKey(i % benchKeys)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkReuse удаляет значение и записывает новое того же размера на
+// освободившееся место.
+func BenchmarkReuse(b *testing.B) {
+	benchSync(b, func(b *testing.B, sync bool) {
+		var (
+			db    = openBench(b, sync, benchKeys, benchSize)
+			value = make([]byte, benchSize)
+		)
+		b.SetBytes(benchSize)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			var key = benchKey(i % benchKeys)
+			if err := db.Delete(key); err != nil {
+				b.Fatal(err)
+			}
+			if err := db.Put(key, value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkKeysCount выбирает страницу ключей из хранилища с разным
+// количеством ключей: с готовым отсортированным списком и после записи,
+// которая требует построить его заново.
+func BenchmarkKeysCount(b *testing.B) {
+	for _, n := range []int{10000, 100000} {
+		var (
+			db    = openBench(b, false, n, 16)
+			last  = benchKey(n / 2)
+			value = make([]byte, 16)
+		)
+		b.Run(fmt.Sprintf("cached/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				db.Keys("", last, 0, 100, true)
+			}
+		})
+		b.Run(fmt.Sprintf("changed/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := db.Put(benchKey(n+i%100), value); err != nil {
+					b.Fatal(err)
+				}
+				db.Keys("", last, 0, 100, true)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package keystore
+
+import (
+	"errors"
+	"io"
+	"math"
+	"time"
+)
+
+// ErrDuplicateKey возвращается Builder при попытке повторно сохранить
+// значение с уже записанным ключом.
+var ErrDuplicateKey = errors.New("duplicate key")
+
+// errBuilderFinished возвращается при записи в уже завершенный Builder.
+var errBuilderFinished = errors.New("builder finished")
+
+// Builder последовательно записывает файл хранилища, не открывая его. Это
+// самый быстрый способ создать хранилище с заранее известными данными,
+// например при сборке приложения: записи просто добавляются друг за другом
+// без блокировок и поиска свободного места. Полученный файл открывается
+// обычным образом.
+//
+// Каждый ключ может быть записан только один раз. Значения сохраняются без
+// сжатия и шифрования.
+type Builder struct {
+	w       *countWriter
+	head    *header
+	keys    map[string]bool // уже записанные ключи
+	started bool            // заголовок файла записан
+	done    bool            // запись завершена
+}
+
+// NewBuilder возвращает новый Builder, записывающий файл хранилища в w.
+func NewBuilder(w io.Writer) *Builder {
+	return &Builder{
+		w:    &countWriter{w: w},
+		head: newHeader(0),
+		keys: make(map[string]bool),
+	}
+}
+
+// SetCounter задает значение счетчика хранилища (см. db.NextSequence). Если
+// w не поддерживает io.WriterAt, то счетчик можно задать только до записи
+// первого значения.
+func (b *Builder) SetCounter(counter uint64) {
+	b.head.Counter = counter
+}
+
+// start записывает заголовок файла, если он еще не записан.
+func (b *Builder) start() error {
+	if b.started {
+		return nil
+	}
+	b.started = true
+	return b.head.write(b.w)
+}
+
+// Put записывает значение с указанным ключом. Если значение с таким ключом
+// уже было записано, то возвращается ошибка ErrDuplicateKey.
+func (b *Builder) Put(key string, value []byte) error {
+	if b.done {
+		return errBuilderFinished
+	}
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if uint64(len(key))+uint64(len(value)) > math.MaxUint32 {
+		return ErrValueTooLarge
+	}
+	if b.keys[key] {
+		return ErrDuplicateKey
+	}
+	if err := b.start(); err != nil {
+		return err
+	}
+	if b.w.n+recordHeaderSize(b.head.Flags)+int64(len(key)+len(value)) >
+		math.MaxUint32 {
+		return ErrFileTooLarge
+	}
+	err := writeRecord(b.w, key, value, uint32(time.Now().Unix()), 0)
+	if err != nil {
+		return err
+	}
+	b.keys[key] = true
+	return nil
+}
+
+// Finish завершает запись файла хранилища. Если w поддерживает io.WriterAt,
+// то заголовок в начале файла перезаписывается с итоговым значением счетчика
+// и концом данных, поэтому файл должен записываться с нулевого смещения.
+// Иначе при открытии файла конец данных определяется по концу файла. Сам w
+// не закрывается.
+func (b *Builder) Finish() error {
+	if b.done {
+		return errBuilderFinished
+	}
+	if err := b.start(); err != nil {
+		return err
+	}
+	b.done = true
+	if w, ok := b.w.w.(io.WriterAt); ok {
+		b.head.End = b.w.n
+		return b.head.write(io.NewOffsetWriter(w, 0))
+	}
+	return nil
+}
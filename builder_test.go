@@ -0,0 +1,90 @@
+package keystore
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+	var filename = filepath.Join("db", "builder.db")
+	os.Remove(filename)
+	defer os.Remove(filename)
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var builder = NewBuilder(file)
+	for _, key := range []string{"c", "a", "b"} {
+		if err := builder.Put(key, []byte("value "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := builder.Put("a", nil); err != ErrDuplicateKey {
+		t.Fatalf("bad duplicate error: %v", err)
+	}
+	if err := builder.Put("", nil); err != ErrEmptyKey {
+		t.Fatalf("bad empty key error: %v", err)
+	}
+	builder.SetCounter(100)
+	if err := builder.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.Put("d", nil); err == nil {
+		t.Fatal("put after finish")
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.Count() != 3 || db.stored != db.size {
+		t.Fatalf("bad store: %d, %d", db.Count(), db.stored)
+	}
+	if value, err := db.Get("b"); err != nil || string(value) != "value b" {
+		t.Fatalf("bad value: %q, %v", value, err)
+	}
+	if n, err := db.NextSequence(); err != nil || n != 101 {
+		t.Fatalf("bad counter: %d, %v", n, err)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// без io.WriterAt конец данных в заголовке не сохраняется
+	var buf bytes.Buffer
+	builder = NewBuilder(&buf)
+	builder.SetCounter(7)
+	if err := builder.Put("key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	clone, err := OpenBinary(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clone.Close()
+	if value, err := clone.Get("key"); err != nil || string(value) != "value" {
+		t.Fatalf("bad value: %q, %v", value, err)
+	}
+	if n, _ := clone.NextSequence(); n != 8 {
+		t.Fatalf("bad counter: %d", n)
+	}
+
+	// пустое хранилище
+	buf.Reset()
+	if err := NewBuilder(&buf).Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if empty, err := OpenBinary(buf.Bytes()); err != nil || empty.Count() != 0 {
+		t.Fatalf("bad empty store: %v", err)
+	} else {
+		empty.Close()
+	}
+}
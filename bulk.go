@@ -0,0 +1,36 @@
+package keystore
+
+// BulkLoad выполняет пакетную загрузку данных в хранилище. Функция fn
+// получает функцию put для сохранения значений, которую можно использовать
+// только до возврата из fn.
+//
+// Во время загрузки все новые записи добавляются в конец файла без поиска
+// свободного места, освободившиеся при перезаписи места не сортируются, а
+// сброс данных в файл после каждой записи не выполняется. По окончании
+// загрузки список свободных мест сортируется и выполняется однократный сброс
+// данных в файл, если для хранилища не установлена политика SyncNever.
+//
+// На все время загрузки хранилище блокируется, в том числе и для чтения.
+// Если fn возвращает ошибку, то уже сохраненные значения не отменяются.
+func (db *DB) BulkLoad(fn func(put func(key string, value []byte) error) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if db.ro {
+		return ErrReadOnly
+	}
+	db.bulk = true
+	defer func() {
+		db.bulk = false
+		db.trimFree()
+	}()
+	err := fn(db.put)
+	if db.policy != SyncNever {
+		if err2 := db.sync(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
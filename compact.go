@@ -0,0 +1,445 @@
+package keystore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// compactBatch задает количество записей, которые при сжатии хранилища
+// копируются под одной блокировкой.
+const compactBatch = 1000
+
+// autoCompactMin задает размер данных в файле, начиная с которого
+// выполняется автоматическое сжатие хранилища: сжимать маленькие файлы нет
+// смысла, а доля свободного места в них меняется слишком резко.
+const autoCompactMin = 64 << 10
+
+// errCompactStale возвращается, если хранилище было перечитано или очищено
+// во время сжатия и скопированные записи уже недействительны.
+var errCompactStale = errors.New("store changed during compaction")
+
+// ErrCompacted возвращается при чтении значения с помощью объекта,
+// полученного от db.GetReader до сжатия хранилища: файл, из которого он
+// читал данные, уже заменен.
+var ErrCompacted = errors.New("store file compacted")
+
+// snapshotFile читает данные из файла хранилища, который действовал в момент
+// его создания. Прежний файл после сжатия закрывается, а смещения записей в
+// новом файле уже другие, поэтому чтение из замененного файла никогда не
+// возвращает чужие данные, а завершается ошибкой ErrCompacted.
+type snapshotFile struct {
+	locked *lockedFile // заменяемый при сжатии файл хранилища
+	file   *os.File    // файл, действовавший при создании
+}
+
+// ReadAt читает данные файла, начиная с указанного смещения.
+func (f snapshotFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.file.ReadAt(p, off)
+	if err != nil && err != io.EOF && f.locked.os() != f.file {
+		err = ErrCompacted
+	}
+	return n, err
+}
+
+// compaction описывает выполняющееся сжатие хранилища.
+type compaction struct {
+	keys  map[string]bool // ключи, измененные во время копирования записей
+	stale bool            // скопированные записи недействительны
+}
+
+// compactEntry описывает запись, которую нужно скопировать при сжатии.
+type compactEntry struct {
+	key   string // ключ записи
+	trash bool   // значение из корзины
+}
+
+// touch отмечает ключ измененным, если выполняется сжатие хранилища: перед
+// заменой файла его записи будут скопированы заново. Вызывающий должен
+// удерживать эксклюзивную блокировку хранилища.
+func (db *DB) touch(key string) {
+	if db.compact != nil {
+		db.compact.keys[key] = true
+	}
+}
+
+// staleCompaction отмечает, что выполняющееся сжатие хранилища необходимо
+// начать заново, так как записи в файле изменились целиком.
+func (db *DB) staleCompaction() {
+	if db.compact != nil {
+		db.compact.stale = true
+	}
+}
+
+// Compact сжимает файл хранилища: копирует действующие записи и значения в
+// корзине (см. db.SetSoftDelete) в новый файл без удаленных записей и
+// свободного места между ними и заменяет им прежний файл. Отброшенные
+// свободные места (см. db.SetMaxFreeSlots) и место, зарезервированное с
+// помощью db.Preallocate, в новый файл так же не попадают. Значения и время их
+// изменения сохраняются, но восстановить удаленные значения с помощью
+// db.Undelete после сжатия уже нельзя.
+//
+// Записи копируются частями, и между ними хранилище доступно как для
+// чтения, так и для записи. Значения, измененные за время копирования,
+// копируются заново непосредственно перед заменой файла, поэтому чтение и
+// запись блокируются только на время копирования этих изменений и
+// переименования файла.
+// Объекты для чтения значений, полученные с помощью db.GetReader до замены
+// файла, после нее возвращают ошибку ErrCompacted.
+//
+// Новый файл создается рядом с прежним с тем же именем и расширением
+// ".compact", поэтому на время сжатия на диске требуется место для копии
+// данных. Если используется любая политика сброса данных, кроме SyncNever,
+// то перед заменой файла данные копии сбрасываются на диск. При ошибке
+// прежний файл остается без изменений.
+//
+// Сжатие поддерживается только для хранилищ в файлах на диске: для
+// остальных, например открытых с помощью OpenMemory, возвращается ошибка,
+// соответствующая errors.ErrUnsupported. В Windows открытый файл обычно
+// нельзя заменить, поэтому там сжатие завершается ошибкой.
+//
+// Одновременно выполняется только одно сжатие: если оно уже выполняется,
+// например автоматически (см. db.SetAutoCompact), то Compact ожидает его
+// завершения. Закрытие хранилища прерывает сжатие с ошибкой ErrClosed.
+func (db *DB) Compact() error {
+	return db.CompactContext(context.Background())
+}
+
+// CompactContext сжимает файл хранилища так же, как и Compact, но прерывает
+// копирование записей с ошибкой контекста, если он был отменен.
+func (db *DB) CompactContext(ctx context.Context) error {
+	db.cmu.Lock()
+	defer db.cmu.Unlock()
+	return db.compactFile(ctx)
+}
+
+// compactFile сжимает файл хранилища, начиная копирование заново, если
+// хранилище было перечитано во время сжатия. Вызывающий должен удерживать
+// блокировку db.cmu.
+func (db *DB) compactFile(ctx context.Context) error {
+	for {
+		if err := db.compactOnce(ctx); err != errCompactStale {
+			return err
+		}
+	}
+}
+
+// compactOnce копирует записи хранилища в новый файл и заменяет им прежний.
+func (db *DB) compactOnce(ctx context.Context) (err error) {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrClosed
+	}
+	if db.ro {
+		db.mu.Unlock()
+		return ErrReadOnly
+	}
+	file, ok := db.f.(*lockedFile)
+	if !ok {
+		db.mu.Unlock()
+		return &os.PathError{Op: "compact", Path: db.Path(),
+			Err: errors.ErrUnsupported}
+	}
+	info, err := file.Stat()
+	if err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	var (
+		c = &compaction{keys: make(map[string]bool)}
+		// записи копируются в порядке ключей, как и при создании копии
+		entries = make([]compactEntry, 0, len(db.indexes)+len(db.trash))
+		head    = (&header{Counter: db.counter, Flags: db.flags,
+			Check: db.check}).current()
+		aead    = db.aead
+		durable = db.policy != SyncNever
+		from    = db.size
+	)
+	for key := range db.indexes {
+		entries = append(entries, compactEntry{key: key})
+	}
+	for key := range db.trash {
+		entries = append(entries, compactEntry{key: key, trash: true})
+	}
+	db.compact = c
+	db.mu.Unlock()
+	defer func() {
+		db.mu.Lock()
+		if db.compact == c {
+			db.compact = nil
+		}
+		db.mu.Unlock()
+	}()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	var tmpname = file.Name() + ".compact"
+	tmp, err := os.OpenFile(tmpname, os.O_CREATE|os.O_TRUNC|os.O_WRONLY,
+		info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	err = db.compactCopy(ctx, tmp, head, entries, c)
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	var fresh *DB
+	if err == nil {
+		fresh, err = open(ctx, osFileOpener(info.Mode().Perm()), tmpname,
+			false, aead)
+	}
+	if err == nil {
+		// изменения копируются под блокировкой, поэтому данные сбрасываются
+		// на диск только один раз перед заменой файла
+		fresh.policy = SyncNever
+		err = db.compactSwap(file, fresh, c, durable)
+		if err != nil {
+			_ = fresh.close()
+		}
+	}
+	if err != nil {
+		_ = os.Remove(tmpname)
+		return err
+	}
+	if logger := db.logger(); logger != nil {
+		logger.Debug("compact", "from", from, "to", fresh.size)
+	}
+	return nil
+}
+
+// compactCopy записывает в w заголовок файла и записи хранилища из entries.
+// Записи копируются частями, каждая под своей блокировкой хранилища на
+// чтение.
+func (db *DB) compactCopy(ctx context.Context, w io.Writer, head *header,
+	entries []compactEntry, c *compaction) error {
+	var buf = bufio.NewWriter(w)
+	if err := head.write(buf); err != nil {
+		return err
+	}
+	for len(entries) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var batch = entries
+		if len(batch) > compactBatch {
+			batch = batch[:compactBatch]
+		}
+		entries = entries[len(batch):]
+		if err := db.copyEntries(buf, batch, c); err != nil {
+			return err
+		}
+	}
+	return buf.Flush()
+}
+
+// copyEntries записывает в w записи хранилища из entries под блокировкой
+// хранилища на чтение. Записи, измененные с начала сжатия, пропускаются:
+// они будут скопированы перед заменой файла.
+func (db *DB) copyEntries(w io.Writer, entries []compactEntry,
+	c *compaction) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if c.stale {
+		return errCompactStale
+	}
+	for _, entry := range entries {
+		if c.keys[entry.key] {
+			continue
+		}
+		var slot, flags = db.indexes[entry.key], uint8(0)
+		if entry.trash {
+			slot, flags = db.trash[entry.key], recordDeleted|recordRetained
+		}
+		data, err := db.read(slot)
+		if err != nil {
+			return err
+		}
+		err = writeRecord(w, entry.key, data, slot.Time, slot.Flags|flags)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactSwap копирует в новое хранилище fresh записи, измененные во время
+// сжатия, и заменяет файл хранилища файлом fresh. Ошибка возвращается только
+// в том случае, если файл не был заменен.
+func (db *DB) compactSwap(file *lockedFile, fresh *DB, c *compaction,
+	durable bool) error {
+	db.pmu.Lock() // ожидаем завершения параллельной записи
+	defer db.pmu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if c.stale {
+		return errCompactStale
+	}
+	for key := range c.keys {
+		if err := fresh.recopy(db, key); err != nil {
+			return err
+		}
+	}
+	if fresh.counter != db.counter {
+		if err := fresh.writeCounter(db.counter); err != nil {
+			return err
+		}
+		fresh.counter = db.counter
+	}
+	if err := fresh.commitEnd(); err != nil {
+		return err
+	}
+	if durable {
+		if err := fresh.f.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(fresh.Path(), file.Name()); err != nil {
+		return err
+	}
+	// читатели без блокировки не должны обращаться к прежним записям
+	db.view.Store((*sync.Map)(nil))
+	db.reuse()
+	db.unmap()
+	var prev = file.replace(fresh.f.(*lockedFile).os())
+	db.indexes, db.deleted = fresh.indexes, fresh.deleted
+	db.trash = fresh.trash
+	db.starts, db.ends = fresh.starts, fresh.ends
+	db.counter, db.slot = fresh.counter, fresh.slot
+	db.start, db.flags, db.check = fresh.start, fresh.flags, fresh.check
+	db.size, db.stored, db.endAt = fresh.size, fresh.stored, fresh.endAt
+	db.lost, db.lostSize = 0, 0
+	db.sorted = nil
+	db.compact = nil
+	db.resetView()
+	if size, err := db.f.Seek(0, io.SeekEnd); err == nil {
+		db.remap(size)
+	}
+	_ = closeLocked(prev) // данные уже в новом файле
+	return nil
+}
+
+// recopy заново копирует из хранилища src действующее значение и значение в
+// корзине с указанным ключом, удаляя их прежние копии.
+func (db *DB) recopy(src *DB, key string) error {
+	if err := db.unretain(key); err != nil {
+		return err
+	}
+	if slot, ok := db.indexes[key]; ok {
+		db.dropIndex(key)
+		if err := db.discard(slot); err != nil {
+			return err
+		}
+	}
+	if slot, ok := src.indexes[key]; ok {
+		copied, err := db.copyRecord(src, key, slot, 0)
+		if err != nil {
+			return err
+		}
+		db.setIndex(key, copied)
+	}
+	if slot, ok := src.trash[key]; ok {
+		copied, err := db.copyRecord(src, key, slot, recordDeleted|recordRetained)
+		if err != nil {
+			return err
+		}
+		if db.trash == nil {
+			db.trash = make(map[string]index)
+		}
+		db.trash[key] = copied
+	}
+	return nil
+}
+
+// copyRecord копирует запись slot с указанным ключом из хранилища src и
+// возвращает индекс копии. Флаги mark добавляются только к заголовку
+// записи в файле.
+func (db *DB) copyRecord(src *DB, key string, slot index,
+	mark uint8) (index, error) {
+	data, err := src.read(slot)
+	if err != nil {
+		return index{}, err
+	}
+	copied, _, err := db.reserve(key, data, slot.Flags)
+	if err != nil {
+		return index{}, err
+	}
+	copied.Time = slot.Time
+	var stored = copied
+	stored.Flags |= mark
+	if err := db.store(stored, key, data); err != nil {
+		db.release(copied)
+		return index{}, err
+	}
+	return copied, nil
+}
+
+// SetAutoCompact включает автоматическое сжатие хранилища (см. db.Compact),
+// когда доля свободного места в файле превышает ratio, например 0.5. Доля
+// учитывает удаленные записи и отброшенные свободные места (см.
+// db.SetMaxFreeSlots), но не значения в корзине. Нулевое значение выключает
+// автоматическое сжатие, которое по умолчанию не используется.
+//
+// Доля свободного места проверяется после каждой записи или удаления, и если
+// она превышает ratio, то сжатие запускается в фоне и не задерживает саму
+// операцию. Файлы с данными меньше 64 Кб не сжимаются. Одновременно
+// выполняется только одно сжатие, а при закрытии хранилища оно прерывается и
+// Close ожидает его завершения. Если сжатие завершилось ошибкой, то
+// автоматическое сжатие выключается, а ошибка записывается в журнал (см.
+// db.SetLogger).
+func (db *DB) SetAutoCompact(ratio float64) {
+	db.mu.Lock()
+	db.autoc = ratio
+	db.mu.Unlock()
+}
+
+// fragmented возвращает true, если доля свободного места в файле превышает
+// порог автоматического сжатия.
+func (db *DB) fragmented() bool {
+	if db.autoc <= 0 || db.size < autoCompactMin {
+		return false
+	}
+	var free = float64(db.deleted.size + db.lostSize)
+	return free > db.autoc*float64(db.size-db.start)
+}
+
+// autoCompact запускает сжатие хранилища в фоне, если доля свободного места
+// превышает порог и сжатие еще не выполняется. Вызывается после записи с
+// эксклюзивной блокировкой хранилища.
+func (db *DB) autoCompact() {
+	if db.closed || db.ro || !db.fragmented() {
+		return
+	}
+	if _, ok := db.f.(*lockedFile); !ok || !db.cmu.TryLock() {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	db.cstop = cancel
+	db.cwg.Add(1)
+	go func() {
+		defer db.cwg.Done()
+		defer db.cmu.Unlock()
+		defer cancel()
+		err := db.compactFile(ctx)
+		if err == nil || err == ErrClosed || ctx.Err() != nil {
+			return
+		}
+		db.mu.Lock()
+		db.autoc = 0
+		var logger = db.logger()
+		db.mu.Unlock()
+		if logger != nil {
+			logger.Warn("auto compaction disabled", "err", err)
+		}
+	}()
+}
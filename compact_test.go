@@ -0,0 +1,307 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCompact(t *testing.T) {
+	var filename = "db/compact.db"
+	os.Remove(filename)
+	if err := os.MkdirAll("db", 0777); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filename)
+	db, err := OpenWithOptions(filename, &Options{SoftDelete: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		var key = fmt.Sprintf("key%03d", i)
+		if err := db.Put(key, []byte("value "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.ReserveSequence(10); err != nil {
+		t.Fatal(err)
+	}
+	modTime, err := db.ModTime("key001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key000"); err != nil {
+		t.Fatal(err)
+	}
+	db.SetSoftDelete(false)
+	for i := 1; i < 100; i += 2 {
+		if err := db.Delete(fmt.Sprintf("key%03d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var size = db.Stats().Size
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	var stats = db.Stats()
+	if stats.Size >= size || stats.FreeSlots != 0 || stats.Keys != 49 {
+		t.Fatalf("bad compacted stats: %+v", stats)
+	}
+	if info, err := os.Stat(filename); err != nil || info.Size() != stats.Size {
+		t.Fatal("bad compacted file:", info.Size(), err)
+	}
+	if _, err := os.Stat(filename + ".compact"); !os.IsNotExist(err) {
+		t.Error("compact file not removed:", err)
+	}
+	if value, err := db.Get("key002"); err != nil || string(value) != "value key002" {
+		t.Fatalf("bad compacted value: %q, %v", value, err)
+	}
+	if mt, err := db.ModTime("key002"); err != nil || !mt.Equal(modTime) {
+		t.Errorf("bad compacted mod time: %v, %v", mt, err)
+	}
+	if db.Sequence() != 10 {
+		t.Error("bad compacted sequence:", db.Sequence())
+	}
+	// корзина сохраняется, а просто удаленные значения уже не восстановить
+	if list := db.ListDeleted(); len(list) != 1 || list[0].Key != "key000" {
+		t.Fatalf("bad compacted trash: %+v", list)
+	}
+	if err := db.Undelete("key001"); err != ErrNotFound {
+		t.Errorf("bad undelete after compact: %v", err)
+	}
+	if err := db.Undelete("key000"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("new", []byte("new value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Healthy(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.Count() != 51 || db.Sequence() != 10 {
+		t.Fatal("bad reopened store:", db.Count(), db.Sequence())
+	}
+	if value, err := db.Get("key000"); err != nil || string(value) != "value key000" {
+		t.Fatalf("bad reopened value: %q, %v", value, err)
+	}
+
+	memory, err := OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer memory.Close()
+	if err := memory.Compact(); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("bad memory compact: %v", err)
+	}
+}
+
+func TestCompactReader(t *testing.T) {
+	var filename = "db/compact_reader.db"
+	os.Remove(filename)
+	if err := os.MkdirAll("db", 0777); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filename)
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("a", []byte("first value")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := db.Put(fmt.Sprintf("k%03d", i),
+			[]byte(fmt.Sprintf("value-%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader, err := db.GetReader("k050")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	// прежний файл уже закрыт, а смещения в новом файле другие
+	if data, err := io.ReadAll(reader); err != ErrCompacted {
+		t.Fatalf("bad stale reader: %q, %v", data, err)
+	}
+	if reader, err = db.GetReader("k050"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(reader); err != nil || string(data) != "value-050" {
+		t.Fatalf("bad reader after compact: %q, %v", data, err)
+	}
+}
+
+func TestCompactConcurrent(t *testing.T) {
+	var filename = "db/compact_concurrent.db"
+	os.Remove(filename)
+	if err := os.MkdirAll("db", 0777); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filename)
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetSync(false)
+	db.SetMmap(true)
+	const keys = 3 * compactBatch
+	for i := 0; i < keys; i++ {
+		if err := db.Put(fmt.Sprint(i), []byte("first")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// значения изменяются и удаляются во время копирования записей
+	var (
+		wg   sync.WaitGroup
+		stop = make(chan struct{})
+	)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; ; i += 4 {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				var key = fmt.Sprint(i % keys)
+				var err error
+				if i%3 == 0 {
+					err = db.Delete(key)
+				} else {
+					err = db.Put(key, []byte("second "+key))
+				}
+				if err != nil && err != ErrNotFound {
+					t.Error(err)
+					return
+				}
+				if _, err := db.Get(key); err != nil && err != ErrNotFound {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	var values = make(map[string][]byte)
+	if err := db.ForEach("", func(key string, value []byte) error {
+		values[key] = value
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if int(db.Count()) != len(values) {
+		t.Fatalf("bad reloaded count: %d of %d", db.Count(), len(values))
+	}
+	for key, value := range values {
+		if got, err := db.Get(key); err != nil || string(got) != string(value) {
+			t.Fatalf("bad reloaded value %q: %q, %v", key, got, err)
+		}
+	}
+}
+
+func TestAutoCompact(t *testing.T) {
+	var filename = "db/autocompact.db"
+	os.Remove(filename)
+	if err := os.MkdirAll("db", 0777); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filename)
+	db, err := OpenWithOptions(filename, &Options{AutoCompact: 0.9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value = make([]byte, 1024)
+	for i := 0; i < 200; i++ {
+		if err := db.Put(fmt.Sprint(i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var size = db.Stats().Size
+	for i := 0; i < 150; i++ {
+		if err := db.Delete(fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.Stats().FreeSlots == 0 {
+		t.Fatal("store compacted below threshold")
+	}
+	// сжатие выполняется в фоне после следующей записи
+	db.SetAutoCompact(0.5)
+	if err := db.Delete("150"); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		var stats = db.Stats()
+		if stats.FreeSlots == 0 && stats.Size < size/2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("store not compacted: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if db.Count() != 49 {
+		t.Fatal("bad compacted count:", db.Count())
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	// закрытие ожидает завершения сжатия, начатого перед ним
+	for i := 0; i < 150; i++ {
+		if err := db.Put(fmt.Sprint(i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.DeletePrefix("1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename + ".compact"); !os.IsNotExist(err) {
+		t.Error("compact file not removed:", err)
+	}
+	if db, err = Open(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,101 @@
+package keystore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+// Compression задает способ сжатия значений в хранилище.
+type Compression uint8
+
+// Поддерживаемые способы сжатия значений.
+const (
+	CompressionNone Compression = iota // без сжатия
+	CompressionGzip                    // сжатие gzip
+)
+
+// DefaultCompressionThreshold задает минимальный размер значения в байтах, начиная
+// с которого оно сжимается, если порог не был изменен с помощью
+// db.SetCompressionThreshold.
+const DefaultCompressionThreshold = 256
+
+// SetCompression задает способ сжатия новых значений при записи в хранилище.
+//
+// Сжатие применяется только к значениям, размер которых не меньше заданного
+// порога (по умолчанию DefaultCompressionThreshold), и только если сжатые данные
+// получаются меньше исходных. Признак сжатия сохраняется для каждой записи
+// отдельно, поэтому сжатые и несжатые значения могут храниться вместе, а
+// чтение сжатых значений не зависит от текущих настроек сжатия. Размеры
+// значений в файле хранилища при этом соответствуют сжатым данным.
+func (db *DB) SetCompression(c Compression) {
+	db.mu.Lock()
+	db.compress = c
+	if db.minsize == 0 {
+		db.minsize = DefaultCompressionThreshold
+	}
+	db.mu.Unlock()
+}
+
+// SetCompressionThreshold задает минимальный размер значения в байтах, начиная
+// с которого оно сжимается при записи.
+func (db *DB) SetCompressionThreshold(size int) {
+	db.mu.Lock()
+	db.minsize = size
+	db.mu.Unlock()
+}
+
+var gzipPool = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+// encode возвращает данные значения для записи в файл и флаги записи. При
+// необходимости данные сжимаются и шифруются.
+func (db *DB) encode(key string, value []byte) (data []byte, flags uint8, err error) {
+	data, flags, err = db.compressValue(value)
+	if err != nil || db.aead == nil {
+		return data, flags, err
+	}
+	data, err = seal(db.aead, key, data)
+	return data, flags, err
+}
+
+// compressValue сжимает значение, если это необходимо.
+func (db *DB) compressValue(value []byte) ([]byte, uint8, error) {
+	if db.compress != CompressionGzip || len(value) < db.minsize {
+		return value, 0, nil
+	}
+	var (
+		buf = new(bytes.Buffer)
+		zw  = gzipPool.Get().(*gzip.Writer)
+	)
+	defer gzipPool.Put(zw)
+	zw.Reset(buf)
+	if _, err := zw.Write(value); err != nil {
+		return nil, 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, 0, err
+	}
+	if buf.Len() >= len(value) {
+		return value, 0, nil // сжатие не дало выигрыша
+	}
+	return buf.Bytes(), recordCompressed, nil
+}
+
+// decode восстанавливает значение из данных, сохраненных в файле.
+func (db *DB) decode(key string, data []byte, flags uint8) (value []byte, err error) {
+	if db.aead != nil {
+		if data, err = unseal(db.aead, key, data); err != nil {
+			return nil, err
+		}
+	}
+	if flags&recordCompressed == 0 {
+		return data, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
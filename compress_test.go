@@ -0,0 +1,75 @@
+package keystore
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	var filename = "db/compress.db"
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(filename)
+	var large = []byte(strings.Repeat("compressed value ", 100))
+	if err := db.Put("plain", large); err != nil {
+		t.Fatal(err)
+	}
+	db.SetCompression(CompressionGzip)
+	if err := db.Put("large", large); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("small", []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+	if db.indexes["large"].Flags&recordCompressed == 0 ||
+		db.indexes["large"].DataSize >= uint32(len(large)) {
+		t.Error("large value not compressed")
+	}
+	if db.indexes["small"].Flags&recordCompressed != 0 {
+		t.Error("small value compressed")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// сжатые и несжатые значения читаются независимо от настроек
+	db, err = Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string][]byte{
+		"plain": large,
+		"large": large,
+		"small": []byte("small"),
+	} {
+		value, err := db.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(value, want) {
+			t.Errorf("bad value for %q", key)
+		}
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	// после удаления сжатого значения флаг удаления не теряется
+	if err := db.Put("last", []byte("last")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("large"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Has("large") || db.Count() != 3 {
+		t.Error("bad deleted compressed value")
+	}
+}
@@ -2,39 +2,103 @@ package keystore
 
 import (
 	"bytes"
+	"context"
+	"crypto/cipher"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
 	"os"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// var logger = log.New("DB")
-
 // DB описывает файловое хранилище данных, где значения задаются и выбираются
 // с помощью ключа (key-value store).
 type DB struct {
-	f       *os.File
-	indexes map[string]index // map with key and address of values
-	deleted []index          // свободные ячейки для записи данных
-	counter uint64           // счетчик
-	mu      sync.RWMutex     // блокировка одновременного доступа к файлам
-	sync    bool             // выполнять принудительный сброс данных в файл при каждой записи
+	reused   uint64            // счетчик повторного использования места
+	view     atomic.Value      // копия индекса для чтения без блокировки
+	meter    atomic.Value      // получатель статистики операций
+	log      atomic.Value      // журнал отладочных сообщений
+	f        File              // файл с данными хранилища
+	closed   bool              // хранилище закрыто
+	name     string            // имя в списке открытых хранилищ
+	temp     bool              // удалить файл при закрытии
+	sorted   []string          // отсортированный список ключей или nil
+	kmu      sync.Mutex        // блокировка построения списка ключей
+	indexes  map[string]index  // map with key and address of values
+	deleted  freeTree          // свободные ячейки для записи данных
+	trash    map[string]index  // удаленные записи, хранящиеся в корзине
+	soft     bool              // удаленные записи помещаются в корзину
+	starts   map[uint32]index  // свободные ячейки по смещению
+	ends     map[uint32]uint32 // смещения свободных ячеек по смещению их конца
+	bulk     bool              // выполняется пакетная загрузка
+	alloc    AllocStrategy     // стратегия выделения свободного места
+	counter  uint64            // счетчик
+	slot     int               // слот с текущим значением счетчика
+	start    int64             // размер заголовка файла
+	size     int64             // конец данных в файле
+	stored   int64             // конец данных, сохраненный в заголовке файла
+	endAt    int64             // смещение слота с концом данных или 0
+	flags    uint32            // флаги формата файла
+	check    []byte            // блок проверки ключа шифрования
+	aead     cipher.AEAD       // шифрование значений
+	mmap     []byte            // отображение файла в память или nil
+	usemmap  bool              // читать значения через отображение в память
+	mu       sync.RWMutex      // блокировка одновременного доступа к файлам
+	pmu      sync.RWMutex      // ожидание завершения параллельной записи
+	shards   []sync.Mutex      // блокировки ключей при параллельной записи
+	pending  map[uint32]bool   // смещения еще не записанных новых записей
+	written  *sync.Cond        // уведомление о сдвиге конца данных
+	policy   SyncPolicy        // политика сброса данных в файл после записи
+	flusher  *flusher          // периодический сброс данных в файл
+	ro       bool              // хранилище открыто только для чтения
+	warnings []string          // предупреждения при загрузке файла
+	compress Compression       // способ сжатия значений
+	minsize  int               // минимальный размер сжимаемых значений
+	jsonOnly bool              // сохранять только значения в формате JSON
+	maxvalue uint32            // ограничение размера значения
+	maxfile  int64             // ограничение размера файла
+	lookups  secondaryIndexes  // вторичные индексы по именам
+	maxfree  int               // ограничение количества свободных мест
+	lost     uint64            // количество отброшенных свободных мест
+	lostSize uint64            // размер отброшенных свободных мест
+	loader   Loader            // функция загрузки отсутствующих значений
+	loads    map[string]*load  // выполняющиеся в данный момент загрузки
+	lmu      sync.Mutex        // блокировка списка загрузок
+	watches  map[*watch]bool   // подписки на изменения
+	wmu      sync.Mutex        // блокировка списка подписок
+	compact  *compaction       // выполняющееся сжатие файла или nil
+	cmu      sync.Mutex        // выполнение только одного сжатия
+	cwg      sync.WaitGroup    // завершение сжатия в фоне
+	cstop    func()            // прерывание сжатия в фоне
+	autoc    float64           // порог автоматического сжатия
 }
 
-// open открывает файл с данными и инициализирует работу с ним.
+// open открывает файл с данными с помощью openFile и инициализирует работу с
+// ним.
 //
 // По умолчанию открытое хранилище использует синхронную запись данных. Если
-// необходимо это отменить, то можно воспользоваться методом db.SetSync()
-// после открытия хранилища.
-func open(filename string) (db *DB, err error) {
-	// logger.Debug("open", "filename", filename)
-	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0666)
+// необходимо это отменить, то можно воспользоваться методами db.SetSync() или
+// db.SetSyncPolicy() после открытия хранилища.
+//
+// Если указан флаг readOnly, то файл открывается только для чтения и не
+// создается в случае его отсутствия.
+//
+// Во время построения индекса периодически проверяется состояние контекста и,
+// если он был отменен, то открытие прерывается с ошибкой контекста.
+//
+// Если указан шифр aead, то новый файл создается с шифрованием значений, а
+// для существующего файла проверяется, что он зашифрован именно этим ключом.
+func open(ctx context.Context, openFile FileOpener, filename string,
+	readOnly bool, aead cipher.AEAD) (db *DB, err error) {
+	file, err := openFile(filename, readOnly)
 	if err != nil {
 		return nil, err
 	}
@@ -44,105 +108,219 @@ func open(filename string) (db *DB, err error) {
 			_ = file.Close() // закрываем файл
 		}
 	}()
+	return loadFile(ctx, file, readOnly, aead)
+}
 
-	// header описывает заголовок файла с индексом и данными
-	const signature uint32 = 0xD3EFAA03
-	var header = &struct {
-		Signature uint32 // заголовок файла
-		Counter   uint64 // глобальный счетчик для генерации уникальых значений
-	}{
-		Signature: signature,
+// loadFile инициализирует хранилище с данными из уже открытого файла. Файл
+// не закрывается в случае ошибки.
+func loadFile(ctx context.Context, file File, readOnly bool,
+	aead cipher.AEAD) (db *DB, err error) {
+	// заголовок файла с сигнатурой и счетчиком
+	var head = newHeader(0)
+	// если файл только создан, то записываем вначало заголовок,
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
 	}
-	// если файл только создан, то записываем вначало сигнатуру,
-	if info, _ := file.Stat(); info.Size() == 0 {
+	if size == 0 && !readOnly {
+		if aead != nil {
+			head.Flags |= flagEncrypted
+			if head.Check, err = newCheck(aead); err != nil {
+				return nil, err
+			}
+		}
 		// записываем заголовок индекса
-		if err = binary.Write(file, binary.BigEndian, header); err != nil {
+		head.End = head.Size()
+		if err = head.write(io.NewOffsetWriter(file, 0)); err != nil {
 			return nil, err
 		}
+		size = head.Size()
 		// иначе проверяем, что она там есть и версия совпадает
-	} else {
-		if err = binary.Read(file, binary.BigEndian, header); err != nil {
-			return nil, err
-		}
-		if header.Signature != signature {
-			return nil, &os.PathError{Op: "check", Path: file.Name(),
-				Err: errors.New("bad file format")}
-		}
+	} else if err = head.read(io.NewSectionReader(file, 0, size)); err != nil {
+		return nil, loadError(file.Name(), 0, err)
+	} else if err = verifyCheck(aead, head); err != nil {
+		return nil, &os.PathError{Op: "check", Path: file.Name(), Err: err}
+	}
+	// если конец данных известен, то записи читаются только до него
+	var end = size
+	if head.End > 0 && head.End < size {
+		end = head.End
 	}
 	// читаем файл с данными и воспроизводим индекс
 	var (
-		offset      int64 = 12                      // размер заголовка с счетчиком
-		storedIndex       = new(storedIndex)        // сохраненная информация об индексе
-		indexes           = make(map[string]index)  // список индексов по именами ключей
-		times             = make(map[string]uint32) // используется для разрешения конфликтов
-		deleted           = make([]index, 0, 100)   // список свободных мест
+		reader = newRecordReader( // последовательное чтение записей
+			io.NewSectionReader(file, head.Size(), end-head.Size()),
+			head.Size(), head.Flags)
+		record   = new(record)            // прочитанная запись
+		indexes  = make(map[string]index) // список индексов по именами ключей
+		deleted  freeTree                 // список свободных мест
+		trash    = make(map[string]index) // записи в корзине
+		warnings []string                 // предупреждения при загрузке
 	)
-	for {
-		// читаем заголовок с индексной информацией
-		if err = binary.Read(file, binary.BigEndian, storedIndex); err != nil {
-			break
+	reader.size = end
+	for n := 1; ; n++ {
+		// периодически проверяем, что открытие не отменено
+		if n%checkInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return nil, err
+			}
 		}
-		// читаем имя ключа
-		var key = make([]byte, storedIndex.KeySize)
-		if _, err = file.Read(key); err != nil {
+		// читаем запись с индексной информацией
+		if err = reader.next(record); err != nil {
 			break
 		}
-		var strKey = string(key)
-		// инициализируем описание индекса и сохраняем его
-		var index = index{
-			Offset:    uint32(offset),
-			KeySize:   storedIndex.KeySize,
-			DataSize:  storedIndex.DataSize,
-			EmptySize: storedIndex.EmptySize,
+		if !record.Valid {
+			return nil, &os.PathError{Op: "check", Path: file.Name(),
+				Err: fmt.Errorf("%w at offset %d", ErrChecksum, record.Offset)}
 		}
-		if !storedIndex.Deleted {
+		var strKey = string(record.Key)
+		// инициализируем описание индекса и сохраняем его
+		var index = record.index()
+		if !record.Deleted() {
 			// на всякий случай, проверяем возможное дублирование ключей
 			if idx, ok := indexes[strKey]; ok {
-				// logger.Warn("dublicate", "key", strKey)
-				if times[strKey] < storedIndex.Time {
+				warnings = append(warnings, fmt.Sprintf(
+					"duplicate key %q at offsets %d and %d", strKey,
+					idx.Offset, index.Offset))
+				if idx.Time < index.Time {
 					// попалось более свежее значение
-					deleted = append(deleted, idx)   // освобождаем старое
-					indexes[strKey] = index          // сохраняем новое
-					times[strKey] = storedIndex.Time // запоминаем временную метку
+					deleted.insert(idx)     // освобождаем старое
+					indexes[strKey] = index // сохраняем новое
 				} else {
 					// попалось более старое значение
-					deleted = append(deleted, index) // записываем как свободное место
+					deleted.insert(index) // записываем как свободное место
 				}
 			} else {
-				// такого индекса еще нет
-				indexes[strKey] = index          // сохраняем новое
-				times[strKey] = storedIndex.Time // запоминаем временную метку
+				indexes[strKey] = index // такого индекса еще нет
 			}
+		} else if record.Flags&recordRetained == 0 {
+			deleted.insert(index)
+		} else if idx, ok := trash[strKey]; ok && idx.Time > index.Time {
+			deleted.insert(index) // в корзине остается последнее удаление
 		} else {
-			deleted = append(deleted, index)
-		}
-		// logger.Debug("load index", "key", strKey, "index", index, "deleted", storedIndex.Deleted)
-		offset += storedIndex.Size() // позиция следующей записи
-		// пропускаем данные и возможное свободное пространство за ними
-		// и устанавливаем курсор на следующие данные
-		if _, err = file.Seek(offset, io.SeekStart); err != nil {
-			break
+			if ok {
+				deleted.insert(idx)
+			}
+			trash[strKey] = index
 		}
 	}
 	if err != io.EOF {
-		return nil, err
+		return nil, loadError(file.Name(), record.Offset, err)
+	}
+	if head.End > size {
+		// файл обрезан, но по границе записи
+		return nil, loadError(file.Name(), reader.offset, errTruncated)
+	}
+	if head.End > 0 && reader.offset != head.End {
+		return nil, loadError(file.Name(), reader.offset, errDataEnd)
 	}
-	// сортируем удаленные данные по размеру занимаемого ими места
-	sort.Slice(deleted, func(i, j int) bool {
-		var s1, s2 = deleted[i].Size(), deleted[j].Size()
-		return s1 < s2 || (s1 == s2 && deleted[i].Offset < deleted[j].Offset)
-	})
 	// возвращаем инициализированное хранилище
 	db = &DB{
-		f:       file,
-		indexes: indexes,
-		deleted: deleted,
-		counter: header.Counter,
-		sync:    true,
+		f:        file,
+		indexes:  indexes,
+		deleted:  deleted,
+		trash:    trash,
+		counter:  head.Counter,
+		slot:     head.Slot,
+		start:    head.Size(),
+		size:     reader.offset,
+		stored:   head.End,
+		endAt:    head.endOffset(),
+		flags:    head.Flags,
+		check:    head.Check,
+		aead:     aead,
+		policy:   SyncAlways,
+		ro:       readOnly,
+		warnings: warnings,
 	}
+	db.indexFree()
+	db.resetView()
 	return db, nil
 }
 
+// LoadWarnings возвращает список предупреждений, обнаруженных при загрузке
+// файла хранилища. Сейчас это только повторяющиеся ключи: из нескольких
+// записей с одним ключом действующей считается самая новая, а остальные
+// становятся свободным местом. Появление таких записей говорит о сбое во
+// время записи в прошлом.
+func (db *DB) LoadWarnings() []string {
+	return db.warnings
+}
+
+// Reload заново читает файл хранилища и перестраивает индекс, не закрывая
+// сам файл. Используется, чтобы увидеть изменения, сделанные в файле другим
+// процессом, например, после того как он закрыл хранилище, открытое на запись.
+// Это дешевле, чем закрыть и снова открыть хранилище, и оно остается в списке
+// открытых.
+//
+// На время перечитывания файла все остальные операции с хранилищем
+// блокируются, поэтому они видят либо прежнее, либо уже обновленное
+// состояние. При ошибке чтения файла прежний индекс сохраняется без
+// изменений. Подписчики на изменения о перечитывании файла не уведомляются.
+func (db *DB) Reload() error {
+	db.pmu.Lock()
+	defer db.pmu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return &os.PathError{Op: "reload", Path: db.Path(), Err: ErrClosed}
+	}
+	fresh, err := loadFile(context.Background(), db.f, db.ro, db.aead)
+	if err != nil {
+		return err
+	}
+	db.staleCompaction()
+	db.indexes, db.deleted = fresh.indexes, fresh.deleted
+	db.trash = fresh.trash
+	db.starts, db.ends = fresh.starts, fresh.ends
+	db.counter, db.slot = fresh.counter, fresh.slot
+	db.size, db.stored, db.endAt = fresh.size, fresh.stored, fresh.endAt
+	db.lost, db.lostSize = 0, 0
+	db.trimFree()
+	db.resetView()
+	db.flags, db.check = fresh.flags, fresh.check
+	db.warnings = fresh.warnings
+	db.sorted = nil // список ключей мог измениться
+	if size, err := db.f.Seek(0, io.SeekEnd); err == nil {
+		db.remap(size) // файл мог увеличиться
+	}
+	db.logLoad()
+	for _, idx := range db.lookups {
+		if err := idx.rebuild(db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadError возвращает описание ошибки, произошедшей при чтении файла
+// хранилища по указанному смещению. Неизвестная сигнатура файла возвращается
+// как ErrBadSignature, а обрезанные данные и записи, выходящие за пределы
+// файла, — как ErrCorruptIndex. Остальные ошибки чтения возвращаются с
+// указанием смещения.
+func loadError(filename string, offset int64, err error) error {
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		err = ErrCorruptIndex
+	case ErrBadSignature, ErrCorruptIndex, errOutOfBounds:
+	default:
+		return &os.PathError{Op: "read", Path: filename,
+			Err: fmt.Errorf("at offset %d: %w", offset, err)}
+	}
+	return &os.PathError{Op: "check", Path: filename,
+		Err: fmt.Errorf("%w at offset %d", err, offset)}
+}
+
+// recordHeaderSize возвращает размер заголовка записи в файле хранилища.
+func (db *DB) recordHeaderSize() int64 {
+	return recordHeaderSize(db.flags)
+}
+
+// dataOffset возвращает смещение относительно начала файла для чтения данных.
+func (db *DB) dataOffset(i index) int64 {
+	return int64(i.Offset) + db.recordHeaderSize() + int64(i.KeySize)
+}
+
 // String возвращает имя файла с хранилища с префиксом "db:" и обычно
 // используется для отладки или вывода в лог имени хранилища.
 func (db *DB) String() string {
@@ -158,42 +336,109 @@ func (db *DB) Path() string {
 //
 // Вызов данного метода обычно не требуется, если вручную не выключен
 // автоматический сброс кешей при любой операции записи.
+//
+// Для хранилища, открытого только для чтения, ничего не делает.
 func (db *DB) Sync() error {
-	// logger.Trace("sync")
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	return db.sync()
+}
+
+// sync сбрасывает данные из кеша в файл без проверки того, что хранилище
+// открыто. Может вызываться как с блокировкой, так и без нее.
+func (db *DB) sync() error {
+	if db.ro {
+		return nil
+	}
 	return db.f.Sync()
 }
 
 // SetSync устанавливает значение флага автоматического сброса кеша после
-// каждой записи.
+// каждой записи. Является сокращением для SetSyncPolicy с политикой
+// SyncAlways или SyncNever.
 func (db *DB) SetSync(sync bool) {
-	db.mu.Lock()
-	db.sync = sync
-	db.mu.Unlock()
+	if sync {
+		db.SetSyncPolicy(SyncAlways, 0)
+	} else {
+		db.SetSyncPolicy(SyncNever, 0)
+	}
 }
 
 // close закрывает файл с данными хранилища.
 func (db *DB) close() (err error) {
-	if db.f.Fd() == ^(uintptr(0)) {
-		return nil // файл уже закрыт
+	defer db.cwg.Wait() // сжатие в фоне завершится, увидев закрытие
+	db.pmu.Lock()       // ожидаем завершения параллельной записи
+	defer db.pmu.Unlock()
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrClosed
 	}
-	db.mu.RLock()
-	if db.sync {
-		err = db.Sync()
+	db.closed = true
+	if db.cstop != nil {
+		db.cstop() // прерываем сжатие в фоне
+	}
+	db.view.Store((*sync.Map)(nil)) // чтение без блокировки больше недоступно
+	var policy, flusher = db.policy, db.flusher
+	var indexes, state = db.lookups, []byte(nil)
+	if len(indexes) > 0 {
+		state = db.fingerprint() // индексы соответствуют данным
+	}
+	db.flusher, db.lookups = nil, nil
+	db.unmap() // читатели уже не используют отображение
+	// методы, которые не возвращают ошибку, после закрытия видят пустое
+	// хранилище, а не данные на момент закрытия
+	db.indexes, db.trash, db.sorted = make(map[string]index), nil, nil
+	db.deleted = freeTree{}
+	db.indexFree()
+	db.lost, db.lostSize = 0, 0
+	// блокировка удерживается до закрытия файла: операции, начатые до
+	// закрытия, к этому моменту уже завершены, а все последующие вернут
+	// ErrClosed, не обращаясь к файлу
+	// данные должны оказаться на диске раньше, чем индексы будут помечены
+	// соответствующими им
+	if policy != SyncNever || state != nil {
+		err = db.sync()
+	}
+	db.unwatchAll()
+	if logger := db.logger(); logger != nil {
+		logger.Debug("close")
 	}
-	db.mu.RUnlock()
-	// logger.Debug("close")
 	if err2 := db.f.Close(); err == nil {
 		err = err2
 	}
+	db.mu.Unlock()
+	// фоновый сброс ожидает блокировку, поэтому останавливается после ее
+	// снятия и уже не обращается к закрытому файлу
+	flusher.stop()
+	if err != nil {
+		state = nil // индексы будут построены заново
+	}
+	if err2 := closeIndexes(indexes, state); err == nil {
+		err = err2
+	}
+	if db.temp {
+		if err2 := os.Remove(db.f.Name()); err == nil {
+			err = err2
+		}
+	}
 	return err
 }
 
 // Close закрывает хранилище. Если специально не задано не выполнять
 // синхронизацию, то при этом происходит принудительный сброс кешей в файл.
-// Повторное выполнение уже закрытого хранилища не приводит к ошибке.
+// Повторное закрытие уже закрытого хранилища возвращает ошибку ErrClosed, так
+// же как и чтение или изменение значений после закрытия. Методы, которые не
+// возвращают ошибку, такие как Count или Keys, после закрытия возвращают
+// результат для пустого хранилища.
 func (db *DB) Close() error {
 	mu.Lock()
-	delete(dbs, db.f.Name()) // удаляем из списка открытых
+	if dbs[db.name] == db {
+		delete(dbs, db.name) // удаляем из списка открытых
+	}
 	mu.Unlock()
 	return db.close()
 }
@@ -205,21 +450,188 @@ func (db *DB) Count() uint32 {
 	return uint32(len(db.indexes))
 }
 
+// CountPrefix возвращает количество ключей, начинающихся с prefix. Для
+// пустого префикса возвращает то же, что и Count.
+func (db *DB) CountPrefix(prefix string) uint32 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if prefix == "" {
+		return uint32(len(db.indexes))
+	}
+	var count uint32
+	for key := range db.indexes {
+		if strings.HasPrefix(key, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
 // NextSequence возвращает значение счетчика, которое увеличивается при каждом
 // обращении к данной функции. Обычно используется для задания гарантированного
 // уникального идентификатора записи хранилища, т.к. последнее использованное
 // значение сохраняется в хранилище.
+//
+// Значение счетчика сбрасывается в файл сразу, если только для хранилища не
+// установлена политика SyncNever. Сбой во время записи счетчика не приводит
+// к потере предыдущего сохраненного значения.
 func (db *DB) NextSequence() (uint64, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if db.closed {
+		return db.counter, ErrClosed
+	}
+	if db.ro {
+		return db.counter, ErrReadOnly
+	}
+	if err := db.writeCounter(db.counter + 1); err != nil {
+		return db.counter, err
+	}
 	db.counter++
-	var counter = make([]byte, 8)
-	binary.BigEndian.PutUint64(counter, db.counter)
-	_, err := db.f.WriteAt(counter, 4) // счетчик идет сразу после сигнатуры файла
-	if err == nil && db.sync {
-		err = db.Sync()
+	return db.counter, nil
+}
+
+// Sequence возвращает текущее значение счетчика, не изменяя его: это
+// последнее значение, выданное NextSequence, ReserveSequence или NextUID.
+func (db *DB) Sequence() uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.counter
+}
+
+// ErrSequenceDecrease возвращается SetSequence при попытке уменьшить значение
+// счетчика.
+var ErrSequenceDecrease = errors.New("sequence cannot decrease")
+
+// SetSequence увеличивает значение счетчика до v, например, после импорта
+// данных с идентификаторами, выданными в другом месте. Следующий вызов
+// NextSequence вернет v+1. Значение сохраняется в файле так же, как и в
+// случае NextSequence.
+//
+// Счетчик не может уменьшаться, иначе выданные ранее значения могли бы
+// повториться, поэтому для v меньше текущего значения возвращается ошибка
+// ErrSequenceDecrease. Для v равного текущему значению ничего не делает.
+func (db *DB) SetSequence(v uint64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if db.ro {
+		return ErrReadOnly
+	}
+	if v < db.counter {
+		return ErrSequenceDecrease
+	}
+	if v == db.counter {
+		return nil
+	}
+	if err := db.writeCounter(v); err != nil {
+		return err
+	}
+	db.counter = v
+	return nil
+}
+
+// errSequenceOverflow возвращается, если счетчик не может быть увеличен на
+// запрошенное значение без переполнения.
+var errSequenceOverflow = errors.New("sequence overflow")
+
+// ReserveSequence резервирует сразу n последовательных значений счетчика и
+// возвращает первое из них: зарезервированными считаются значения от start
+// до start+n-1 включительно. Счетчик в файле увеличивается на n одной
+// записью, поэтому ни одно из зарезервированных значений не будет выдано
+// повторно, даже если они так и не были использованы.
+//
+// Это позволяет выдавать уникальные идентификаторы самостоятельно без
+// обращения к хранилищу за каждым из них. При n равном 0 ничего не
+// резервируется и возвращается значение, которое будет выдано следующим.
+func (db *DB) ReserveSequence(n uint64) (start uint64, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return 0, ErrClosed
+	}
+	if db.ro {
+		return 0, ErrReadOnly
+	}
+	if db.counter+n < db.counter {
+		return 0, errSequenceOverflow
+	}
+	start = db.counter + 1
+	if n == 0 {
+		return start, nil
+	}
+	if err := db.writeCounter(db.counter + n); err != nil {
+		return 0, err
+	}
+	db.counter += n
+	return start, nil
+}
+
+// NextUID возвращает уникальный идентификатор, основанный на текущем времени
+// и счетчике хранилища. В отличие от NewUID, его уникальность и монотонное
+// возрастание сохраняются и после повторного открытия хранилища, так как
+// последний выданный идентификатор сохраняется в файле так же, как и в
+// случае NextSequence.
+//
+// Для этого используется тот же самый счетчик, что и в NextSequence:
+// идентификатор соответствует времени, если оно больше последнего значения
+// счетчика, или просто следующему значению счетчика. Поэтому NextSequence и
+// NextUID можно использовать совместно в качестве единого источника
+// уникальных значений, но после вызова NextUID значения NextSequence
+// перескакивают на значения идентификаторов. Если системное время было
+// переведено назад или за единицу времени идентификатора выдано больше
+// 1048576 значений, то время в идентификаторе может немного опережать
+// реальное. Номер процесса в таких идентификаторах не используется: его
+// биты вместе с битами счетчика заняты значением счетчика хранилища.
+func (db *DB) NextUID() (UID, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return 0, ErrClosed
+	}
+	if db.ro {
+		return 0, ErrReadOnly
+	}
+	var next = uint64(DateUID(time.Now())) // время без счетчика
+	if next <= db.counter {
+		if db.counter+1 == 0 {
+			return 0, errSequenceOverflow
+		}
+		next = db.counter + 1
+	}
+	if err := db.writeCounter(next); err != nil {
+		return 0, err
+	}
+	db.counter = next
+	return UID(next), nil
+}
+
+// writeCounter сохраняет новое значение счетчика в файле.
+//
+// Если формат файла поддерживает слоты для счетчика, то значение записывается
+// в тот из них, который не содержит текущего значения. Сброс данных в файл
+// выполняется сразу, если только не используется политика SyncNever:
+// значение счетчика должно сохраниться, чтобы не быть выданным повторно после
+// сбоя.
+func (db *DB) writeCounter(counter uint64) (err error) {
+	if db.flags&flagCounterSlots != 0 {
+		var slot = 1 - db.slot
+		_, err = db.f.WriteAt(counterSlot(counter),
+			counterSlotsOffset+int64(slot)*counterSlotSize)
+		if err == nil {
+			db.slot = slot
+		}
+	} else {
+		var data = make([]byte, 8)
+		binary.BigEndian.PutUint64(data, counter)
+		_, err = db.f.WriteAt(data, 4) // счетчик идет сразу после сигнатуры файла
+	}
+	if err == nil && db.policy != SyncNever {
+		err = db.sync()
 	}
-	return db.counter, err
+	return err
 }
 
 // ErrNotFound возвращается, если данные с таким ключом в хранилище не найдены.
@@ -231,18 +643,120 @@ func (db *DB) NextSequence() (uint64, error) {
 // проверки на то, что значения с таким ключем нет в хранилище.
 var ErrNotFound = errors.New("key not found")
 
+// ErrLocked возвращается при открытии хранилища, если файл уже открыт на
+// запись другим процессом или, при открытии на запись, открыт кем-то еще.
+var ErrLocked = errors.New("store is locked by another process")
+
+// ErrClosed возвращается при обращении к уже закрытому хранилищу, в том числе
+// при его повторном закрытии. Ошибка также соответствует os.ErrClosed при
+// проверке с помощью errors.Is.
+var ErrClosed = fmt.Errorf("store closed: %w", os.ErrClosed)
+
+// ErrReadOnly возвращается при попытке изменения хранилища, открытого только
+// для чтения.
+var ErrReadOnly = errors.New("read-only store")
+
+// MaxKeySize задает максимальную длину ключа в байтах.
+const MaxKeySize = math.MaxUint8
+
+// ErrKeyTooLong возвращается при попытке сохранить значение с ключом длиннее
+// MaxKeySize байт.
+var ErrKeyTooLong = errors.New("key too long")
+
+// ErrEmptyKey возвращается при попытке сохранить значение с пустым ключом.
+// Запись без ключа в файле хранилища используется только для описания
+// свободного места.
+var ErrEmptyKey = errors.New("empty key")
+
+// checkKey проверяет, что ключ может быть сохранен в хранилище.
+func checkKey(key string) error {
+	if key == "" {
+		return ErrEmptyKey
+	}
+	if len(key) > MaxKeySize {
+		return ErrKeyTooLong
+	}
+	return nil
+}
+
+// ErrValueTooLarge возвращается при попытке сохранить значение, которое вместе
+// с ключом не укладывается в 4 Гб (размер записи в формате файла хранилища
+// представлен 32-битным числом) или превышает ограничение, заданное
+// db.SetMaxValueSize.
+var ErrValueTooLarge = errors.New("value too large")
+
+// ErrFileTooLarge возвращается, если для записи данных пришлось бы увеличить
+// файл хранилища больше 4 Гб: смещение записей в формате файла хранилища так же
+// представлено 32-битным числом.
+var ErrFileTooLarge = errors.New("file too large")
+
 // get возвращает данные, сохраненные с указанным ключом.
 func (db *DB) get(key string) ([]byte, error) {
+	if db.closed {
+		return nil, ErrClosed
+	}
 	index, ok := db.indexes[string(key)]
 	if !ok {
 		return nil, ErrNotFound
 	}
+	data, err := db.read(index)
+	if err != nil {
+		return nil, err
+	}
+	return db.decode(key, data, index.Flags)
+}
+
+// GetReader возвращает значение с указанным ключом в виде io.ReadSeeker, не
+// загружая его в память целиком. Это удобно для отдачи больших значений, в
+// том числе с помощью http.ServeContent. Если значения с таким ключом нет, то
+// возвращается ошибка ErrNotFound.
+//
+// Возвращаемый объект читает данные непосредственно из файла хранилища без
+// блокировки, поэтому значение не должно изменяться или удаляться, пока он
+// используется: новое значение всегда записывается на новое место, но
+// освободившееся после перезаписи или удаления место может быть занято
+// другим значением или отрезано от файла. Сжатые или
+// зашифрованные значения при этом все равно распаковываются в память целиком
+// и такому ограничению не подвержены.
+//
+// Сжатие хранилища (см. db.Compact и db.SetAutoCompact) заменяет файл, после
+// чего чтение из полученных до этого объектов завершается ошибкой
+// ErrCompacted: их необходимо получить заново.
+func (db *DB) GetReader(key string) (io.ReadSeeker, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	index, ok := db.indexes[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if db.aead != nil || index.Flags&recordCompressed != 0 {
+		value, err := db.get(key)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(value), nil
+	}
+	var file io.ReaderAt = db.f
+	if locked, ok := db.f.(*lockedFile); ok {
+		file = snapshotFile{locked: locked, file: locked.os()}
+	}
+	return io.NewSectionReader(file, db.dataOffset(index),
+		int64(index.DataSize)), nil
+}
+
+// read возвращает данные записи в том виде, в котором они сохранены в файле.
+func (db *DB) read(index index) ([]byte, error) {
 	var data = make([]byte, index.DataSize)
-	_, err := db.f.ReadAt(data, index.DataOffset())
+	if db.readMapped(data, db.dataOffset(index)) {
+		return data, nil
+	}
+	_, err := db.f.ReadAt(data, db.dataOffset(index))
 	if err != nil {
 		return nil, err
 	}
-	// logger.Debug("get", "key", string(key), "value", string(data), "index", index)
 	return data, nil
 }
 
@@ -250,21 +764,61 @@ func (db *DB) get(key string) ([]byte, error) {
 // ключем в хранилище не сохранены, то возвращается ошибка ErrNotFound и nil
 // в качестве значения. Для пустого значения (nil) всегда возвращается пуcтой
 // массив байт ([]byte{}).
-func (db *DB) Get(key string) ([]byte, error) {
+//
+// Если для хранилища задана функция загрузки (db.SetLoader), то для
+// отсутствующих ключей значение запрашивается у нее и сохраняется.
+//
+// Для значений, которые были удалены в режиме db.SetSoftDelete и еще
+// находятся в корзине, возвращается ошибка ErrDeleted.
+func (db *DB) Get(key string) (value []byte, err error) {
+	if metrics := db.metrics(); metrics != nil {
+		defer func() { metrics.ObserveGet(err == nil, len(value)) }()
+	}
+	if value, ok := db.getView(key); ok {
+		return value, nil
+	}
 	db.mu.RLock()
-	defer db.mu.RUnlock()
-	return db.get(key)
+	_, ok := db.indexes[key]
+	if _, deleted := db.trash[key]; !ok && deleted {
+		db.mu.RUnlock()
+		return nil, ErrDeleted
+	}
+	if ok || db.loader == nil {
+		defer db.mu.RUnlock()
+		return db.get(key)
+	}
+	var loader = db.loader
+	db.mu.RUnlock()
+	return db.load(key, loader)
 }
 
 // GetJSON преобразует значение из хранилища обратно в объект. Возвращает
 // ошибку, если данные с таким ключем не сохранены или формат сохраненных
 // данных не соответствует формату JSON.
 func (db *DB) GetJSON(key string, v interface{}) error {
+	return db.GetCodec(key, v, JSON)
+}
+
+// GetGob преобразует значение, сохраненное с помощью PutGob, обратно в объект.
+// Возвращает ошибку, если данные с таким ключем не сохранены или не
+// соответствуют формату encoding/gob.
+func (db *DB) GetGob(key string, v interface{}) error {
+	return db.GetCodec(key, v, Gob)
+}
+
+// GetCodec преобразует значение из хранилища обратно в объект с помощью
+// указанного формата сериализации. Если формат не указан, то используется
+// DefaultCodec. Возвращает ошибку, если данные с таким ключем не сохранены или
+// не могут быть преобразованы.
+func (db *DB) GetCodec(key string, v interface{}, codec Codec) error {
+	if codec == nil {
+		codec = DefaultCodec
+	}
 	data, err := db.Get(key)
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(data, v)
+	return codec.Unmarshal(data, v)
 }
 
 // Gets возвращает список значений, соответствующих списку ключей. Игнорирует
@@ -283,6 +837,66 @@ func (db *DB) Gets(keys ...string) (result [][]byte, err error) {
 	return result, nil
 }
 
+// GetMap возвращает значения для указанных ключей в виде словаря. В словарь
+// попадают только найденные ключи, поэтому наличие ключа в хранилище
+// определяется по его наличию в словаре, а не по значению: сохраненное пустое
+// значение тоже имеет нулевую длину.
+func (db *DB) GetMap(keys ...string) (map[string][]byte, error) {
+	var result = make(map[string][]byte, len(keys))
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for _, key := range keys {
+		data, err := db.get(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		result[key] = data
+	}
+	return result, nil
+}
+
+// GetsWithFound возвращает список значений, соответствующих списку ключей, и
+// признаки того, что значение для ключа с тем же номером найдено. В отличие
+// от Gets позволяет отличить сохраненное пустое значение от отсутствующего.
+func (db *DB) GetsWithFound(keys ...string) (values [][]byte, found []bool, err error) {
+	values = make([][]byte, len(keys))
+	found = make([]bool, len(keys))
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for i, key := range keys {
+		values[i], err = db.get(key)
+		switch err {
+		case nil:
+			found[i] = true
+		case ErrNotFound:
+		default:
+			return nil, nil, err
+		}
+	}
+	return values, found, nil
+}
+
+// GetRawJSON возвращает значение с указанным ключом в формате
+// json.RawMessage без его разбора. Возвращает ошибку ErrNotFound, если
+// значения с таким ключом нет, или ошибку, если сохраненные данные не
+// соответствуют формату JSON.
+//
+// Как и GetsJSON, удобно использовать для отдачи значения в ответ на
+// HTTP-запрос без его повторного преобразования в JSON.
+func (db *DB) GetRawJSON(key string) (json.RawMessage, error) {
+	data, err := db.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(data) {
+		return nil, invalidJSON(key, data)
+	}
+	return json.RawMessage(data), nil
+}
+
 // GetsJSON возвращает массив значений для указанных ключей в формате
 // json.RawMessage. Возвращает ошибку, если сохраненные данные не соответствуют
 // формату JSON. Для тех ключей, для которых не задано значение, возвращается
@@ -291,22 +905,126 @@ func (db *DB) Gets(keys ...string) (result [][]byte, err error) {
 // Данную функцию удобно использовать для отдачи результатов выборки в ответ
 // на HTTP-запрос.
 func (db *DB) GetsJSON(keys ...string) (result []json.RawMessage, err error) {
-	result = make([]json.RawMessage, len(keys))
+	return db.getsJSON(keys, true)
+}
+
+// GetsRawUnchecked возвращает массив значений для указанных ключей в формате
+// json.RawMessage, как и GetsJSON, но не проверяет, что они действительно
+// соответствуют формату JSON. Для тех ключей, для которых не задано значение,
+// возвращается nil.
+//
+// Проверка формата при отдаче большого количества значений занимает заметное
+// время, поэтому эту функцию имеет смысл использовать, если все значения
+// заведомо записаны в формате JSON, например, с помощью PutJSON или в режиме
+// db.SetJSONOnly. В остальных случаях следует использовать GetsJSON: иначе
+// некорректные данные попадут прямо в ответ.
+func (db *DB) GetsRawUnchecked(keys ...string) ([]json.RawMessage, error) {
+	return db.getsJSON(keys, false)
+}
+
+// getsJSON возвращает массив значений для указанных ключей в формате
+// json.RawMessage. Если указан флаг validate, то проверяется, что значения
+// соответствуют формату JSON.
+func (db *DB) getsJSON(keys []string, validate bool) ([]json.RawMessage, error) {
+	var result = make([]json.RawMessage, len(keys))
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 	for i, key := range keys {
 		data, err := db.get(key)
-		if err != nil && err != ErrNotFound {
+		if err == ErrNotFound {
+			continue // для отсутствующих ключей возвращается nil
+		}
+		if err != nil {
 			return nil, err
 		}
-		if !json.Valid(data) {
-			return nil, fmt.Errorf("invalid JSON format for key %q", key)
+		if validate && !json.Valid(data) {
+			return nil, invalidJSON(key, data)
 		}
 		result[i] = json.RawMessage(data)
 	}
 	return result, nil
 }
 
+// ErrInvalidJSON возвращается, если значение не соответствует формату JSON:
+// при чтении с помощью GetRawJSON и GetsJSON или при записи в хранилище, для
+// которого задан режим db.SetJSONOnly.
+var ErrInvalidJSON = errors.New("invalid JSON format")
+
+// invalidJSON возвращает ошибку ErrInvalidJSON для значения с указанным
+// ключом. Для облегчения поиска источника ошибки в нее включается начало
+// значения.
+func invalidJSON(key string, value []byte) error {
+	const maxPrefix = 32 // максимальная длина начала значения в ошибке
+	var prefix = string(value)
+	if len(prefix) > maxPrefix {
+		prefix = prefix[:maxPrefix] + "..."
+	}
+	return fmt.Errorf("%w for key %q: %q", ErrInvalidJSON, key, prefix)
+}
+
+// SetJSONOnly включает строгий режим, в котором хранилище принимает только
+// значения в формате JSON: запись любых других значений, в том числе с
+// помощью Put и PutReader, завершается ошибкой ErrInvalidJSON. Это позволяет
+// обнаружить ошибку при записи, а не при последующем чтении с помощью
+// GetsJSON. Уже сохраненные значения при включении режима не проверяются.
+func (db *DB) SetJSONOnly(strict bool) {
+	db.mu.Lock()
+	db.jsonOnly = strict
+	db.mu.Unlock()
+}
+
+// SetMaxValueSize ограничивает размер сохраняемых значений: запись значения
+// больше size байт, в том числе с помощью PutReader и Append, завершается
+// ошибкой ErrValueTooLarge еще до записи в файл. Ограничение защищает от
+// заполнения диска одним ошибочно большим значением. По умолчанию (size
+// равно 0) размер значений не ограничен. Уже сохраненные значения при
+// установке ограничения не проверяются.
+//
+// Ограничение применяется к значению до сжатия и шифрования.
+func (db *DB) SetMaxValueSize(size uint32) {
+	db.mu.Lock()
+	db.maxvalue = size
+	db.mu.Unlock()
+}
+
+// MaxValueSize возвращает ограничение размера сохраняемых значений,
+// установленное с помощью db.SetMaxValueSize, или 0, если размер не
+// ограничен.
+func (db *DB) MaxValueSize() uint32 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.maxvalue
+}
+
+// checkValue проверяет, что значение удовлетворяет ограничениям, заданным
+// db.SetMaxValueSize и db.SetJSONOnly.
+func (db *DB) checkValue(key string, value []byte) error {
+	if db.maxvalue > 0 && uint64(len(value)) > uint64(db.maxvalue) {
+		return ErrValueTooLarge
+	}
+	if db.jsonOnly && !json.Valid(value) {
+		return invalidJSON(key, value)
+	}
+	return nil
+}
+
+// ModTime возвращает время последнего сохранения значения с указанным ключом.
+// Если значения с таким ключом в хранилище нет, то возвращается ошибка
+// ErrNotFound. Время сохраняется с точностью до секунды.
+func (db *DB) ModTime(key string) (time.Time, error) {
+	db.mu.RLock()
+	index, ok := db.indexes[key]
+	var closed = db.closed
+	db.mu.RUnlock()
+	if closed {
+		return time.Time{}, ErrClosed
+	}
+	if !ok {
+		return time.Time{}, ErrNotFound
+	}
+	return time.Unix(int64(index.Time), 0), nil
+}
+
 // Has возвращает true, если значение с таким ключом определено.
 func (db *DB) Has(key string) bool {
 	db.mu.RLock()
@@ -336,105 +1054,379 @@ func (db *DB) Has(key string) bool {
 // offset задает сдвиг относительно начала списка, а limit - ограничивает
 // количество ключей в выборке.
 func (db *DB) Keys(prefix, last string, offset, limit uint32, asc bool) []string {
+	keys, _ := db.KeysContext(context.Background(), prefix, last, offset, limit, asc)
+	return keys
+}
+
+// KeysContext возвращает список ключей, подходящих под запрос, аналогично
+// db.Keys, но периодически проверяет состояние контекста во время выборки и
+// прерывает ее с ошибкой контекста, если он был отменен.
+func (db *DB) KeysContext(ctx context.Context, prefix, last string,
+	offset, limit uint32, asc bool) ([]string, error) {
 	db.mu.RLock()
-	var keys = make([]string, 0, len(db.indexes))
-	// выбираем подходящие ключи
-	for key := range db.indexes {
-		if prefix == "" || strings.HasPrefix(key, prefix) {
-			keys = append(keys, key)
-		}
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	return db.keys(ctx, prefix, last, offset, limit, asc)
+}
+
+// KeysFunc возвращает список ключей, начинающихся с prefix, отсортированный
+// с помощью функции сравнения less. Это позволяет задать произвольный порядок
+// сортировки, например, числовой для ключей с числами. less должна возвращать
+// true, если ключ a должен идти перед ключом b, и задавать строгий слабый
+// порядок, как того требует sort.Sort: иначе порядок ключей в выборке не
+// определен.
+//
+// offset задает сдвиг относительно начала отсортированного списка, а limit -
+// ограничивает количество ключей в выборке. В отличие от db.Keys, список
+// ключей сортируется при каждом вызове.
+func (db *DB) KeysFunc(prefix string, less func(a, b string) bool,
+	offset, limit uint32) []string {
+	db.mu.RLock()
+	var keys = make([]string, 0, len(db.indexes))
+	for key := range db.indexes {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
 	}
 	db.mu.RUnlock()
 	sort.Slice(keys, func(i, j int) bool {
-		// return keys[i] < keys[j] == asc
-		// сортируем по длине, а только потом по алфавиту; регистр учитывается
-		var (
-			s1, s2 = keys[i], keys[j]
-			length = len(s1) - len(s2)
-		)
-		if length == 0 {
-			return s1 < s2 == asc
-		}
-		return length < 0 == asc
+		return less(keys[i], keys[j])
 	})
+	if offset >= uint32(len(keys)) {
+		return keys[:0]
+	}
+	keys = keys[offset:]
+	if limit > 0 && limit < uint32(len(keys)) {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+// keys возвращает список ключей, подходящих под запрос. Вызывающий должен
+// удерживать блокировку хранилища.
+func (db *DB) keys(ctx context.Context, prefix, last string,
+	offset, limit uint32, asc bool) ([]string, error) {
+	all, err := db.sortedKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// находим в отсортированном списке место, с которого начинается выборка
+	var start, stop, step = 0, len(all), 1
+	if !asc {
+		start, stop, step = len(all)-1, -1, -1
+	}
 	if last != "" {
-		// находим в списке строку, где она должна бы была быть
-		var found = sort.Search(len(keys), func(i int) bool {
-			return keys[i] >= last == asc
-		})
-		// в случае точного совпадения, исключаем само значение
-		if found < len(keys) && keys[found] == last {
-			found++
+		// ключ last, если он есть в списке, не включается в выборку
+		if asc {
+			start = sort.Search(len(all), func(i int) bool {
+				return keyLess(last, all[i])
+			})
+		} else {
+			start = sort.Search(len(all), func(i int) bool {
+				return !keyLess(all[i], last)
+			}) - 1
+		}
+	}
+	var keys = make([]string, 0, limit)
+	for i, n := start, 1; i != stop; i, n = i+step, n+1 {
+		if n%checkInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		if prefix != "" && !strings.HasPrefix(all[i], prefix) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		keys = append(keys, all[i])
+		if limit > 0 && uint32(len(keys)) == limit {
+			break
 		}
-		keys = keys[found:] // оставляем только ключи после указанного
 	}
-	var min = func(x, y int) int {
-		if x < y {
-			return x
+	return keys, nil
+}
+
+// sortedKeys возвращает отсортированный по возрастанию список всех ключей
+// хранилища. Список строится при первом обращении и используется повторно
+// до тех пор, пока набор ключей не изменится: при добавлении или удалении
+// ключа он сбрасывается. Вызывающий должен удерживать блокировку хранилища,
+// а возвращаемый список нельзя изменять.
+func (db *DB) sortedKeys(ctx context.Context) ([]string, error) {
+	// при блокировке на чтение список могут строить одновременно несколько
+	// читателей, поэтому его построение защищено отдельной блокировкой
+	db.kmu.Lock()
+	defer db.kmu.Unlock()
+	if db.sorted != nil {
+		return db.sorted, nil
+	}
+	var keys = make([]string, 0, len(db.indexes))
+	var n int
+	for key := range db.indexes {
+		if n++; n%checkInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
 		}
-		return y
+		keys = append(keys, key)
 	}
-	if offset > 0 {
-		keys = keys[min(int(offset), len(keys)):]
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
+	sortKeys(keys, true)
+	db.sorted = keys
+	return keys, nil
+}
+
+// Page возвращает страницу из не более чем limit ключей, начинающихся с
+// prefix, которые идут после ключа cursor в порядке сортировки, заданном asc
+// (см. db.Keys). Для получения первой страницы cursor должен быть пустым.
+//
+// Вместе с ключами возвращается курсор для получения следующей страницы: это
+// последний ключ текущей страницы. Если страница последняя, то возвращается
+// пустой курсор. Т.к. курсор задает ключ, а не позицию в списке, то
+// добавление и удаление ключей между запросами страниц не приводит к пропуску
+// или повтору ключей. Если limit не задан, то возвращаются все ключи.
+func (db *DB) Page(prefix, cursor string, limit uint32, asc bool) (keys []string, next string) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var more uint32 // запрашиваем на один ключ больше, чтобы узнать о продолжении
 	if limit > 0 {
-		keys = keys[:min(int(limit), len(keys))]
+		more = limit + 1
+	}
+	keys, _ = db.keys(context.Background(), prefix, cursor, 0, more, asc)
+	if limit > 0 && uint32(len(keys)) > limit {
+		keys = keys[:limit]
+		next = keys[limit-1]
+	}
+	return keys, next
+}
+
+// Item описывает ключ и связанное с ним значение.
+type Item struct {
+	Key   string
+	Value []byte
+}
+
+// Items возвращает список ключей, подходящих под запрос, вместе с их
+// значениями. Параметры запроса совпадают с параметрами db.Keys.
+//
+// В отличие от последовательного вызова db.Keys и db.Gets, выборка ключей и
+// чтение значений выполняются в рамках одной блокировки, поэтому ключ не может
+// быть удален между этими операциями и все значения соответствуют одному и
+// тому же состоянию хранилища.
+func (db *DB) Items(prefix, last string, offset, limit uint32, asc bool) ([]Item, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	keys, err := db.keys(context.Background(), prefix, last, offset, limit, asc)
+	if err != nil {
+		return nil, err
+	}
+	var items = make([]Item, len(keys))
+	for i, key := range keys {
+		value, err := db.get(key)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = Item{Key: key, Value: value}
+	}
+	return items, nil
+}
+
+// ErrStopIteration может быть возвращена функцией, переданной в db.ForEach,
+// для прекращения перебора без ошибки.
+var ErrStopIteration = errors.New("stop iteration")
+
+// ForEach последовательно вызывает fn для всех ключей, начинающихся с prefix,
+// и их значений в порядке сортировки ключей, как в db.Keys. Значения читаются
+// по одному непосредственно перед вызовом fn, поэтому, в отличие от db.Items,
+// не требуется держать в памяти все значения сразу.
+//
+// Если fn возвращает ошибку, то перебор прекращается и ForEach возвращает эту
+// ошибку. Исключение составляет ErrStopIteration: в этом случае перебор
+// прекращается, а ForEach возвращает nil.
+//
+// На все время перебора хранилище блокируется на запись, поэтому fn видит
+// неизменное состояние хранилища, но не должна его изменять: это приведет к
+// взаимной блокировке. Срез value действителен только во время вызова fn.
+func (db *DB) ForEach(prefix string, fn func(key string, value []byte) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	keys, err := db.keys(context.Background(), prefix, "", 0, 0, true)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		value, err := db.get(key)
+		if err != nil {
+			return err
+		}
+		if err = fn(key, value); err != nil {
+			if err == ErrStopIteration {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// keyLess возвращает true, если ключ a в отсортированном списке ключей идет
+// раньше ключа b. Ключи сортируются по длине, а только потом по алфавиту с
+// учетом регистра.
+func keyLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// sortKeys сортирует список ключей в прямом или обратном порядке.
+func sortKeys(keys []string, asc bool) {
+	sort.Slice(keys, func(i, j int) bool {
+		if asc {
+			return keyLess(keys[i], keys[j])
+		}
+		return keyLess(keys[j], keys[i])
+	})
+}
+
+// Range возвращает отсортированный список ключей в диапазоне от start
+// (включительно) до end (не включая его). Пустое значение end снимает
+// ограничение сверху. Для сравнения ключей используется тот же порядок
+// сортировки, что и в db.Keys: сначала по длине, а потом по алфавиту. Порядок
+// сортировки задается параметром asc.
+//
+// Данный метод удобно использовать для выборки ключей, созданных на основе
+// UID, за определенный промежуток времени.
+func (db *DB) Range(start, end string, asc bool) []string {
+	db.mu.RLock()
+	all, _ := db.sortedKeys(context.Background())
+	// ищем границы диапазона в отсортированном списке
+	var from = sort.Search(len(all), func(i int) bool {
+		return !keyLess(all[i], start)
+	})
+	var to = len(all)
+	if end != "" {
+		to = from + sort.Search(len(all)-from, func(i int) bool {
+			return !keyLess(all[from+i], end)
+		})
+	}
+	var keys = append(make([]string, 0, to-from), all[from:to]...)
+	db.mu.RUnlock()
+	if !asc {
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+		}
 	}
 	return keys
 }
 
+// RangeFunc последовательно вызывает fn для каждого ключа в диапазоне от start
+// (включительно) до end (не включая его), пока функция возвращает true.
+// Порядок ключей и обработка границ диапазона совпадают с db.Range.
+//
+// Функция вызывается без блокировки хранилища, поэтому внутри нее можно
+// обращаться к другим методам хранилища.
+func (db *DB) RangeFunc(start, end string, asc bool, fn func(key string) bool) {
+	for _, key := range db.Range(start, end, asc) {
+		if !fn(key) {
+			return
+		}
+	}
+}
+
+// inRange возвращает true, если ключ находится в диапазоне от start
+// (включительно) до end (не включая его).
+func inRange(key, start, end string) bool {
+	return !keyLess(key, start) && (end == "" || keyLess(key, end))
+}
+
+// checkInterval задает количество обрабатываемых записей, через которое
+// проверяется состояние контекста в длительных операциях.
+const checkInterval = 1024
+
 var bufPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
 
-// delete удаляет ключ из хранилища.
+// delete удаляет ключ из хранилища и уведомляет об этом подписчиков.
 func (db *DB) delete(key string) error {
-	index, ok := db.indexes[key]
-	if !ok {
-		return ErrNotFound
+	if db.closed {
+		return ErrClosed
 	}
-	delete(db.indexes, key) // удаляем информацию об индексе
-	// получаем размер файла
-	end, err := db.f.Seek(0, io.SeekEnd)
+	old, err := db.indexed(key)
 	if err != nil {
 		return err
 	}
+	if db.soft {
+		err = db.retain(key)
+	} else {
+		err = db.remove(key)
+	}
+	if metrics := db.metrics(); metrics != nil && err != ErrReadOnly {
+		metrics.ObserveDelete(err != ErrNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	if logger := db.logger(); logger != nil {
+		logger.Debug("delete", "key", key)
+	}
+	if err := db.reindex(key, old, nil); err != nil {
+		return err
+	}
+	db.notify(EventDelete, key, nil)
+	return nil
+}
+
+// remove удаляет ключ из хранилища.
+func (db *DB) remove(key string) error {
+	if db.ro {
+		return ErrReadOnly
+	}
+	index, ok := db.indexes[key]
+	if !ok {
+		return ErrNotFound
+	}
+	db.dropIndex(key) // удаляем информацию об индексе
+	db.sorted = nil   // список ключей изменился
+	return db.discard(index)
+}
+
+// discard помечает запись в файле удаленной и освобождает занимаемое ей
+// место. Если запись последняя в файле, то данные просто укорачиваются.
+func (db *DB) discard(index index) error {
 	// в том случае, если это последний блок в файле, то просто укорачиваем на него
-	if end == index.DataOffset()+int64(index.DataSize) {
-		return db.f.Truncate(int64(index.Offset))
+	if db.size == db.dataOffset(index)+int64(index.DataSize) {
+		return db.shrink(int64(index.Offset))
 	}
 	// записиваем в заголовок метку об удалении
 	var buf = bufPool.Get().(*bytes.Buffer)
 	buf.Reset() // сбрасываем буфер от возможного предыдущего значения
 	// записываем только метку об удалении
 	_ = binary.Write(buf, binary.BigEndian, &struct {
-		Time    uint32 // время удаление
-		Deleted bool   // метка об удалении
+		Time  uint32 // время удаление
+		Flags uint8  // флаги с меткой об удалении
 	}{
-		Time:    uint32(time.Now().Unix()),
-		Deleted: true,
+		Time:  uint32(time.Now().Unix()),
+		Flags: index.Flags | recordDeleted,
 	})
-	_, err = db.f.WriteAt(buf.Bytes(), int64(index.Offset))
+	_, err := db.f.WriteAt(buf.Bytes(), int64(index.Offset))
 	bufPool.Put(buf)
 	if err != nil {
 		return err
 	}
-	// logger.Debug("delete", "key", string(key), "index", index)
 	// сохраняем информацию об освободившемся для записи месте
-	var dl = len(db.deleted)
-	found := sort.Search(dl, func(i int) bool {
-		var s1, s2 = db.deleted[i].Size(), index.Size()
-		return s1 > s2 || (s1 == s2 && db.deleted[i].Offset > index.Offset)
-	})
-	if found < dl && db.deleted[found].Offset == index.Offset {
-		// logger.Warn("dublicate free", "key", string(key), "index", index)
-		return nil // не добавляем дубль
-	}
-	// https://blog.golang.org/go-slices-usage-and-internals
-	db.deleted = append(db.deleted, index) //grow origin slice capacity if needed
-	if found < dl {
-		copy(db.deleted[found+1:], db.deleted[found:]) //ha-ha, lol, 20x faster
-		db.deleted[found] = index
-	}
-	return nil
+	return db.free(index)
 }
 
 // Delete удаляет ключ из хранилища. Если значения с таким ключом в хранилище
@@ -443,8 +1435,8 @@ func (db *DB) Delete(key string) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 	err := db.delete(key)
-	if err == nil && db.sync {
-		return db.Sync()
+	if err == nil {
+		err = db.flush()
 	}
 	return err
 }
@@ -459,92 +1451,551 @@ func (db *DB) Deletes(keys ...string) error {
 			return err
 		}
 	}
-	if db.sync {
-		return db.Sync()
+	return db.flush()
+}
+
+// DeletePrefix удаляет из хранилища все ключи, начинающиеся с prefix, и
+// возвращает количество удаленных ключей. Удаление выполняется под одной
+// блокировкой, поэтому другие операции записи не могут вклиниться в его
+// середину.
+func (db *DB) DeletePrefix(prefix string) (int, error) {
+	return db.deleteFunc(func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
+
+// DeleteRange удаляет из хранилища все ключи в диапазоне от start
+// (включительно) до end (не включая его) и возвращает количество удаленных
+// ключей. Ключи сравниваются так же, как и в Range: если end не задан, то
+// удаляются все ключи, начиная со start.
+func (db *DB) DeleteRange(start, end string) (int, error) {
+	return db.deleteFunc(func(key string) bool {
+		return inRange(key, start, end)
+	})
+}
+
+// deleteFunc удаляет все ключи, для которых match возвращает true.
+func (db *DB) deleteFunc(match func(key string) bool) (count int, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return 0, ErrClosed
 	}
-	return nil
+	if db.ro {
+		return 0, ErrReadOnly
+	}
+	for key := range db.indexes {
+		if !match(key) {
+			continue
+		}
+		if err = db.delete(key); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if count > 0 {
+		err = db.flush()
+	}
+	return count, err
+}
+
+// Truncate удаляет из хранилища все значения, оставляя в файле только
+// заголовок с прежним значением счетчика. В отличие от удаления и повторного
+// создания файла, хранилище при этом остается открытым и в списке открытых.
+// Заголовок файла записывается в текущей версии формата, а зарезервированное
+// с помощью Preallocate место освобождается.
+//
+// Подписчики на изменения получают уведомление об удалении каждого ключа.
+func (db *DB) Truncate() error {
+	db.pmu.Lock()
+	defer db.pmu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if db.ro {
+		return ErrReadOnly
+	}
+	var head = (&header{Counter: db.counter, Flags: db.flags,
+		Check: db.check}).current()
+	head.End = head.Size()
+	// читатели без блокировки не должны обращаться к удаляемым записям
+	db.view.Store((*sync.Map)(nil))
+	db.reuse()
+	defer db.resetView()
+	// сначала записываем заголовок с новым концом данных, чтобы при сбое
+	// прежние записи уже не учитывались
+	if err := head.write(io.NewOffsetWriter(db.f, 0)); err != nil {
+		return err
+	}
+	if err := db.f.Truncate(head.Size()); err != nil {
+		return err
+	}
+	var keys = db.indexes
+	db.staleCompaction()
+	db.indexes = make(map[string]index)
+	db.deleted = freeTree{}
+	db.trash = make(map[string]index)
+	db.indexFree()
+	db.lost, db.lostSize = 0, 0
+	db.sorted = nil
+	db.start, db.flags, db.slot = head.Size(), head.Flags, 0
+	db.size, db.stored, db.endAt = head.End, head.End, head.endOffset()
+	for _, idx := range db.lookups {
+		if err := idx.db.Truncate(); err != nil {
+			return err
+		}
+	}
+	if db.watched() {
+		for key := range keys {
+			db.notify(EventDelete, key, nil)
+		}
+	}
+	return db.flush()
 }
 
 // put сохраняет данные в хранилище с указанным ключом.
 func (db *DB) put(key string, value []byte) (err error) {
+	if err := db.checkPut(key, value); err != nil {
+		return err
+	}
 	// проверяем, что запись с таким ключем уже существует
-	if index, ok := db.indexes[key]; ok {
-		if len(value) == 0 && index.DataSize == 0 {
-			return nil // не требуется перезапись пустого значения
-			// иначе удаляем индекс, если он существовал, и сводим задачу
-			// к первоначальной
-		} else if err := db.delete(key); err != nil {
-			return err
-		}
+	if old, ok := db.indexes[key]; ok && len(value) == 0 && old.DataSize == 0 {
+		return nil // не требуется перезапись пустого значения
+	}
+	// при необходимости сжимаем данные
+	data, flags, err := db.encode(key, value)
+	if err != nil {
+		return err
+	}
+	// новое значение всегда записывается на новое место, а прежнее помечается
+	// удаленным только после этого, поэтому при сбое в файле сохраняется либо
+	// прежнее, либо новое значение. Перезапись на месте прежнего значения
+	// такой гарантии не дает, поэтому вместо нее предпочитается соседнее
+	// свободное место (см. db.allocateNear)
+	index, reused, err := db.reserve(key, data, flags)
+	if err != nil {
+		return err
+	}
+	err = db.store(index, key, data)
+	if err == nil {
+		err = db.commitEnd() // запись добавлена в конец данных
+	}
+	if err != nil {
+		// прежнее значение осталось нетронутым: возвращаем выделенное место
+		db.release(index)
+		return err
+	}
+	db.observePut(key, index, reused, len(data))
+	return db.publish(key, index, value)
+}
+
+// checkPut проверяет, что значение с указанным ключом может быть сохранено.
+func (db *DB) checkPut(key string, value []byte) error {
+	if db.closed {
+		return ErrClosed
+	}
+	if db.ro {
+		return ErrReadOnly
+	}
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	// шифрование увеличивает размер данных, поэтому он проверяется заранее:
+	// иначе пришлось бы шифровать значение, которое все равно не поместится
+	var size = uint64(len(key)) + uint64(len(value))
+	if db.aead != nil {
+		size += nonceSize + tagSize
+	}
+	if size > math.MaxUint32 {
+		return ErrValueTooLarge
+	}
+	return db.checkValue(key, value)
+}
+
+// reserve выделяет в файле место для записи с указанным ключом и данными и
+// возвращает ее индекс. Второе значение равно true, если запись будет сделана
+// на место удаленных данных, а не добавлена в конец файла.
+func (db *DB) reserve(key string, data []byte, flags uint8) (index, bool, error) {
+	// размер проверяется уже для записываемых данных, до приведения к uint32
+	if uint64(len(key))+uint64(len(data)) > math.MaxUint32 {
+		return index{}, false, ErrValueTooLarge
 	}
-	// теперь находим подходящее место для вставки данных
 	var (
-		dataSize = uint32(len(key) + len(value)) // размер данных для записи
-		dl       = len(db.deleted)               // количество свободных мест
-		offset   int64                           // итоговое смещение для записи данных
-		empty    uint32                          // размер свободного места за данными
+		tail   = db.size
+		size   = uint32(len(key) + len(data))
+		offset int64
+		empty  uint32
+		err    error
 	)
-	if found := sort.Search(dl, func(i int) bool {
-		return db.deleted[i].Size() >= dataSize
-	}); found < dl {
-		var index = db.deleted[found] // найдено подходящее свободное место
-		offset = int64(index.Offset)  // смещение для записи
-		// вычисляем размер свободного места, которое останется после данных
-		empty = index.Size() - uint32(len(key)+len(value))
-		// удаляем этот индекс из свободного доступа
-		db.deleted = append(db.deleted[:found], db.deleted[found+1:]...)
+	if old, ok := db.indexes[key]; ok {
+		offset, empty, err = db.allocateNear(old, size)
 	} else {
-		// не найдено подходящего места для записи - записываем в конец файла
-		offset, err = db.f.Seek(0, io.SeekEnd)
-		if err != nil {
-			return err
-		}
+		offset, empty, err = db.allocate(size)
 	}
-	var index = index{
+	if err != nil {
+		return index{}, false, err
+	}
+	return index{
 		Offset:    uint32(offset),
 		KeySize:   uint8(len(key)),
-		DataSize:  uint32(len(value)),
+		DataSize:  uint32(len(data)),
 		EmptySize: empty,
-	}
-	// записываем заголовок с индексом и сами данные в файл хранилища
+		Time:      uint32(time.Now().Unix()),
+		Flags:     flags,
+	}, offset < tail, nil
+}
+
+// store записывает в выделенное для записи место заголовок с индексом, ключ
+// и данные.
+func (db *DB) store(index index, key string, data []byte) error {
 	var buf = bufPool.Get().(*bytes.Buffer)
 	buf.Reset() // сбрасываем буфер от возможного предыдущего значения
+	defer bufPool.Put(buf)
 	_ = binary.Write(buf, binary.BigEndian, &storedIndex{
-		Time:      uint32(time.Now().Unix()),
-		Deleted:   false,
+		Time:      index.Time,
+		Flags:     index.Flags,
 		KeySize:   index.KeySize,
 		DataSize:  index.DataSize,
 		EmptySize: index.EmptySize,
 	})
-	_, _ = io.WriteString(buf, key)            // имя ключа
-	_, _ = buf.Write(value)                    // данные
-	_, err = db.f.WriteAt(buf.Bytes(), offset) // сохраняем в хранилище
-	bufPool.Put(buf)
+	if db.flags&flagChecksum != 0 {
+		_ = binary.Write(buf, binary.BigEndian, checksum(key, data))
+	}
+	_, _ = io.WriteString(buf, key) // имя ключа
+	_, _ = buf.Write(data)          // данные
+	_, err := db.f.WriteAt(buf.Bytes(), int64(index.Offset))
+	return err
+}
+
+// publish делает уже записанное в файл значение действующим вместо
+// прежнего значения с тем же ключом, если оно было.
+func (db *DB) publish(key string, index index, value []byte) error {
+	prev, err := db.swap(key, index)
 	if err != nil {
 		return err
 	}
-	// сохраняем индекс
-	db.indexes[string(key)] = index
-	// logger.Debug("put", "key", string(key), "value", string(value), "index", index)
+	if value == nil {
+		value = []byte{} // пустое значение отличается от отсутствующего
+	}
+	if err := db.reindex(key, prev, value); err != nil {
+		return err
+	}
+	db.notify(EventPut, key, value)
 	return nil
 }
 
+// swap делает уже записанную в файл запись действующей вместо прежней записи
+// с тем же ключом, если она была, и возвращает прежнее значение для
+// вторичных индексов.
+func (db *DB) swap(key string, index index) ([]byte, error) {
+	prev, err := db.indexed(key)
+	if err != nil {
+		return nil, err
+	}
+	old, exists := db.indexes[key]
+	if !exists {
+		db.sorted = nil // добавлен новый ключ
+	}
+	db.setIndex(key, index)
+	if err := db.unretain(key); err != nil {
+		return nil, err
+	}
+	if exists {
+		// новое значение должно оказаться на диске раньше, чем прежнее будет
+		// помечено удаленным
+		if db.policy == SyncAlways {
+			if err := db.f.Sync(); err != nil {
+				return nil, err
+			}
+		}
+		if err := db.discard(old); err != nil {
+			return nil, err
+		}
+	}
+	return prev, nil
+}
+
 // Put сохраняет данные в хранилище с указанным ключом. Если данные с таким
 // ключом уже были ранее сохранены в хранилище, то они перезаписываются.
 func (db *DB) Put(key string, value []byte) error {
+	_, err := db.PutX(key, value)
+	return err
+}
+
+// PutX сохраняет данные в хранилище с указанным ключом, как и db.Put, но
+// дополнительно возвращает true, если ключа в хранилище до этого не было и
+// он был создан, и false, если было перезаписано уже существующее значение.
+// Наличие ключа проверяется в рамках той же блокировки, что и запись, поэтому,
+// в отличие от предварительного вызова db.Has, результат всегда точен.
+func (db *DB) PutX(key string, value []byte) (created bool, err error) {
+	db.pmu.RLock()
+	if db.shards != nil {
+		defer db.pmu.RUnlock()
+		return db.putParallel(key, value)
+	}
+	db.pmu.RUnlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	_, exists := db.indexes[key]
+	if err = db.put(key, value); err != nil {
+		return false, err
+	}
+	return !exists, db.flush()
+}
+
+// Append добавляет suffix в конец значения с указанным ключом. Если значения
+// с таким ключом нет, то оно создается.
+//
+// Если за данными записи в файле достаточно свободного места, то suffix
+// дописывается прямо в него без перезаписи всего значения. В противном
+// случае, а так же для сжатых или зашифрованных значений, значение
+// перезаписывается целиком, как при Put.
+func (db *DB) Append(key string, suffix []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	err := db.append(key, suffix)
+	if err == nil {
+		err = db.flush()
+	}
+	return err
+}
+
+// append добавляет данные в конец значения.
+func (db *DB) append(key string, suffix []byte) error {
+	if db.closed {
+		return ErrClosed
+	}
+	if db.ro {
+		return ErrReadOnly
+	}
+	index, ok := db.indexes[key]
+	if !ok {
+		return db.put(key, suffix)
+	}
+	if len(suffix) == 0 {
+		return nil
+	}
+	// размер проверяется до приведения к uint32, чтобы он не был обрезан
+	if uint64(len(key))+uint64(index.DataSize)+uint64(len(suffix)) >
+		math.MaxUint32 {
+		return ErrValueTooLarge
+	}
+	if index.EmptySize < uint32(len(suffix)) || db.aead != nil ||
+		index.Flags&recordCompressed != 0 {
+		value, err := db.get(key)
+		if err != nil {
+			return err
+		}
+		return db.put(key, append(value, suffix...))
+	}
+	if db.maxvalue > 0 &&
+		uint64(index.DataSize)+uint64(len(suffix)) > uint64(db.maxvalue) {
+		return ErrValueTooLarge
+	}
+	// сначала дописываем данные в свободное место, а только потом изменяем
+	// заголовок записи, чтобы при сбое сохранилось прежнее значение
+	if _, err := db.f.WriteAt(suffix, db.dataOffset(index)+
+		int64(index.DataSize)); err != nil {
+		return err
+	}
+	index.DataSize += uint32(len(suffix))
+	index.EmptySize -= uint32(len(suffix))
+	index.Time = uint32(time.Now().Unix())
+	var buf = bufPool.Get().(*bytes.Buffer)
+	buf.Reset() // сбрасываем буфер от возможного предыдущего значения
+	defer bufPool.Put(buf)
+	_ = binary.Write(buf, binary.BigEndian, &storedIndex{
+		Time:      index.Time,
+		Flags:     index.Flags,
+		KeySize:   index.KeySize,
+		DataSize:  index.DataSize,
+		EmptySize: index.EmptySize,
+	})
+	if db.flags&flagChecksum != 0 {
+		// контрольная сумма продолжается с сохраненного значения
+		var sum = make([]byte, checksumSize)
+		if _, err := db.f.ReadAt(sum, int64(index.Offset)+storedIndexSize); err != nil {
+			return err
+		}
+		var crc = crc32.Update(binary.BigEndian.Uint32(sum), crc32.IEEETable, suffix)
+		_ = binary.Write(buf, binary.BigEndian, crc)
+	}
+	if _, err := db.f.WriteAt(buf.Bytes(), int64(index.Offset)); err != nil {
+		return err
+	}
+	db.setIndex(key, index)
+	if db.watched() {
+		value, err := db.get(key)
+		if err != nil {
+			return err
+		}
+		db.notify(EventPut, key, value)
+	}
+	return nil
+}
+
+// ErrSizeMismatch возвращается PutReader, если размер прочитанных данных не
+// совпадает с заявленным.
+var ErrSizeMismatch = errors.New("value size mismatch")
+
+// PutReader сохраняет в хранилище значение размером size байт, читая его из r,
+// без загрузки значения в память целиком: данные копируются сразу в файл
+// хранилища. Если из r прочитано меньше или больше size байт, то возвращается
+// ошибка ErrSizeMismatch, а прежнее значение с таким ключом не изменяется.
+//
+// Если для хранилища задано сжатие или шифрование, то значение все равно
+// читается в память целиком, т.к. они требуют всего значения сразу.
+func (db *DB) PutReader(key string, r io.Reader, size uint32) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	err := db.put(key, value)
-	if err == nil && db.sync {
-		return db.Sync()
+	err := db.putReader(key, r, size)
+	if err == nil {
+		err = db.flush()
 	}
 	return err
 }
 
+// putReader сохраняет в хранилище значение, читая его из r.
+func (db *DB) putReader(key string, r io.Reader, size uint32) error {
+	if db.closed {
+		return ErrClosed
+	}
+	if db.ro {
+		return ErrReadOnly
+	}
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if uint64(len(key))+uint64(size) > math.MaxUint32 ||
+		(db.maxvalue > 0 && size > db.maxvalue) {
+		return ErrValueTooLarge
+	}
+	// значение в формате JSON проверяется целиком до записи
+	if db.aead != nil || db.compress != CompressionNone || db.jsonOnly {
+		var buf = bytes.NewBuffer(make([]byte, 0, size))
+		if err := copySize(buf, r, int64(size)); err != nil {
+			return err
+		}
+		return db.put(key, buf.Bytes())
+	}
+	// новое значение всегда записывается на новое место, чтобы прежнее
+	// оставалось нетронутым, пока данные не будут прочитаны полностью
+	var tail = db.size // конец данных до выделения места
+	offset, empty, err := db.allocate(uint32(len(key)) + size)
+	if err != nil {
+		return err
+	}
+	var index = index{
+		Offset:    uint32(offset),
+		KeySize:   uint8(len(key)),
+		DataSize:  size,
+		EmptySize: empty,
+		Time:      uint32(time.Now().Unix()),
+		Flags:     recordDeleted, // пока данные не записаны, место свободно
+	}
+	var hash = crc32.NewIEEE()
+	_, _ = io.WriteString(hash, key)
+	err = db.writeHeader(index, key, 0)
+	if err == nil {
+		var w = io.NewOffsetWriter(db.f, db.dataOffset(index))
+		err = copySize(io.MultiWriter(w, hash), r, int64(size))
+	}
+	index.Flags = 0
+	if err == nil {
+		err = db.writeHeader(index, key, hash.Sum32())
+	}
+	if err == nil {
+		err = db.commitEnd()
+	}
+	if err != nil {
+		db.release(index) // возвращаем выделенное место
+		return err
+	}
+	db.observePut(key, index, int64(offset) < tail, int(size))
+	// только теперь удаляем прежнее значение
+	old, err := db.swap(key, index)
+	if err != nil {
+		return err
+	}
+	if db.watched() || len(db.lookups) > 0 {
+		value, err := db.get(key)
+		if err != nil {
+			return err
+		}
+		if err := db.reindex(key, old, value); err != nil {
+			return err
+		}
+		db.notify(EventPut, key, value)
+	}
+	return nil
+}
+
+// copySize копирует из r в w ровно size байт. Если данных в r меньше или
+// больше, то возвращает ErrSizeMismatch.
+func copySize(w io.Writer, r io.Reader, size int64) error {
+	if _, err := io.CopyN(w, r, size); err != nil {
+		if err == io.EOF {
+			return ErrSizeMismatch
+		}
+		return err
+	}
+	// проверяем, что данные закончились
+	var b [1]byte
+	switch _, err := io.ReadFull(r, b[:]); err {
+	case io.EOF:
+		return nil
+	case nil:
+		return ErrSizeMismatch
+	default:
+		return err
+	}
+}
+
+// writeHeader записывает в файл заголовок записи с контрольной суммой и
+// ключом.
+func (db *DB) writeHeader(index index, key string, sum uint32) error {
+	var buf = bufPool.Get().(*bytes.Buffer)
+	buf.Reset() // сбрасываем буфер от возможного предыдущего значения
+	defer bufPool.Put(buf)
+	_ = binary.Write(buf, binary.BigEndian, &storedIndex{
+		Time:      index.Time,
+		Flags:     index.Flags,
+		KeySize:   index.KeySize,
+		DataSize:  index.DataSize,
+		EmptySize: index.EmptySize,
+	})
+	if db.flags&flagChecksum != 0 {
+		_ = binary.Write(buf, binary.BigEndian, sum)
+	}
+	_, _ = io.WriteString(buf, key)
+	_, err := db.f.WriteAt(buf.Bytes(), int64(index.Offset))
+	return err
+}
+
 // PutJSON сохраняет данные в хранилище с указанным ключом в формате JSON.
 // Возвращает ошибку, если не удалось преобразовать объект в формат JSON.
 func (db *DB) PutJSON(key string, value interface{}) error {
-	data, err := json.Marshal(value)
+	return db.PutCodec(key, value, JSON)
+}
+
+// PutGob сохраняет данные в хранилище с указанным ключом в формате
+// encoding/gob. В отличие от PutJSON, такие значения сохраняют типы, которые
+// не поддерживает JSON, но не могут быть прочитаны программами не на Go.
+// Возвращает ошибку, если не удалось преобразовать объект.
+func (db *DB) PutGob(key string, value interface{}) error {
+	return db.PutCodec(key, value, Gob)
+}
+
+// PutCodec сохраняет данные в хранилище с указанным ключом, используя заданный
+// формат сериализации. Если формат не указан, то используется DefaultCodec.
+// Возвращает ошибку, если не удалось преобразовать объект.
+func (db *DB) PutCodec(key string, value interface{}, codec Codec) error {
+	if codec == nil {
+		codec = DefaultCodec
+	}
+	data, err := codec.Marshal(value)
 	if err != nil {
 		return err
 	}
@@ -555,18 +2006,29 @@ func (db *DB) PutJSON(key string, value interface{}) error {
 // передаются в виде связанного списка: ключ - значение. Т.к. ключем в map
 // не может выступать изменяемый массив байт, то значение ключа задается
 // в виде строки.
+//
+// Перед записью проверяются все ключи и значения (см. db.SetMaxValueSize и
+// db.SetJSONOnly): если хотя бы одно из них не может быть сохранено, то
+// возвращается ошибка и ни одно из значений не записывается.
 func (db *DB) Puts(values map[string][]byte) error {
+	for key := range values {
+		if err := checkKey(key); err != nil {
+			return err
+		}
+	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
 	for key, value := range values {
-		if err := db.put(key, value); err != nil {
+		if err := db.checkValue(key, value); err != nil {
 			return err
 		}
 	}
-	if db.sync {
-		return db.Sync()
+	for key, value := range values {
+		if err := db.put(key, value); err != nil {
+			return err
+		}
 	}
-	return nil
+	return db.flush()
 }
 
 // PutsJSON сохраняет в хранилище объекты в формате JSON. Возвращает ошибку,
@@ -583,3 +2045,155 @@ func (db *DB) PutsJSON(values map[string]interface{}) error {
 	}
 	return db.Puts(result)
 }
+
+// PutsGob сохраняет в хранилище объекты в формате encoding/gob. Возвращает
+// ошибку, если не удалось преобразовать объект, и в этом случае ни одно из
+// значений не сохраняется.
+func (db *DB) PutsGob(values map[string]interface{}) error {
+	var result = make(map[string][]byte, len(values))
+	for key, value := range values {
+		data, err := Gob.Marshal(value)
+		if err != nil {
+			return err
+		}
+		result[key] = data
+	}
+	return db.Puts(result)
+}
+
+// CompareAndSwap атомарно заменяет значение ключа на new, но только в том
+// случае, если текущее сохраненное значение совпадает с old. Возвращает true,
+// если замена произошла. Если в качестве old передан nil, то значение
+// добавляется, только если ключа в хранилище нет: существующее пустое
+// значение с nil не совпадает, для него в качестве old нужно передать
+// []byte{}.
+//
+// Если значение уже заменено, но сбросить данные в файл не удалось, то
+// вместе с ошибкой возвращается true: повторять замену в этом случае не
+// нужно.
+//
+// Чтение, сравнение и запись выполняются в рамках одной блокировки, поэтому
+// этот метод можно использовать для оптимистичного обновления значений из
+// нескольких потоков без дополнительной синхронизации.
+func (db *DB) CompareAndSwap(key string, old, new []byte) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return false, ErrClosed
+	}
+	if _, ok := db.indexes[key]; !ok {
+		if old != nil {
+			return false, nil
+		}
+	} else {
+		if old == nil {
+			return false, nil // ключ уже существует
+		}
+		data, err := db.get(key)
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(data, old) {
+			return false, nil
+		}
+	}
+	if err := db.put(key, new); err != nil {
+		return false, err
+	}
+	return true, db.flush()
+}
+
+// PutIfAbsent сохраняет значение с указанным ключом, только если такого
+// ключа в хранилище еще нет, и возвращает true, если значение было сохранено.
+// Если ключ уже существует, то хранилище не изменяется и возвращается false.
+//
+// Проверка и запись выполняются в рамках одной блокировки, поэтому из
+// нескольких одновременных вызовов с одним и тем же ключом успешным будет
+// только один. Это позволяет использовать хранилище для блокировок.
+//
+// Если значение уже сохранено, но сбросить данные в файл не удалось, то
+// вместе с ошибкой возвращается true.
+func (db *DB) PutIfAbsent(key string, value []byte) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return false, ErrClosed
+	}
+	if _, ok := db.indexes[key]; ok {
+		return false, nil
+	}
+	if err := db.put(key, value); err != nil {
+		return false, err
+	}
+	return true, db.flush()
+}
+
+// DeleteIf удаляет ключ, только если его текущее значение совпадает с
+// expected, и возвращает true, если ключ был удален. Если ключа в хранилище
+// нет, то возвращается false без ошибки, поэтому повторный вызов безопасен.
+//
+// Чтение, сравнение и удаление выполняются в рамках одной блокировки, что
+// позволяет, например, снять блокировку, сохраненную с помощью
+// db.PutIfAbsent, только если она все еще принадлежит вызывающему.
+//
+// Если ключ уже удален, но сбросить данные в файл не удалось, то вместе с
+// ошибкой возвращается true.
+func (db *DB) DeleteIf(key string, expected []byte) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return false, ErrClosed
+	}
+	if _, ok := db.indexes[key]; !ok {
+		return false, nil
+	}
+	data, err := db.get(key)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(data, expected) {
+		return false, nil
+	}
+	if err := db.delete(key); err != nil {
+		return false, err
+	}
+	return true, db.flush()
+}
+
+// Increment увеличивает на delta числовое значение, сохраненное с указанным
+// ключом, и возвращает получившийся результат. Значение хранится в виде
+// восьми байт int64 в формате binary.BigEndian. Отсутствующий ключ считается
+// нулевым значением. Если сохраненное значение не является числом такого
+// формата, то возвращается ошибка.
+//
+// Чтение, изменение и сохранение значения выполняются в рамках одной
+// блокировки.
+func (db *DB) Increment(key string, delta int64) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return 0, ErrClosed
+	}
+	var value int64
+	if _, ok := db.indexes[key]; ok {
+		data, err := db.get(key)
+		if err != nil {
+			return 0, err
+		}
+		if len(data) != 8 {
+			return 0, fmt.Errorf("invalid number format for key %q", key)
+		}
+		value = int64(binary.BigEndian.Uint64(data))
+	}
+	value += delta
+	var data = make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(value))
+	err := db.put(key, data)
+	if err == nil {
+		err = db.flush()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return value, nil
+}
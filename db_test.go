@@ -1,20 +1,21 @@
 package keystore
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"math/rand"
 	"os"
 	"strings"
 	"testing"
 	"time"
-
-	"github.com/mdigger/log"
 )
 
 func init() {
 	rand.Seed(time.Now().Unix())
-	log.SetLevel(log.DEBUG)
 }
 
 func randomAsterics() string {
@@ -59,7 +60,6 @@ func TestDB(t *testing.T) {
 			}
 		}
 
-		// log.Info("----------------------------")
 		for i := 1; i < 500; i++ {
 			key := keys[rand.Intn(len(keys))]
 			if rand.Intn(3) == 0 {
@@ -84,7 +84,6 @@ func TestDB(t *testing.T) {
 			}
 		}
 
-		// log.Info("===============================")
 		nkeys := db.Keys("", "", 0, 0, true)
 		j, err := db.GetsJSON(nkeys...)
 		if err != nil {
@@ -100,7 +99,6 @@ func TestDB(t *testing.T) {
 		if err := db.Close(); err != nil {
 			t.Fatal(err)
 		}
-		// log.Info("++++++++++++++++++++++++")
 	}
 
 	db, err := Open(filename)
@@ -115,7 +113,7 @@ func TestDB(t *testing.T) {
 	}
 	_ = j
 	CloseAll()
-	if err := db.Close(); err != nil {
+	if err := db.Close(); err != ErrClosed {
 		t.Fatal(err)
 	}
 }
@@ -173,9 +171,1196 @@ func TestErrNotFound(t *testing.T) {
 	if value != nil {
 		t.Fatal("bad not found value")
 	}
+	values, err := db.GetMap("id1", "id100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := values["id1"]; !ok || len(value) != 0 {
+		t.Fatal("bad empty value in map")
+	}
+	if _, ok := values["id100"]; ok || len(values) != 1 {
+		t.Fatal("bad not found value in map")
+	}
+	list, found, err := db.GetsWithFound("id1", "id100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || len(list[0]) != 0 || len(list[1]) != 0 {
+		t.Fatal("bad values with found")
+	}
+	if !found[0] || found[1] {
+		t.Fatal("bad found flags:", found)
+	}
 	// ErrNotFound = nil
 	// _, err = db.Get("id100")
 	// if err != nil {
 	// 	t.Fatal("bad nil not found error")
 	// }
 }
+
+func TestCompareAndSwap(t *testing.T) {
+	os.RemoveAll(filename)
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetSync(false)
+	// вставка отсутствующего ключа
+	ok, err := db.CompareAndSwap("cas", nil, []byte("1"))
+	if err != nil || !ok {
+		t.Fatal("bad insert", ok, err)
+	}
+	ok, err = db.CompareAndSwap("cas", nil, []byte("2"))
+	if err != nil || ok {
+		t.Fatal("bad insert over existing", ok, err)
+	}
+	ok, err = db.CompareAndSwap("cas", []byte("0"), []byte("2"))
+	if err != nil || ok {
+		t.Fatal("bad swap with wrong value", ok, err)
+	}
+	ok, err = db.CompareAndSwap("cas", []byte("1"), []byte("2"))
+	if err != nil || !ok {
+		t.Fatal("bad swap", ok, err)
+	}
+	value, err := db.Get("cas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "2" {
+		t.Fatalf("bad swapped value: %q", value)
+	}
+	ok, err = db.CompareAndSwap("none", []byte("1"), []byte("2"))
+	if err != nil || ok {
+		t.Fatal("bad swap for missing key", ok, err)
+	}
+	// nil не совпадает с существующим пустым значением
+	if err := db.Put("empty", nil); err != nil {
+		t.Fatal(err)
+	}
+	ok, err = db.CompareAndSwap("empty", nil, []byte("1"))
+	if err != nil || ok {
+		t.Fatal("bad insert over empty value", ok, err)
+	}
+	ok, err = db.CompareAndSwap("empty", []byte{}, []byte("1"))
+	if err != nil || !ok {
+		t.Fatal("bad swap of empty value", ok, err)
+	}
+}
+
+// syncFailFile возвращает ошибку при сбросе данных в файл, если установлен
+// флаг fail.
+type syncFailFile struct {
+	File
+	fail bool
+}
+
+func (f *syncFailFile) Sync() error {
+	if f.fail {
+		return errors.New("sync failed")
+	}
+	return f.File.Sync()
+}
+
+// openSyncFail открывает хранилище в памяти, в котором освобождено место
+// для записи значения размером с "value", чтобы запись не увеличивала файл
+// и сбрасывала данные только после ее завершения.
+func openSyncFail(t *testing.T) (*DB, *syncFailFile) {
+	t.Helper()
+	var file = &syncFailFile{File: newMemFile("syncfail")}
+	db, err := loadFile(context.Background(), file, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for _, key := range []string{"x", "y"} {
+		if err := db.Put(key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("x"); err != nil {
+		t.Fatal(err)
+	}
+	return db, file
+}
+
+func TestPutIfAbsentSyncError(t *testing.T) {
+	db, file := openSyncFail(t)
+	file.fail = true
+	ok, err := db.PutIfAbsent("x", []byte("value"))
+	if err == nil || !ok {
+		t.Fatal("bad insert with sync error", ok, err)
+	}
+	if !db.Has("x") {
+		t.Fatal("inserted value not found")
+	}
+}
+
+func TestDeleteIfSyncError(t *testing.T) {
+	db, file := openSyncFail(t)
+	file.fail = true
+	ok, err := db.DeleteIf("y", []byte("value"))
+	if err == nil || !ok {
+		t.Fatal("bad delete with sync error", ok, err)
+	}
+	if db.Has("y") {
+		t.Fatal("deleted value found")
+	}
+}
+
+func TestCompareAndSwapSyncError(t *testing.T) {
+	db, file := openSyncFail(t)
+	file.fail = true
+	// значение записано, не удалось только сбросить данные в файл
+	ok, err := db.CompareAndSwap("x", nil, []byte("value"))
+	if err == nil || !ok {
+		t.Fatal("bad swap with sync error", ok, err)
+	}
+	if value, err := db.Get("x"); err != nil || string(value) != "value" {
+		t.Fatalf("bad swapped value: %q, %v", value, err)
+	}
+}
+
+func TestPutIfAbsent(t *testing.T) {
+	db, err := OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	const workers = 10
+	var results = make(chan bool, workers)
+	for i := 0; i < workers; i++ {
+		go func(i int) {
+			ok, err := db.PutIfAbsent("lock", []byte(fmt.Sprint("owner", i)))
+			if err != nil {
+				t.Error(err)
+			}
+			results <- ok
+		}(i)
+	}
+	var success int
+	for i := 0; i < workers; i++ {
+		if <-results {
+			success++
+		}
+	}
+	if success != 1 {
+		t.Fatalf("bad success count: %d", success)
+	}
+	value, err := db.Get("lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := db.PutIfAbsent("lock", []byte("other"))
+	if err != nil || ok {
+		t.Fatal("bad put over existing", ok, err)
+	}
+	if data, _ := db.Get("lock"); string(data) != string(value) {
+		t.Fatalf("value changed: %q", data)
+	}
+}
+
+func TestDeleteIf(t *testing.T) {
+	db, err := OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("lock", []byte("owner1")); err != nil {
+		t.Fatal(err)
+	}
+	ok, err := db.DeleteIf("lock", []byte("owner2"))
+	if err != nil || ok {
+		t.Fatal("bad delete with wrong value", ok, err)
+	}
+	if !db.Has("lock") {
+		t.Fatal("key deleted with wrong value")
+	}
+	ok, err = db.DeleteIf("lock", []byte("owner1"))
+	if err != nil || !ok {
+		t.Fatal("bad delete", ok, err)
+	}
+	if db.Has("lock") {
+		t.Fatal("key not deleted")
+	}
+	ok, err = db.DeleteIf("lock", []byte("owner1"))
+	if err != nil || ok {
+		t.Fatal("bad delete of missing key", ok, err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	var filename = "db/readonly.db"
+	if _, err := OpenReadOnly(filename); err == nil {
+		t.Fatal("opened missing read-only file")
+	}
+	if err := Put(filename, "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(filename)
+	// хранилище, открытое на запись, блокирует открытие для чтения
+	if _, err := OpenReadOnly(filename); !errors.Is(err, ErrLocked) {
+		t.Fatal("opened locked file:", err)
+	}
+	if err := Close(filename); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenReadOnly(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// читать одновременно можно нескольким
+	reader, err := OpenReadOnly(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if _, err := Open(filename); !errors.Is(err, ErrLocked) {
+		t.Fatal("opened file locked for reading:", err)
+	}
+	value, err := db.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value" {
+		t.Fatalf("bad value: %q", value)
+	}
+	if err := db.Put("key", nil); err != ErrReadOnly {
+		t.Error("bad put:", err)
+	}
+	if err := db.PutJSON("key", 1); err != ErrReadOnly {
+		t.Error("bad put json:", err)
+	}
+	if err := db.Delete("key"); err != ErrReadOnly {
+		t.Error("bad delete:", err)
+	}
+	if _, err := db.NextSequence(); err != ErrReadOnly {
+		t.Error("bad sequence:", err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Error("bad sync:", err)
+	}
+	if !db.Has("key") {
+		t.Error("key deleted")
+	}
+}
+
+func TestReload(t *testing.T) {
+	var file = newMemFile("reload")
+	writer, err := loadFile(context.Background(), file, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Put("old", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := loadFile(context.Background(), file, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Keys("", "", 0, 0, true) // кеш списка ключей
+	if err := writer.Put("new", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Delete("old"); err != nil {
+		t.Fatal(err)
+	}
+	// чтение во время перечитывания видит прежнее или новое состояние
+	var done = make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if reader.Has("old") == reader.Has("new") {
+				t.Error("inconsistent state")
+				return
+			}
+		}
+	}()
+	if err := reader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if reader.Has("old") || !reader.Has("new") {
+		t.Fatal("store not reloaded")
+	}
+	if keys := reader.Keys("", "", 0, 0, true); len(keys) != 1 || keys[0] != "new" {
+		t.Fatalf("bad keys: %v", keys)
+	}
+	if len(reader.DeletedSlots()) != 1 {
+		t.Fatalf("bad free slots: %v", reader.DeletedSlots())
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.Reload(); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("reload closed store: %v", err)
+	}
+}
+
+func TestKeyTooLong(t *testing.T) {
+	var filename = "db/longkey.db"
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(filename)
+	if err := db.Put("key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	var long = strings.Repeat("k", 256)
+	if err := db.Put(long, []byte("value")); err != ErrKeyTooLong {
+		t.Fatal("bad long key error:", err)
+	}
+	err = db.Puts(map[string][]byte{"key2": []byte("value2"), long: nil})
+	if err != ErrKeyTooLong {
+		t.Fatal("bad long key error in batch:", err)
+	}
+	if err := db.Put("", []byte("value")); err != ErrEmptyKey {
+		t.Fatal("bad empty key error:", err)
+	}
+	if err := db.Append("", []byte("value")); err != ErrEmptyKey {
+		t.Fatal("bad empty key append error:", err)
+	}
+	err = db.Puts(map[string][]byte{"key2": []byte("value2"), "": nil})
+	if err != ErrEmptyKey {
+		t.Fatal("bad empty key error in batch:", err)
+	}
+	if err := db.Put(long[:255], []byte("max")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// проверяем, что хранилище после повторного открытия не испорчено
+	db, err = Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := db.Keys("", "", 0, 0, true)
+	if len(keys) != 2 || keys[0] != "key" || keys[1] != long[:255] {
+		t.Fatalf("bad keys: %q", keys)
+	}
+	value, err := db.Get("key")
+	if err != nil || string(value) != "value" {
+		t.Fatalf("bad value: %q, %v", value, err)
+	}
+}
+
+func TestContext(t *testing.T) {
+	var filename = "db/context.db"
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(filename)
+	db.SetSync(false)
+	for i := 0; i < checkInterval*2; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.KeysContext(ctx, "", "", 0, 0, true); err != context.Canceled {
+		t.Fatal("bad canceled keys:", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenContext(ctx, filename); err != context.Canceled {
+		t.Fatal("bad canceled open:", err)
+	}
+	db, err = OpenContext(context.Background(), filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Count() != checkInterval*2 {
+		t.Fatal("bad count:", db.Count())
+	}
+}
+
+func TestModTime(t *testing.T) {
+	var filename = "db/modtime.db"
+	defer Remove(filename)
+	var before = time.Now().Truncate(time.Second)
+	if err := Put(filename, "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	modTime, err := ModTime(filename, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if modTime.Before(before) || modTime.After(time.Now()) {
+		t.Fatal("bad modification time:", modTime)
+	}
+	if _, err := ModTime(filename, "none"); err != ErrNotFound {
+		t.Fatal("bad not found:", err)
+	}
+	// время должно сохраняться при повторном открытии
+	if err := Close(filename); err != nil {
+		t.Fatal(err)
+	}
+	modTime2, err := ModTime(filename, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !modTime2.Equal(modTime) {
+		t.Fatal("bad reopened modification time:", modTime2)
+	}
+}
+
+func TestGetRawJSON(t *testing.T) {
+	db, err := OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.PutJSON("json", map[string]int{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("text", []byte("not json")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := db.GetRawJSON("json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"a":1}` {
+		t.Fatalf("bad json: %s", data)
+	}
+	if _, err := db.GetRawJSON("text"); err == nil {
+		t.Fatal("invalid json returned")
+	}
+	if _, err := db.GetRawJSON("none"); err != ErrNotFound {
+		t.Fatalf("bad not found error: %v", err)
+	}
+	// для отсутствующих ключей возвращается nil
+	values, err := db.GetsJSON("json", "none")
+	if err != nil || string(values[0]) != `{"a":1}` || values[1] != nil {
+		t.Fatalf("bad values: %q, %v", values, err)
+	}
+	if _, err := db.GetsJSON("json", "text"); !errors.Is(err, ErrInvalidJSON) {
+		t.Fatalf("invalid json returned: %v", err)
+	}
+	values, err = db.GetsRawUnchecked("json", "text", "none")
+	if err != nil || string(values[0]) != `{"a":1}` ||
+		string(values[1]) != "not json" || values[2] != nil {
+		t.Fatalf("bad unchecked values: %q, %v", values, err)
+	}
+}
+
+func TestJSONOnly(t *testing.T) {
+	db, err := OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// ошибка чтения указывает на ключ и начало значения
+	if err := db.Put("garbage", []byte("<html>"+strings.Repeat("x", 100))); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.GetsJSON("garbage")
+	if !errors.Is(err, ErrInvalidJSON) ||
+		!strings.Contains(err.Error(), `"garbage"`) ||
+		!strings.Contains(err.Error(), `"<html>xxx`) {
+		t.Fatalf("bad invalid JSON error: %v", err)
+	}
+	if err := db.PutJSON("nan", math.NaN()); err == nil {
+		t.Fatal("NaN saved as JSON")
+	}
+
+	db.SetJSONOnly(true)
+	if err := db.Put("text", []byte("text")); !errors.Is(err, ErrInvalidJSON) {
+		t.Fatalf("invalid JSON saved: %v", err)
+	}
+	if err := db.PutReader("text", strings.NewReader("text"), 4); !errors.Is(err, ErrInvalidJSON) {
+		t.Fatalf("invalid JSON saved from reader: %v", err)
+	}
+	if err := db.Puts(map[string][]byte{
+		"a": []byte(`"a"`), "b": []byte("b"),
+	}); !errors.Is(err, ErrInvalidJSON) {
+		t.Fatalf("invalid JSON saved with Puts: %v", err)
+	}
+	if db.Has("a") || db.Has("text") {
+		t.Fatal("invalid values saved")
+	}
+	if err := db.Put("json", []byte(`{"a":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutReader("reader", strings.NewReader("[1]"), 3); err != nil {
+		t.Fatal(err)
+	}
+	db.SetJSONOnly(false)
+	if err := db.Put("text", []byte("text")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxValueSize(t *testing.T) {
+	db, err := OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxValueSize(8)
+	if err := db.Put("big", []byte("123456789")); err != ErrValueTooLarge {
+		t.Fatalf("too large value saved: %v", err)
+	}
+	if err := db.PutJSON("big", "1234567"); err != ErrValueTooLarge {
+		t.Fatalf("too large JSON saved: %v", err)
+	}
+	if err := db.PutReader("big", strings.NewReader("123456789"), 9); err != ErrValueTooLarge {
+		t.Fatalf("too large value saved from reader: %v", err)
+	}
+	if err := db.Puts(map[string][]byte{
+		"a": []byte("a"), "b": []byte("123456789"),
+	}); err != ErrValueTooLarge {
+		t.Fatalf("too large value saved with Puts: %v", err)
+	}
+	var batch = new(WriteBatch)
+	batch.Put("a", []byte("a"))
+	batch.Put("b", []byte("123456789"))
+	if err := db.Apply(batch); err != ErrValueTooLarge {
+		t.Fatalf("too large value saved with Apply: %v", err)
+	}
+	if db.Has("a") || db.Has("big") || db.Count() != 0 {
+		t.Fatal("too large values saved")
+	}
+	// значение, увеличенное с помощью Append, тоже проверяется
+	if err := db.Put("append", []byte("1234")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Append("append", []byte("56789")); err != ErrValueTooLarge {
+		t.Fatalf("too large value appended: %v", err)
+	}
+	if err := db.Append("append", []byte("5678")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("append"); err != nil || string(value) != "12345678" {
+		t.Fatalf("bad appended value: %q, %v", value, err)
+	}
+	db.SetMaxValueSize(0)
+	if err := db.Put("big", []byte("123456789")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	db, err := OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	// размер значения после добавления проверяется до приведения к uint32:
+	// запись индекса подменяется, чтобы не выделять 4 Гб
+	var index = db.indexes["key"]
+	var fake = index
+	fake.DataSize, fake.EmptySize = math.MaxUint32-8, 16
+	db.indexes["key"] = fake
+	if err := db.Append("key", []byte("0123456789")); err != ErrValueTooLarge {
+		t.Fatalf("bad huge append error: %v", err)
+	}
+	db.indexes["key"] = index
+	// ключ вместе со значением тоже не должен превышать 4 Гб
+	var r = strings.NewReader("")
+	if err := db.PutReader("huge", r, math.MaxUint32); err != ErrValueTooLarge {
+		t.Fatalf("bad huge reader error: %v", err)
+	}
+	if db.Has("huge") {
+		t.Fatal("huge value saved")
+	}
+	if value, err := db.Get("key"); err != nil || string(value) != "value" {
+		t.Fatalf("bad value after huge append: %q, %v", value, err)
+	}
+	// запись, которая увеличила бы файл больше 4 Гб, не выполняется; файл
+	// в памяти при этом не увеличивается, так как запись не происходит
+	var size = db.size
+	db.size = math.MaxUint32 - 16
+	if err := db.Put("big", make([]byte, 32)); err != ErrFileTooLarge {
+		t.Fatalf("bad file too large error: %v", err)
+	}
+	if db.Has("big") || db.size != math.MaxUint32-16 {
+		t.Fatal("value saved over file limit:", db.size)
+	}
+	db.size = size
+	if err := db.Preallocate(math.MaxUint32 + 1); err != ErrFileTooLarge {
+		t.Fatalf("bad preallocate error: %v", err)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestItems(t *testing.T) {
+	var filename = "db/items.db"
+	defer Remove(filename)
+	err := Puts(filename, map[string]interface{}{
+		"i1": "one",
+		"i2": "two",
+		"i3": "three",
+		"x1": "other",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := Items(filename, "i", "i1", 0, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 ||
+		items[0].Key != "i2" || string(items[0].Value) != "two" ||
+		items[1].Key != "i3" || string(items[1].Value) != "three" {
+		t.Fatalf("bad items: %q", items)
+	}
+}
+
+func TestSyncPolicy(t *testing.T) {
+	os.RemoveAll(filename)
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetSyncPolicy(SyncEveryInterval, 10*time.Millisecond)
+	var flusher = db.flusher
+	if flusher == nil {
+		t.Fatal("flusher not started")
+	}
+	for i := 0; i < 100; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	// смена политики останавливает фоновый сброс
+	db.SetSync(true)
+	select {
+	case <-flusher.done:
+	default:
+		t.Fatal("flusher not stopped")
+	}
+	db.SetSyncPolicy(SyncEveryInterval, time.Second)
+	flusher = db.flusher
+	if err := db.Put("key", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-flusher.done:
+	default:
+		t.Fatal("flusher not stopped on close")
+	}
+}
+
+func TestSyncPolicyCompact(t *testing.T) {
+	os.RemoveAll(filename)
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetSyncPolicy(SyncEveryInterval, time.Millisecond)
+	// фоновый сброс выполняется одновременно со сжатием и закрытием
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 10; j++ {
+			var key = fmt.Sprintf("key%d", j)
+			if err := db.Put(key, []byte(fmt.Sprint("value", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var flusher = db.flusher
+	if err := db.Put("key", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-flusher.done
+	// политика закрытого хранилища не запускает фоновый сброс
+	db.SetSyncPolicy(SyncEveryInterval, time.Millisecond)
+	if db.flusher != nil {
+		t.Fatal("flusher started after close")
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	os.RemoveAll(filename)
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("old", make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("last", nil); err != nil {
+		t.Fatal(err)
+	}
+	var free = db.indexes["old"]
+	if err := db.Delete("old"); err != nil {
+		t.Fatal(err)
+	}
+	err = db.BulkLoad(func(put func(key string, value []byte) error) error {
+		for i := 0; i < 1000; i++ {
+			var key = fmt.Sprintf("key%d", i%500)
+			if err := put(key, []byte(fmt.Sprintf("value%d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Count() != 501 {
+		t.Fatal("bad count:", db.Count())
+	}
+	// свободное место не использовалось при загрузке
+	var reused = true
+	for _, index := range db.deleted.slice() {
+		if index.Offset == free.Offset {
+			reused = false
+		}
+	}
+	if reused {
+		t.Fatal("free slot used during bulk load")
+	}
+	var deleted = db.deleted.slice()
+	for i := 1; i < len(deleted); i++ {
+		if deleted[i].Size() < deleted[i-1].Size() {
+			t.Fatal("deleted not sorted")
+		}
+	}
+	value, err := db.Get("key10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value510" {
+		t.Fatalf("bad value: %q", value)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	os.RemoveAll(filename)
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// освобождаем место, в которое затем попадет короткое значение
+	if err := db.Put("big", make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("last", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("big"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Append("log", []byte("line1\n")); err != nil {
+		t.Fatal(err)
+	}
+	var index = db.indexes["log"]
+	if index.EmptySize == 0 {
+		t.Fatal("value is not in free slot")
+	}
+	if err := db.Append("log", []byte("line2\n")); err != nil {
+		t.Fatal(err)
+	}
+	if db.indexes["log"].Offset != index.Offset {
+		t.Fatal("value moved on append")
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	// значение, не помещающееся в свободное место, перезаписывается
+	if err := db.Append("log", make([]byte, 200)); err != nil {
+		t.Fatal(err)
+	}
+	if db.indexes["log"].Offset == index.Offset {
+		t.Fatal("value not moved on large append")
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	value, err := db.Get("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(value) != 212 || string(value[:12]) != "line1\nline2\n" {
+		t.Fatalf("bad appended value: %q", value[:12])
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	os.RemoveAll(filename)
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"a1", "a2", "a3", "a10", "b1", "b2", "c1"} {
+		if err := db.Put(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.CountPrefix("a") != 4 || db.CountPrefix("") != db.Count() {
+		t.Fatal("bad count prefix:", db.CountPrefix("a"))
+	}
+	count, err := db.DeletePrefix("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 || db.Has("a1") || db.Has("a10") || !db.Has("b1") {
+		t.Fatal("bad delete prefix:", count, db.Keys("", "", 0, 0, true))
+	}
+	count, err = db.DeleteRange("b2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 || db.Count() != 1 || !db.Has("b1") {
+		t.Fatal("bad delete range:", count, db.Keys("", "", 0, 0, true))
+	}
+	// освободившееся место доступно для записи
+	if db.deleted.len() == 0 {
+		t.Fatal("deleted slots are not registered")
+	}
+	if err := db.Put("new", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if db.indexes["new"].Offset > db.indexes["b1"].Offset {
+		t.Fatal("deleted slots are not reused")
+	}
+	if count, err := db.DeletePrefix("x"); err != nil || count != 0 {
+		t.Fatal("bad empty delete:", count, err)
+	}
+}
+
+// BenchmarkKeys сравнивает повторные выборки ключей с использованием
+// отсортированного списка и с его построением заново при каждом запросе.
+func BenchmarkKeys(b *testing.B) {
+	os.RemoveAll(filename)
+	db, err := Open(filename)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	err = db.BulkLoad(func(put func(key string, value []byte) error) error {
+		for i := 0; i < 10000; i++ {
+			if err := put(fmt.Sprintf("key%d", i), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			db.Keys("", "key5000", 0, 20, true)
+		}
+	})
+	b.Run("rebuild", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			db.mu.Lock()
+			db.sorted = nil
+			db.mu.Unlock()
+			db.Keys("", "key5000", 0, 20, true)
+		}
+	})
+}
+
+func TestKeysCache(t *testing.T) {
+	os.RemoveAll(filename)
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"b", "a", "c"} {
+		if err := db.Put(key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keys := db.Keys("", "", 0, 0, true); fmt.Sprint(keys) != "[a b c]" {
+		t.Fatal("bad keys:", keys)
+	}
+	// после изменения набора ключей список строится заново
+	if err := db.Put("aa", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := db.Keys("", "", 0, 0, false); fmt.Sprint(keys) != "[aa c a]" {
+		t.Fatal("bad keys after change:", keys)
+	}
+	if keys := db.Range("a", "aa", true); fmt.Sprint(keys) != "[a c]" {
+		t.Fatal("bad range after change:", keys)
+	}
+}
+
+func TestGetReader(t *testing.T) {
+	os.RemoveAll(filename)
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.GetReader("key"); err != ErrNotFound {
+		t.Fatal("bad not found error:", err)
+	}
+	var value = []byte(strings.Repeat("0123456789", 100))
+	if err := db.Put("key", value); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("next", nil); err != nil {
+		t.Fatal(err)
+	}
+	r, err := db.GetReader("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Seek(995, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "56789" {
+		t.Fatalf("bad tail: %q", data)
+	}
+	if size, err := r.Seek(0, io.SeekEnd); err != nil || size != int64(len(value)) {
+		t.Fatal("bad size:", size, err)
+	}
+	// сжатое значение распаковывается
+	db.SetCompression(CompressionGzip)
+	if err := db.Put("zip", value); err != nil {
+		t.Fatal(err)
+	}
+	if r, err = db.GetReader("zip"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = io.ReadAll(r); err != nil || string(data) != string(value) {
+		t.Fatal("bad compressed value:", err)
+	}
+}
+
+func TestPutReader(t *testing.T) {
+	os.RemoveAll(filename)
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var value = strings.Repeat("0123456789", 100)
+	if err := db.PutReader("key", strings.NewReader(value), 1000); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := db.Get("key"); err != nil || string(data) != value {
+		t.Fatal("bad value:", err)
+	}
+	// при несовпадении размера прежнее значение сохраняется
+	if err := db.PutReader("key", strings.NewReader("short"), 10); err != ErrSizeMismatch {
+		t.Fatal("bad short value error:", err)
+	}
+	if err := db.PutReader("key", strings.NewReader("too long"), 3); err != ErrSizeMismatch {
+		t.Fatal("bad long value error:", err)
+	}
+	if data, err := db.Get("key"); err != nil || string(data) != value {
+		t.Fatal("value changed on error:", err)
+	}
+	if err := db.PutReader("key", strings.NewReader("new"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := db.Get("key"); err != nil || string(data) != "new" {
+		t.Fatalf("bad reopened value: %q, %v", data, err)
+	}
+	if db.Count() != 1 {
+		t.Fatal("bad count:", db.Count())
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeysFunc(t *testing.T) {
+	db, err := OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"n:10", "n:9", "n:100", "n:2", "x:1"} {
+		if err := db.Put(key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var number = func(key string) (n int) {
+		fmt.Sscanf(key, "n:%d", &n)
+		return n
+	}
+	var desc = func(a, b string) bool {
+		return number(a) > number(b)
+	}
+	for _, test := range []struct {
+		offset, limit uint32
+		keys          string
+	}{
+		{0, 0, "n:100 n:10 n:9 n:2"},
+		{1, 2, "n:10 n:9"},
+		{3, 10, "n:2"},
+		{4, 0, ""},
+		{10, 1, ""},
+	} {
+		var keys = db.KeysFunc("n:", desc, test.offset, test.limit)
+		if strings.Join(keys, " ") != test.keys {
+			t.Errorf("%d, %d: bad keys %v", test.offset, test.limit, keys)
+		}
+	}
+}
+
+func TestForEach(t *testing.T) {
+	db, err := OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 1; i <= 5; i++ {
+		if err := db.Put(fmt.Sprintf("n:%d", i), []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("x", []byte{100}); err != nil {
+		t.Fatal(err)
+	}
+	var sum int
+	err = db.ForEach("n:", func(key string, value []byte) error {
+		sum += int(value[0])
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 15 {
+		t.Fatalf("bad sum: %d", sum)
+	}
+	var keys []string
+	err = db.ForEach("", func(key string, value []byte) error {
+		keys = append(keys, key)
+		if len(keys) == 2 {
+			return ErrStopIteration
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, " ") != "x n:1" {
+		t.Fatalf("bad keys: %v", keys)
+	}
+	var errTest = errors.New("test")
+	err = db.ForEach("", func(key string, value []byte) error {
+		return errTest
+	})
+	if err != errTest {
+		t.Fatalf("bad error: %v", err)
+	}
+}
+
+func TestPutX(t *testing.T) {
+	db, err := OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i, want := range []bool{true, false, false} {
+		created, err := db.PutX("key", []byte(fmt.Sprint("value", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created != want {
+			t.Errorf("%d: bad created: %v", i, created)
+		}
+	}
+	if err := db.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if created, err := db.PutX("key", nil); err != nil || !created {
+		t.Errorf("bad created after delete: %v, %v", created, err)
+	}
+	if created, err := db.PutX("", nil); err != ErrEmptyKey || created {
+		t.Errorf("bad empty key result: %v, %v", created, err)
+	}
+}
+
+// BenchmarkGetsJSON сравнивает выборку значений в формате JSON с проверкой
+// формата и без нее.
+func BenchmarkGetsJSON(b *testing.B) {
+	db, err := OpenMemory()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	var (
+		keys  = make([]string, 5000)
+		value = map[string]interface{}{
+			"name":  strings.Repeat("name", 16),
+			"items": []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+			"text":  strings.Repeat("lorem ipsum ", 64),
+		}
+	)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+	}
+	data, err := JSON.Marshal(value)
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = db.BulkLoad(func(put func(key string, value []byte) error) error {
+		for _, key := range keys {
+			if err := put(key, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("checked", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.GetsJSON(keys...); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("unchecked", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.GetsRawUnchecked(keys...); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
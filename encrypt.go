@@ -0,0 +1,89 @@
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+)
+
+// ErrEncrypted возвращается при попытке открыть зашифрованное хранилище без
+// ключа шифрования.
+var ErrEncrypted = errors.New("store is encrypted")
+
+// ErrBadKey возвращается при попытке открыть зашифрованное хранилище с
+// неверным ключом шифрования.
+var ErrBadKey = errors.New("invalid encryption key")
+
+// errNotEncrypted возвращается при попытке открыть хранилище без шифрования
+// с ключом шифрования.
+var errNotEncrypted = errors.New("store is not encrypted")
+
+// nonceSize и tagSize задают размеры nonce и кода аутентификации AES-GCM.
+const (
+	nonceSize = 12
+	tagSize   = 16
+)
+
+// checkSize задает размер блока проверки ключа шифрования в заголовке файла.
+const checkSize = nonceSize + tagSize
+
+// checkData используется в качестве дополнительных данных при создании блока
+// проверки ключа шифрования.
+var checkData = []byte("keystore")
+
+// newCipher возвращает AES-GCM для указанного ключа шифрования.
+func newCipher(secret []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newCheck возвращает блок проверки ключа шифрования для заголовка файла:
+// случайный nonce и код аутентификации пустого сообщения.
+func newCheck(aead cipher.AEAD) ([]byte, error) {
+	var nonce = make([]byte, nonceSize, checkSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, nil, checkData), nil
+}
+
+// verifyCheck проверяет, что ключ шифрования соответствует заголовку файла.
+// Если ключ не задан, то файл не должен быть зашифрован.
+func verifyCheck(aead cipher.AEAD, head *header) error {
+	switch {
+	case head.Flags&flagEncrypted == 0 && aead == nil:
+		return nil
+	case head.Flags&flagEncrypted == 0:
+		return errNotEncrypted
+	case aead == nil:
+		return ErrEncrypted
+	}
+	_, err := aead.Open(nil, head.Check[:nonceSize], head.Check[nonceSize:], checkData)
+	if err != nil {
+		return ErrBadKey
+	}
+	return nil
+}
+
+// seal шифрует данные значения. Ключ записи используется в качестве
+// дополнительных данных, поэтому зашифрованное значение нельзя перенести
+// в запись с другим ключом.
+func seal(aead cipher.AEAD, key string, data []byte) ([]byte, error) {
+	var nonce = make([]byte, nonceSize, nonceSize+len(data)+tagSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, []byte(key)), nil
+}
+
+// unseal расшифровывает данные значения.
+func unseal(aead cipher.AEAD, key string, data []byte) ([]byte, error) {
+	if len(data) < nonceSize+tagSize {
+		return nil, ErrBadKey
+	}
+	return aead.Open(nil, data[:nonceSize], data[nonceSize:], []byte(key))
+}
@@ -0,0 +1,137 @@
+package keystore
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"os"
+	"testing"
+)
+
+func TestEncryption(t *testing.T) {
+	var (
+		filename = "db/encrypted.db"
+		secret   = []byte("0123456789abcdef")
+		value    = []byte("secret value")
+	)
+	db, err := OpenEncrypted(filename, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(filename)
+	if err := db.Put("key", value); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("empty", nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := db.read(db.indexes["key"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, value) {
+		t.Fatal("value is not encrypted")
+	}
+	// повторное открытие уже открытого хранилища проверяет ключ
+	if _, err := Open(filename); !errors.Is(err, ErrEncrypted) {
+		t.Fatal("bad open without key:", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(filename); !errors.Is(err, ErrEncrypted) {
+		t.Fatal("bad open without key:", err)
+	}
+	if _, err := OpenEncrypted(filename, []byte("fedcba9876543210")); !errors.Is(err, ErrBadKey) {
+		t.Fatal("bad open with wrong key:", err)
+	}
+	db, err = OpenEncrypted(filename, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Fatalf("bad decrypted value: %q", got)
+	}
+	if got, err := db.Get("empty"); err != nil || len(got) != 0 {
+		t.Fatalf("bad empty value: %q, %v", got, err)
+	}
+	// копия зашифрованного хранилища так же зашифрована
+	var buf bytes.Buffer
+	if _, err := db.Backup(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var backup = buf.Bytes()
+	// без ключа открытое хранилище не закрывается и не заменяется
+	_, err = Restore(filename, bytes.NewReader(backup), true)
+	if !errors.Is(err, ErrEncrypted) {
+		t.Fatal("bad restore of encrypted backup:", err)
+	}
+	if _, err := db.Get("key"); err != nil {
+		t.Fatal("store closed by failed restore:", err)
+	}
+	var restorename = "db/encrypted_restore.db"
+	defer Remove(restorename)
+	_, err = RestoreWithOptions(restorename, bytes.NewReader(backup), true,
+		&Options{EncryptionKey: []byte("fedcba9876543210")})
+	if !errors.Is(err, ErrBadKey) {
+		t.Fatal("bad restore with wrong key:", err)
+	}
+	if _, err := os.Stat(restorename); !os.IsNotExist(err) {
+		t.Fatal("restored with wrong key:", err)
+	}
+	restored, err := RestoreWithOptions(restorename, bytes.NewReader(backup),
+		true, &Options{EncryptionKey: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := restored.Get("key"); err != nil || !bytes.Equal(got, value) {
+		t.Fatalf("bad restored value: %q, %v", got, err)
+	}
+	// то же самое для копии в памяти
+	data, err = db.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenBinary(data); !errors.Is(err, ErrEncrypted) {
+		t.Fatal("bad binary open without key:", err)
+	}
+	loaded, err := OpenBinaryWithOptions(data, &Options{EncryptionKey: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+	if got, err := loaded.Get("key"); err != nil || !bytes.Equal(got, value) {
+		t.Fatalf("bad loaded value: %q, %v", got, err)
+	}
+}
+
+func TestEncryptionSizeLimit(t *testing.T) {
+	var filename = "db/encrypted_limit.db"
+	os.Remove(filename)
+	db, err := OpenEncrypted(filename, []byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(filename)
+	// значение отображается в память без выделения 4 Гб: его данные не
+	// читаются, пока размер не проверен
+	huge, err := mmapFile(db.f, math.MaxUint32-20)
+	if err != nil {
+		t.Skip("mmap unsupported:", err)
+	}
+	defer munmapFile(huge)
+	// значение помещается в 4 Гб, но зашифрованное уже нет
+	for _, parallel := range []bool{false, true} {
+		db.SetParallelWrites(parallel)
+		if err := db.Put("huge", huge); err != ErrValueTooLarge {
+			t.Fatalf("parallel=%v: bad huge value error: %v", parallel, err)
+		}
+	}
+	if db.Has("huge") || db.Stats().Size != db.start {
+		t.Fatal("huge value saved")
+	}
+}
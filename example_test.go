@@ -104,3 +104,67 @@ func ExampleDB_Keys() {
 	// 4: ["test3" "test4"]
 	// 5: ["test2" "test1" "aaaa6"]
 }
+
+func ExampleDB_Range() {
+	// открываем хранилище
+	db, err := keystore.Open("db/test_range.db")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close() // закрываем по окончании
+	// заносим тестовые данные
+	err = db.PutsJSON(map[string]interface{}{
+		"a1":  1,
+		"a2":  2,
+		"a3":  3,
+		"a10": 10,
+		"b1":  11,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// выбираем ключи от `a2` до `a10`, не включая его
+	keys := db.Range("a2", "a10", true)
+	fmt.Printf("1: %q\n", keys)
+	// выбираем ключи от `a2` без ограничения сверху в обратном порядке
+	keys = db.Range("a2", "", false)
+	fmt.Printf("2: %q\n", keys)
+	// output:
+	// 1: ["a2" "a3" "b1"]
+	// 2: ["a10" "b1" "a3" "a2"]
+}
+
+func ExampleDB_Page() {
+	// открываем хранилище
+	db, err := keystore.Open("db/test_page.db")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close() // закрываем по окончании
+	// заносим тестовые данные
+	err = db.PutsJSON(map[string]interface{}{
+		"a1": 1,
+		"a2": 2,
+		"a3": 3,
+		"a4": 4,
+		"a5": 5,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// перебираем ключи по две штуки на странице, пока курсор не пустой
+	var keys []string
+	for cursor := ""; ; {
+		keys, cursor = db.Page("a", cursor, 2, true)
+		fmt.Printf("%q %q\n", keys, cursor)
+		if cursor == "" {
+			break
+		}
+	}
+	// output:
+	// ["a1" "a2"] "a2"
+	// ["a3" "a4"] "a4"
+	// ["a5"] ""
+}
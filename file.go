@@ -0,0 +1,179 @@
+package keystore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// File описывает операции с файлом, которые использует хранилище. Помимо
+// обычного файла на диске это позволяет хранить данные в памяти или в любом
+// другом месте, поддерживающем произвольный доступ к данным.
+//
+// Хранилище не использует текущую позицию в файле: Seek вызывается только
+// для определения размера файла. Закрытие файла выполняется один раз при
+// закрытии хранилища, а повторное закрытие хранилища файл уже не затрагивает.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string              // имя файла
+	Truncate(size int64) error // изменение размера файла
+	Sync() error               // сброс данных на диск
+}
+
+// FileOpener открывает файл с указанным именем и возвращает его. Если указан
+// флаг readOnly, то файл используется только для чтения. Если файл на
+// запись не существует, то он должен быть создан пустым.
+type FileOpener func(filename string, readOnly bool) (File, error)
+
+// OpenFile открывает хранилище в файле, который возвращает функция openFile.
+// Это позволяет хранить данные не только в обычном файле на диске.
+//
+// Как и в случае OpenReadOnly, хранилище не добавляется в список открытых и
+// закрывать его необходимо самостоятельно.
+func OpenFile(filename string, openFile FileOpener) (*DB, error) {
+	return open(context.Background(), openFile, filename, false, nil)
+}
+
+// lockedFile описывает файл на диске, заблокированный от изменения другими
+// процессами. Блокировка снимается при закрытии файла.
+//
+// Сжатие хранилища (см. db.Compact) заменяет открытый файл новым, а чтение
+// без блокировки хранилища может выполняться одновременно с этим. Поэтому
+// открытый файл хранится так, чтобы его можно было заменить атомарно: каждая
+// операция выполняется с файлом, действующим в момент ее вызова.
+type lockedFile struct {
+	file atomic.Value // *os.File
+	name string       // имя, с которым файл был открыт
+}
+
+// newLockedFile возвращает описание уже заблокированного файла.
+func newLockedFile(file *os.File) *lockedFile {
+	var f = &lockedFile{name: file.Name()}
+	f.file.Store(file)
+	return f
+}
+
+// os возвращает действующий открытый файл.
+func (f *lockedFile) os() *os.File {
+	return f.file.Load().(*os.File)
+}
+
+// replace заменяет открытый файл на file, который уже должен быть
+// заблокирован, и возвращает прежний. Имя файла не изменяется.
+func (f *lockedFile) replace(file *os.File) *os.File {
+	return f.file.Swap(file).(*os.File)
+}
+
+// Name возвращает имя, с которым файл был открыт.
+func (f *lockedFile) Name() string { return f.name }
+
+// ReadAt читает данные файла, начиная с указанного смещения.
+func (f *lockedFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.os().ReadAt(p, off)
+}
+
+// WriteAt записывает данные в файл, начиная с указанного смещения.
+func (f *lockedFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.os().WriteAt(p, off)
+}
+
+// Seek изменяет текущую позицию в файле.
+func (f *lockedFile) Seek(offset int64, whence int) (int64, error) {
+	return f.os().Seek(offset, whence)
+}
+
+// Truncate изменяет размер файла.
+func (f *lockedFile) Truncate(size int64) error { return f.os().Truncate(size) }
+
+// Sync сбрасывает данные файла на диск.
+func (f *lockedFile) Sync() error { return f.os().Sync() }
+
+// Stat возвращает описание открытого файла.
+func (f *lockedFile) Stat() (os.FileInfo, error) { return f.os().Stat() }
+
+// Fd возвращает дескриптор открытого файла.
+func (f *lockedFile) Fd() uintptr { return f.os().Fd() }
+
+// openOSFile открывает обычный файл на диске с правами доступа по умолчанию.
+var openOSFile = osFileOpener(defaultFileMode)
+
+// osFileOpener возвращает функцию, открывающую обычный файл на диске, который
+// при необходимости создается с правами доступа perm. На открытый файл
+// устанавливается блокировка: для чтения достаточно разделяемой блокировки.
+func osFileOpener(perm os.FileMode) FileOpener {
+	return func(filename string, readOnly bool) (File, error) {
+		var flag = os.O_CREATE | os.O_RDWR
+		if readOnly {
+			flag = os.O_RDONLY
+		}
+		file, err := os.OpenFile(filename, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		if err = lockFile(file, !readOnly); err != nil {
+			_ = file.Close()
+			if err == errWouldBlock {
+				err = ErrLocked
+			}
+			return nil, &os.PathError{Op: "lock", Path: filename, Err: err}
+		}
+		return newLockedFile(file), nil
+	}
+}
+
+// Close снимает блокировку и закрывает файл.
+func (f *lockedFile) Close() error {
+	return closeLocked(f.os())
+}
+
+// closeLocked снимает блокировку с файла и закрывает его.
+func closeLocked(file *os.File) error {
+	_ = unlockFile(file) // блокировка все равно снимается при закрытии
+	return file.Close()
+}
+
+// ErrFileReplaced возвращается Healthy, если файл хранилища был удален или
+// заменен другим файлом после открытия хранилища.
+var ErrFileReplaced = errors.New("store file removed or replaced")
+
+// Healthy проверяет, что файл с указанным при открытии именем по-прежнему
+// является тем же самым файлом, с которым работает хранилище. Если файл был
+// удален или заменен (например, при ротации логов или по ошибке), то запись
+// продолжает выполняться в уже недоступный файл и все изменения будут потеряны
+// после закрытия хранилища. В этом случае возвращается ошибка ErrFileReplaced
+// и хранилище следует закрыть и открыть заново.
+//
+// Файлы сравниваются с помощью os.SameFile: в unix это номер устройства и
+// inode. В Windows открытый файл обычно нельзя удалить или переименовать,
+// поэтому проверка имеет смысл в основном для сетевых дисков, где сравнение
+// выполняется по серийному номеру тома и индексу файла и не всегда надежно.
+//
+// Для хранилищ не на диске, например открытых с помощью OpenMemory или
+// OpenFile без поддержки метода Stat, проверяется только то, что хранилище
+// не закрыто.
+func (db *DB) Healthy() error {
+	db.mu.RLock()
+	var closed = db.closed
+	db.mu.RUnlock()
+	if closed {
+		return &os.PathError{Op: "healthy", Path: db.Path(), Err: ErrClosed}
+	}
+	file, ok := db.f.(interface{ Stat() (os.FileInfo, error) })
+	if !ok {
+		return nil
+	}
+	opened, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	current, err := os.Stat(db.Path())
+	if os.IsNotExist(err) || err == nil && !os.SameFile(opened, current) {
+		return &os.PathError{Op: "healthy", Path: db.Path(), Err: ErrFileReplaced}
+	}
+	return err
+}
@@ -0,0 +1,479 @@
+package keystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// countFile подсчитывает количество вызовов Sync и Close.
+type countFile struct {
+	File
+	syncs, closes int
+}
+
+func (f *countFile) Sync() error {
+	f.syncs++
+	return f.File.Sync()
+}
+
+func (f *countFile) Close() error {
+	f.closes++
+	return f.File.Close()
+}
+
+func TestOpenFile(t *testing.T) {
+	var file *countFile
+	db, err := OpenFile("custom", func(filename string, readOnly bool) (File, error) {
+		if readOnly {
+			t.Error("unexpected read only")
+		}
+		file = &countFile{File: newMemFile(filename)}
+		return file, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Path() != "custom" {
+		t.Fatalf("bad path: %q", db.Path())
+	}
+	if err := db.Put("key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if file.syncs == 0 {
+		t.Error("file not synced")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != ErrClosed {
+		t.Fatal(err)
+	}
+	if file.closes != 1 {
+		t.Fatalf("bad close count: %d", file.closes)
+	}
+
+	var errOpen = errors.New("open error")
+	_, err = OpenFile("bad", func(string, bool) (File, error) {
+		return nil, errOpen
+	})
+	if err != errOpen {
+		t.Fatalf("bad error: %v", err)
+	}
+}
+
+func TestClosed(t *testing.T) {
+	db, err := OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// до закрытия в хранилище есть значения, корзина и свободное место
+	for _, key := range []string{"free", "trash", "key", "last"} {
+		if err := db.Put(key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("free"); err != nil {
+		t.Fatal(err)
+	}
+	db.SetSoftDelete(true)
+	if err := db.Delete("trash"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != ErrClosed || !errors.Is(err, os.ErrClosed) {
+		t.Errorf("bad double close: %v", err)
+	}
+	if _, err := db.Get("key"); err != ErrClosed {
+		t.Errorf("bad get: %v", err)
+	}
+	if _, err := db.GetReader("key"); err != ErrClosed {
+		t.Errorf("bad get reader: %v", err)
+	}
+	if err := db.Put("key", []byte("new")); err != ErrClosed {
+		t.Errorf("bad put: %v", err)
+	}
+	if err := db.PutReader("key", strings.NewReader("new"), 3); err != ErrClosed {
+		t.Errorf("bad put reader: %v", err)
+	}
+	if err := db.Append("key", []byte("new")); err != ErrClosed {
+		t.Errorf("bad append: %v", err)
+	}
+	if err := db.Delete("key"); err != ErrClosed {
+		t.Errorf("bad delete: %v", err)
+	}
+	// все остальные методы, возвращающие ошибку
+	for name, fn := range map[string]func() error{
+		"Sync":     db.Sync,
+		"Truncate": db.Truncate,
+		"Verify":   db.Verify,
+		"Reload":   db.Reload,
+		"Healthy":  db.Healthy,
+		"ModTime":  func() error { _, err := db.ModTime("key"); return err },
+		"Size":     func() error { _, err := db.Size("key"); return err },
+		"Gets":     func() error { _, err := db.Gets("key", "none"); return err },
+		"Items":    func() error { _, err := db.Items("", "", 0, 0, true); return err },
+		"ForEach": func() error {
+			return db.ForEach("", func(string, []byte) error { return nil })
+		},
+		"Backup":       func() error { _, err := db.Backup(io.Discard); return err },
+		"NextSequence": func() error { _, err := db.NextSequence(); return err },
+		"SetSequence":  func() error { return db.SetSequence(100) },
+		"Increment":    func() error { _, err := db.Increment("n", 1); return err },
+		"PutIfAbsent": func() error {
+			_, err := db.PutIfAbsent("key", nil)
+			return err
+		},
+		"DeleteIf": func() error { _, err := db.DeleteIf("key", nil); return err },
+		"Apply":    func() error { return db.Apply(new(WriteBatch)) },
+		"BulkLoad": func() error {
+			return db.BulkLoad(func(func(string, []byte) error) error { return nil })
+		},
+		"Undelete":    func() error { return db.Undelete("key") },
+		"Purge":       func() error { _, err := db.Purge(); return err },
+		"Preallocate": func() error { return db.Preallocate(1024) },
+		"QueryIndex":  func() error { _, err := db.QueryIndex("name", nil); return err },
+		"KeysContext": func() error {
+			_, err := db.KeysContext(context.Background(), "", "", 0, 0, true)
+			return err
+		},
+		"GetMap":     func() error { _, err := db.GetMap("key"); return err },
+		"GetsJSON":   func() error { _, err := db.GetsJSON("key"); return err },
+		"GetRawJSON": func() error { _, err := db.GetRawJSON("key"); return err },
+		"PutX":       func() error { _, err := db.PutX("key", nil); return err },
+		"Compact":    db.Compact,
+	} {
+		if err := fn(); !errors.Is(err, ErrClosed) {
+			t.Errorf("bad %s: %v", name, err)
+		}
+	}
+	// методы без ошибки видят пустое хранилище, а не данные до закрытия
+	if db.Count() != 0 || db.CountPrefix("k") != 0 || db.Has("key") ||
+		db.TotalSize() != 0 {
+		t.Error("closed store is not empty")
+	}
+	if _, ok := db.IndexInfo("key"); ok {
+		t.Error("bad index info")
+	}
+	if keys := db.Keys("", "", 0, 0, true); len(keys) != 0 {
+		t.Errorf("bad keys: %q", keys)
+	}
+	if keys, _ := db.Page("", "", 0, true); len(keys) != 0 {
+		t.Errorf("bad page: %q", keys)
+	}
+	if keys := db.Range("", "", true); len(keys) != 0 {
+		t.Errorf("bad range: %q", keys)
+	}
+	if stats := db.Stats(); stats != (Stats{}) {
+		t.Errorf("bad stats: %+v", stats)
+	}
+	if len(db.Tombstones()) != 0 || len(db.ListDeleted()) != 0 ||
+		len(db.DeletedSlots()) != 0 {
+		t.Error("bad deleted lists")
+	}
+}
+
+func TestCloseConcurrent(t *testing.T) {
+	var filename = "db/close.db"
+	os.Remove(filename)
+	if err := os.MkdirAll("db", 0777); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filename)
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetSync(false)
+	for i := 0; i < 100; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), make([]byte, 1024)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// чтения, выполняемые одновременно с закрытием, должны либо вернуть
+	// значение, либо ErrClosed, но не ошибку чтения закрытого файла
+	var (
+		wg      sync.WaitGroup
+		started = make(chan struct{}, 8)
+		errs    = make(chan error, 8)
+	)
+	for g := 0; g < cap(errs); g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			started <- struct{}{}
+			for i := g; ; i++ {
+				var key = fmt.Sprintf("key%d", i%100)
+				_, err := db.Get(key)
+				if err == nil && i%2 == 0 {
+					_, err = db.Items("", key, 0, 5, true)
+				}
+				if err != nil {
+					if err != ErrClosed {
+						errs <- err
+					}
+					return
+				}
+			}
+		}(g)
+	}
+	for g := 0; g < cap(errs); g++ {
+		<-started
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error("read after close:", err)
+	}
+}
+
+// errCrash имитирует сбой при записи в файл.
+var errCrash = errors.New("crash")
+
+// crashFile имитирует сбой: после limit успешных записей все остальные
+// записи в файл не выполняются.
+type crashFile struct {
+	File
+	writes, limit int
+}
+
+func (f *crashFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.limit >= 0 && f.writes >= f.limit {
+		return 0, errCrash
+	}
+	f.writes++
+	return f.File.WriteAt(p, off)
+}
+
+func TestPutCrash(t *testing.T) {
+	// сбой при записи нового значения и при пометке прежнего удаленным
+	for extra := 0; extra < 2; extra++ {
+		var mem = newMemFile("crash")
+		var file = &crashFile{File: mem, limit: -1}
+		db, err := loadFile(context.Background(), file, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("key", []byte("old value")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("next", []byte("other")); err != nil {
+			t.Fatal(err)
+		}
+		file.limit = file.writes + extra
+		if err := db.Put("key", []byte("new longer value")); err != errCrash {
+			t.Fatalf("%d: bad crash error: %v", extra, err)
+		}
+		// после сбоя в файле должно остаться прежнее или новое значение
+		db, err = loadFile(context.Background(), mem, true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := db.Get("key")
+		if err != nil {
+			t.Fatalf("%d: value lost: %v", extra, err)
+		}
+		if string(value) != "old value" && string(value) != "new longer value" {
+			t.Fatalf("%d: bad value: %q", extra, value)
+		}
+	}
+}
+
+// orderFile запоминает, были ли сброшены на диск все записи в файл перед
+// записью по смещению watch.
+type orderFile struct {
+	File
+	watch    int64
+	unsynced int  // количество записей после последнего сброса
+	dirty    bool // перед записью по смещению watch были несброшенные записи
+}
+
+func (f *orderFile) WriteAt(p []byte, off int64) (int, error) {
+	if off == f.watch && f.unsynced > 0 {
+		f.dirty = true
+	}
+	f.unsynced++
+	return f.File.WriteAt(p, off)
+}
+
+func (f *orderFile) Sync() error {
+	f.unsynced = 0
+	return f.File.Sync()
+}
+
+func TestPutReaderCrash(t *testing.T) {
+	// сбой на каждом шаге записи нового значения
+	for extra := 0; extra < 4; extra++ {
+		var mem = newMemFile("crash")
+		var file = &crashFile{File: mem, limit: -1}
+		db, err := loadFile(context.Background(), file, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("key", []byte("old value")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("next", []byte("other")); err != nil {
+			t.Fatal(err)
+		}
+		file.limit = file.writes + extra
+		var value = "new longer value"
+		err = db.PutReader("key", strings.NewReader(value), uint32(len(value)))
+		if err != errCrash && err != nil {
+			t.Fatalf("%d: bad crash error: %v", extra, err)
+		}
+		db, err = loadFile(context.Background(), mem, true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := db.Get("key")
+		if err != nil {
+			t.Fatalf("%d: value lost: %v", extra, err)
+		}
+		if string(got) != "old value" && string(got) != value {
+			t.Fatalf("%d: bad value: %q", extra, got)
+		}
+	}
+	// прежнее значение помечается удаленным только после сброса на диск
+	// нового, в том числе записанного на место удаленных данных
+	for _, reuse := range []bool{false, true} {
+		var file = &orderFile{File: newMemFile("order"), watch: -1}
+		db, err := loadFile(context.Background(), file, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"free", "key", "next"} {
+			if err := db.Put(key, []byte("value of "+key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if reuse {
+			if err := db.Delete("free"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		file.watch = int64(db.indexes["key"].Offset)
+		var value = "new value"
+		err = db.PutReader("key", strings.NewReader(value), uint32(len(value)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file.dirty {
+			t.Fatalf("%v: old value deleted before new one synced", reuse)
+		}
+		if got, err := db.Get("key"); err != nil || string(got) != value {
+			t.Fatalf("%v: bad value: %q, %v", reuse, got, err)
+		}
+	}
+}
+
+func TestPutRollback(t *testing.T) {
+	// новое значение в конце файла и на месте удаленной записи
+	for _, reuse := range []bool{false, true} {
+		var file = &crashFile{File: newMemFile("rollback"), limit: -1}
+		db, err := loadFile(context.Background(), file, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"free", "key", "last"} {
+			if err := db.Put(key, []byte("value of "+key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if reuse {
+			if err := db.Delete("free"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var (
+			slots   = db.DeletedSlots()
+			size, _ = file.Seek(0, io.SeekEnd)
+		)
+		file.limit = file.writes
+		if err := db.Put("key", []byte("new value")); err != errCrash {
+			t.Fatalf("%v: bad crash error: %v", reuse, err)
+		}
+		file.limit = -1
+		if value, err := db.Get("key"); err != nil || string(value) != "value of key" {
+			t.Fatalf("%v: old value lost: %q, %v", reuse, value, err)
+		}
+		if current := db.DeletedSlots(); len(current) != len(slots) {
+			t.Errorf("%v: free slots changed: %v vs %v", reuse, current, slots)
+		}
+		if current, _ := file.Seek(0, io.SeekEnd); current != size {
+			t.Errorf("%v: file size changed: %d vs %d", reuse, current, size)
+		}
+		if err := db.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("key", []byte("new value")); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = loadFile(context.Background(), file, true, nil); err != nil {
+			t.Fatal(err)
+		}
+		if value, err := db.Get("key"); err != nil || string(value) != "new value" {
+			t.Fatalf("%v: bad new value: %q, %v", reuse, value, err)
+		}
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	var filename = "db/healthy.db"
+	os.RemoveAll(filename)
+	if err := os.MkdirAll("db", 0777); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenFile(filename, openOSFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filename)
+	defer db.Close()
+	if err := db.Healthy(); err != nil {
+		t.Fatal(err)
+	}
+	// файл заменен другим файлом с тем же именем
+	if err := os.Rename(filename, filename+".old"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filename + ".old")
+	if err := os.WriteFile(filename, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Healthy(); !errors.Is(err, ErrFileReplaced) {
+		t.Fatalf("replaced file: %v", err)
+	}
+	// файл удален
+	if err := os.Remove(filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Healthy(); !errors.Is(err, ErrFileReplaced) {
+		t.Fatalf("removed file: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Healthy(); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("closed store: %v", err)
+	}
+
+	mem, err := OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mem.Close()
+	if err := mem.Healthy(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,357 @@
+package keystore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"time"
+)
+
+// AllocStrategy задает стратегию выделения свободного места в файле для
+// записи новых данных.
+type AllocStrategy uint8
+
+// Поддерживаемые стратегии выделения свободного места.
+const (
+	// BestFit выбирает наименьшее подходящее по размеру свободное место. Все,
+	// что осталось незанятым, сохраняется за данными записи и может быть
+	// использовано только при перезаписи или дополнении того же значения.
+	// Используется по умолчанию.
+	BestFit AllocStrategy = iota
+	// BestFitSplit выбирает место так же, как BestFit, но если после записи
+	// данных остается достаточно места для еще одной записи, то оно
+	// отделяется и становится доступным для записи других значений.
+	BestFitSplit
+)
+
+// SetAllocStrategy устанавливает стратегию выделения свободного места.
+func (db *DB) SetAllocStrategy(strategy AllocStrategy) {
+	db.mu.Lock()
+	db.alloc = strategy
+	db.mu.Unlock()
+}
+
+// indexFree строит индексы свободных мест по смещению начала и конца,
+// которые используются для поиска соседних свободных мест.
+func (db *DB) indexFree() {
+	db.starts = make(map[uint32]index, db.deleted.len())
+	db.ends = make(map[uint32]uint32, db.deleted.len())
+	db.deleted.each(func(index index) {
+		db.starts[index.Offset] = index
+		db.ends[db.end(index)] = index.Offset
+	})
+}
+
+// end возвращает смещение конца места, занимаемого записью в файле.
+func (db *DB) end(index index) uint32 {
+	return index.Offset + uint32(db.recordHeaderSize()) + index.Size()
+}
+
+// free добавляет место в список свободных.
+//
+// Если непосредственно перед этим местом или сразу за ним в файле уже есть
+// свободное место, то они объединяются в одно: заголовок первого из них
+// перезаписывается заголовком удаленной записи без ключа и данных, который
+// охватывает их все. Во время пакетной загрузки места не объединяются.
+func (db *DB) free(slot index) error {
+	if db.bulk {
+		db.deleted.insert(slot)
+		db.starts[slot.Offset] = slot
+		db.ends[db.end(slot)] = slot.Offset
+		return nil
+	}
+	var merged = slot
+	if next, ok := db.starts[db.end(slot)]; ok {
+		db.unfree(next)
+		merged.EmptySize += uint32(db.recordHeaderSize()) + next.Size()
+	}
+	if offset, ok := db.ends[slot.Offset]; ok {
+		var prev = db.starts[offset]
+		db.unfree(prev)
+		prev.EmptySize += uint32(db.recordHeaderSize()) + merged.Size()
+		merged = prev
+	}
+	if merged != slot {
+		merged = index{
+			Offset:    merged.Offset,
+			EmptySize: merged.Size(),
+			Time:      uint32(time.Now().Unix()),
+		}
+		if err := db.writeFree(merged); err != nil {
+			return err
+		}
+	}
+	db.insertFree(merged)
+	return nil
+}
+
+// insertFree добавляет место в список свободных.
+func (db *DB) insertFree(index index) {
+	if db.deleted.has(index) {
+		if logger := db.logger(); logger != nil {
+			logger.Warn("duplicate free slot", "offset", index.Offset)
+		}
+		return // не добавляем дубль
+	}
+	if db.maxfree > 0 && db.deleted.len() >= db.maxfree {
+		// список заполнен: вместо расширения отбрасываем наименьшее место
+		var smallest, _ = db.deleted.min()
+		if freeLess(index, smallest) {
+			db.abandon(index)
+			return
+		}
+		db.unfree(smallest)
+		db.abandon(smallest)
+	}
+	db.deleted.insert(index)
+	db.starts[index.Offset] = index
+	db.ends[db.end(index)] = index.Offset
+}
+
+// SetMaxFreeSlots ограничивает количество свободных мест, которые хранятся в
+// памяти для повторного использования. По умолчанию (n равно 0) количество не
+// ограничено.
+//
+// При большом количестве удалений список свободных мест может занимать много
+// памяти. При достижении ограничения отбрасываются
+// наименьшие свободные места: они остаются в файле помеченными удаленными, но
+// больше не используются для записи, пока хранилище не будет открыто заново.
+// Так ограничение памяти и времени записи достигается ценой увеличения файла.
+// Количество и суммарный размер отброшенных мест возвращает db.Stats.
+//
+// Если свободных мест уже больше n, то лишние отбрасываются сразу.
+func (db *DB) SetMaxFreeSlots(n int) {
+	db.mu.Lock()
+	db.maxfree = n
+	db.trimFree()
+	db.mu.Unlock()
+}
+
+// trimFree отбрасывает наименьшие свободные места сверх ограничения,
+// заданного SetMaxFreeSlots.
+func (db *DB) trimFree() {
+	for db.maxfree > 0 && db.deleted.len() > db.maxfree {
+		var smallest, _ = db.deleted.min()
+		db.unfree(smallest)
+		db.abandon(smallest)
+	}
+}
+
+// abandon учитывает отброшенное свободное место, которое больше не
+// используется для записи и не объединяется с соседними.
+func (db *DB) abandon(index index) {
+	db.lost++
+	db.lostSize += uint64(index.Size())
+}
+
+// unfree удаляет место из списка свободных.
+func (db *DB) unfree(index index) {
+	if db.deleted.remove(index) {
+		delete(db.starts, index.Offset)
+		delete(db.ends, db.end(index))
+	}
+}
+
+// writeFree записывает в файл заголовок удаленной записи без ключа и данных,
+// которая занимает указанное свободное место.
+func (db *DB) writeFree(index index) error {
+	var buf = bufPool.Get().(*bytes.Buffer)
+	buf.Reset() // сбрасываем буфер от возможного предыдущего значения
+	defer bufPool.Put(buf)
+	_ = binary.Write(buf, binary.BigEndian, &storedIndex{
+		Time:      index.Time,
+		Flags:     recordDeleted,
+		EmptySize: index.EmptySize,
+	})
+	if db.flags&flagChecksum != 0 {
+		_ = binary.Write(buf, binary.BigEndian, checksum("", nil))
+	}
+	_, err := db.f.WriteAt(buf.Bytes(), int64(index.Offset))
+	return err
+}
+
+// allocate находит место для записи size байт ключа и данных и возвращает
+// его смещение и размер свободного места, которое останется за данными.
+// Выбирается наименьшее подходящее свободное место, а если такого нет или
+// выполняется пакетная загрузка, то запись добавляется в конец файла.
+func (db *DB) allocate(size uint32) (offset int64, empty uint32, err error) {
+	if index, ok := db.deleted.ceil(size); ok && !db.bulk {
+		// найдено подходящее свободное место: удаляем его из свободного доступа
+		db.unfree(index)
+		db.reuse() // место будет перезаписано
+		if logger := db.logger(); logger != nil {
+			logger.Debug("reuse slot", "offset", index.Offset,
+				"size", index.Size(), "need", size)
+		}
+		// вычисляем размер свободного места, которое останется после данных,
+		// и при возможности отделяем его в отдельное свободное место
+		empty, err = db.split(index, size)
+		return int64(index.Offset), empty, err
+	}
+	// не найдено подходящего места для записи - записываем в конец данных
+	offset = db.size
+	var end = offset + db.recordHeaderSize() + int64(size)
+	if end > math.MaxUint32 {
+		return 0, 0, ErrFileTooLarge
+	}
+	if db.maxfile > 0 && end > db.maxfile {
+		return 0, 0, ErrQuotaExceeded
+	}
+	db.size = end
+	db.remap(end) // отображение в память должно охватывать новую запись
+	return offset, 0, nil
+}
+
+// allocateNear выделяет место для перезаписи значения, которое сейчас
+// занимает запись old. Сначала проверяется свободное место, примыкающее к
+// old: как правило, это место, которое значение занимало до предыдущей
+// перезаписи. Так при многократной перезаписи одного ключа значение
+// переходит между двумя соседними местами, а не занимает все новые места в
+// файле. Если соседнее место не подходит, то место выбирается как обычно.
+func (db *DB) allocateNear(old index, size uint32) (offset int64, empty uint32, err error) {
+	if db.bulk {
+		return db.allocate(size)
+	}
+	var near []index
+	if next, ok := db.starts[db.end(old)]; ok {
+		near = append(near, next)
+	}
+	if offset, ok := db.ends[old.Offset]; ok {
+		near = append(near, db.starts[offset])
+	}
+	for _, slot := range near {
+		if slot.Size() < size {
+			continue
+		}
+		db.unfree(slot)
+		db.reuse() // место будет перезаписано
+		if logger := db.logger(); logger != nil {
+			logger.Debug("reuse near slot", "offset", slot.Offset,
+				"size", slot.Size(), "need", size)
+		}
+		empty, err = db.split(slot, size)
+		return int64(slot.Offset), empty, err
+	}
+	return db.allocate(size)
+}
+
+// release возвращает место, выделенное с помощью allocate для записи slot,
+// если саму запись сохранить не удалось. Если запись последняя в файле, то
+// данные укорачиваются, а иначе место снова помечается свободным. Ошибки при
+// этом игнорируются, так как запись и так уже завершилась ошибкой.
+func (db *DB) release(slot index) {
+	if int64(db.end(slot)) == db.size {
+		_ = db.shrink(int64(slot.Offset))
+		return
+	}
+	var free = index{
+		Offset:    slot.Offset,
+		EmptySize: slot.Size(),
+		Time:      uint32(time.Now().Unix()),
+	}
+	_ = db.writeFree(free)
+	_ = db.free(free)
+}
+
+// shrink укорачивает данные в файле до end. Если за концом данных нет
+// зарезервированного с помощью Preallocate места, то укорачивается сам файл.
+// Иначе размер файла не изменяется, а по смещению end записывается нулевой
+// заголовок записи, на котором остановится чтение записей при загрузке.
+func (db *DB) shrink(end int64) error {
+	size, err := db.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	var last = db.size
+	db.size = end
+	db.reuse() // данные за новым концом больше не действительны
+	if logger := db.logger(); logger != nil {
+		logger.Debug("shrink", "from", last, "to", end)
+	}
+	// новый конец данных сохраняется раньше, чем они будут укорочены
+	if err = db.commitEnd(); err != nil {
+		return err
+	}
+	if size <= last {
+		return db.f.Truncate(end)
+	}
+	_, err = db.f.WriteAt(make([]byte, storedIndexSize), end)
+	return err
+}
+
+// commitEnd сохраняет в заголовке файла текущий конец данных, если он
+// изменился и формат файла это поддерживает. Конец данных должен сохраняться
+// только после записи самих данных: при политике SyncAlways перед его
+// увеличением данные сбрасываются на диск, чтобы после сбоя он не указывал на
+// незаписанные данные.
+func (db *DB) commitEnd() error {
+	// при параллельной записи конец данных не должен охватывать записи,
+	// которые еще не записаны в файл
+	var end = db.size
+	for offset := range db.pending {
+		if int64(offset) < end {
+			end = int64(offset)
+		}
+	}
+	if db.endAt == 0 || end == db.stored {
+		return nil
+	}
+	if end > db.stored && db.policy == SyncAlways {
+		if err := db.f.Sync(); err != nil {
+			return err
+		}
+	}
+	if _, err := db.f.WriteAt(endSlot(end), db.endAt); err != nil {
+		return err
+	}
+	db.stored = end
+	return nil
+}
+
+// errSlotTooSmall возвращается, если место, выбранное для записи, меньше
+// размера записываемых данных. Это внутренняя ошибка: запись в такое место
+// привела бы к переполнению размера свободного места за данными и повредила
+// бы файл хранилища.
+var errSlotTooSmall = errors.New("internal error: slot too small")
+
+// restSize возвращает размер свободного места, которое останется в slot после
+// записи size байт ключа и данных.
+func restSize(slot index, size uint32) (uint32, error) {
+	if slot.Size() < size {
+		return 0, errSlotTooSmall
+	}
+	return slot.Size() - size, nil
+}
+
+// split вызывается при записи size байт ключа и данных в свободное место
+// slot и возвращает размер свободного места, которое останется за данными.
+//
+// При стратегии BestFitSplit остаток, в который помещается заголовок и хотя
+// бы один байт, отделяется: на его месте записывается заголовок удаленной
+// записи без ключа и данных, а сам он добавляется в список свободных мест.
+// Заголовок записывается до записи данных, поэтому сбой между ними не
+// нарушает структуру файла: прежняя запись его перекрывает.
+func (db *DB) split(slot index, size uint32) (uint32, error) {
+	rest, err := restSize(slot, size) // остаток свободного места
+	if err != nil {
+		return 0, err
+	}
+	var head = db.recordHeaderSize()
+	if db.alloc != BestFitSplit || int64(rest) <= head {
+		return rest, nil
+	}
+	var tail = index{
+		Offset:    slot.Offset + uint32(head) + size,
+		EmptySize: rest - uint32(head),
+		Time:      uint32(time.Now().Unix()),
+	}
+	if err := db.writeFree(tail); err != nil {
+		return 0, err
+	}
+	if err := db.free(tail); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
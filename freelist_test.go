@@ -0,0 +1,397 @@
+package keystore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestAllocStrategy(t *testing.T) {
+	os.RemoveAll(filename)
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetAllocStrategy(BestFitSplit)
+	if err := db.Put("big", make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("last", nil); err != nil {
+		t.Fatal(err)
+	}
+	var slot = db.indexes["big"]
+	if err := db.Delete("big"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("small", make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	var index = db.indexes["small"]
+	if index.Offset != slot.Offset || index.EmptySize != 0 {
+		t.Fatal("bad split slot:", index)
+	}
+	if db.deleted.len() != 1 {
+		t.Fatal("bad free slots count:", db.deleted.len())
+	}
+	var rest = db.deleted.slice()[0]
+	if rest.Offset+uint32(db.recordHeaderSize())+rest.Size() !=
+		slot.Offset+uint32(db.recordHeaderSize())+slot.Size() {
+		t.Fatal("bad split rest:", rest)
+	}
+	// остаток можно использовать для записи другого значения
+	if err := db.Put("other", make([]byte, 500)); err != nil {
+		t.Fatal(err)
+	}
+	if db.indexes["other"].Offset != rest.Offset {
+		t.Fatal("split rest is not reused")
+	}
+	// слишком маленький остаток не отделяется
+	if err := db.Delete("other"); err != nil {
+		t.Fatal(err)
+	}
+	var smallest, count = db.deleted.slice()[0], db.deleted.len()
+	if err := db.Put("other", make([]byte, smallest.Size()-5-5)); err != nil {
+		t.Fatal(err)
+	}
+	if index := db.indexes["other"]; index.Offset != smallest.Offset ||
+		index.EmptySize != 5 || db.deleted.len() != count-1 {
+		t.Fatal("bad small rest:", index, db.deleted.slice())
+	}
+	count = db.deleted.len()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// после открытия отделенное свободное место сохраняется
+	db, err = Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if db.Count() != 3 || db.deleted.len() != count {
+		t.Fatal("bad reopened store:", db.Count(), db.deleted.slice())
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllocateNear(t *testing.T) {
+	os.RemoveAll(filename)
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, put := range []struct {
+		key  string
+		size int
+	}{{"a", 100}, {"b", 100}, {"c", 10}, {"x", 60}, {"last", 0}} {
+		if err := db.Put(put.key, make([]byte, put.size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var first, near = db.indexes["a"], db.indexes["b"]
+	for _, key := range []string{"b", "x"} {
+		if err := db.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var size = db.Stats().Size
+	// соседнее место предпочитается более подходящему по размеру, а при
+	// следующей перезаписи значение возвращается на прежнее место
+	for i, want := range []uint32{near.Offset, first.Offset, near.Offset} {
+		if err := db.Put("a", make([]byte, 50)); err != nil {
+			t.Fatal(err)
+		}
+		if offset := db.indexes["a"].Offset; offset != want {
+			t.Fatalf("%d: bad near slot: %d, want %d", i, offset, want)
+		}
+	}
+	if db.Stats().Size != size {
+		t.Fatal("file grown:", db.Stats().Size, size)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCoalesceFree(t *testing.T) {
+	os.RemoveAll(filename)
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		if err := db.Put(key, make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var first = db.indexes["b"]
+	// удаляем в таком порядке, чтобы проверить объединение и со следующим,
+	// и с предыдущим свободным местом
+	for _, key := range []string{"b", "d", "c"} {
+		if err := db.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.deleted.len() != 1 {
+		t.Fatal("free slots not merged:", db.deleted.slice())
+	}
+	var slot = db.deleted.slice()[0]
+	if slot.Offset != first.Offset ||
+		slot.Size() != 3*first.Size()+2*uint32(db.recordHeaderSize()) {
+		t.Fatal("bad merged slot:", slot)
+	}
+	// объединенное место вмещает значение, которое не поместилось бы ни в
+	// одно из исходных
+	if err := db.Put("big", make([]byte, 250)); err != nil {
+		t.Fatal(err)
+	}
+	if db.indexes["big"].Offset != first.Offset {
+		t.Fatal("merged slot is not reused")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if db.Count() != 3 || db.deleted.len() != 0 {
+		t.Fatal("bad reopened store:", db.Count(), db.deleted.slice())
+	}
+	if db.indexes["big"].Offset != first.Offset {
+		t.Fatal("bad reopened value offset")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIndexInfo(t *testing.T) {
+	os.RemoveAll(filename)
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, ok := db.IndexInfo("key"); ok {
+		t.Fatal("info for missing key")
+	}
+	for _, key := range []string{"a", "key", "z"} {
+		if err := db.Put(key, make([]byte, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var slot = db.indexes["a"]
+	if err := db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	info, ok := db.IndexInfo("key")
+	if !ok {
+		t.Fatal("no info")
+	}
+	if info.KeySize != 3 || info.DataSize != 10 || info.EmptySize != 0 ||
+		info.Offset != db.indexes["key"].Offset || info.ModTime.IsZero() {
+		t.Fatal("bad info:", info)
+	}
+	if size, err := db.Size("key"); err != nil || size != 10 {
+		t.Fatal("bad size:", size, err)
+	}
+	if _, err := db.Size("a"); err != ErrNotFound {
+		t.Fatal("bad size error:", err)
+	}
+	if total := db.TotalSize(); total != 20 {
+		t.Fatal("bad total size:", total)
+	}
+	var slots = db.DeletedSlots()
+	if len(slots) != 1 || slots[0].Offset != slot.Offset || slots[0].Size != 11 {
+		t.Fatal("bad deleted slots:", slots)
+	}
+}
+
+func TestAllocBoundary(t *testing.T) {
+	const size = 11 // размер освобождаемого места: ключ и данные
+	for _, test := range []struct {
+		delta     int  // отличие размера новой записи от размера места
+		reuse     bool // новая запись должна занять освободившееся место
+		overwrite bool // перезапись значения того же ключа
+	}{
+		{-1, true, false}, {0, true, false}, {1, false, false},
+		// при перезаписи новое значение никогда не записывается на место
+		// прежнего, чтобы оно сохранилось при сбое
+		{-1, false, true}, {0, false, true}, {1, false, true},
+	} {
+		db, err := OpenMemory()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("a", make([]byte, size-1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("z", nil); err != nil {
+			t.Fatal(err)
+		}
+		var slot = db.indexes["a"]
+		var key = "a" // перезапись значения
+		if !test.overwrite {
+			if err := db.Delete("a"); err != nil {
+				t.Fatal(err)
+			}
+			key = "b" // запись в освободившееся место
+		}
+		if err := db.Put(key, make([]byte, size-1+test.delta)); err != nil {
+			t.Fatal(err)
+		}
+		var index = db.indexes[key]
+		if (index.Offset == slot.Offset) != test.reuse {
+			t.Errorf("%+v: bad offset %d", test, index.Offset)
+		}
+		if test.reuse && index.Size() != size {
+			t.Errorf("%+v: bad size %d, empty %d", test, index.Size(), index.EmptySize)
+		}
+		if !test.reuse && index.EmptySize != 0 {
+			t.Errorf("%+v: bad empty size %d", test, index.EmptySize)
+		}
+		if err := db.Verify(); err != nil {
+			t.Errorf("%+v: %v", test, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func FuzzAlloc(f *testing.F) {
+	f.Add([]byte{0, 10, 1, 10, 0, 9, 2, 0, 0, 11, 3, 200, 0, 255})
+	f.Add([]byte{0, 1, 0, 2, 0, 3, 1, 1, 1, 2, 0, 40, 0, 0, 0, 39})
+	f.Add(bytes.Repeat([]byte{0, 255, 1, 128, 0, 17, 3, 0}, 8))
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		var file = newMemFile("fuzz")
+		db, err := loadFile(context.Background(), file, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var values = make(map[string][]byte)
+		// каждая операция задается парой байт: типом и размером значения,
+		// который используется в том числе и для выбора ключа
+		for i := 0; i+1 < len(ops); i += 2 {
+			var (
+				size  = int(ops[i+1])
+				key   = fmt.Sprint("key", size%7)
+				value = bytes.Repeat([]byte{ops[i+1]}, size)
+			)
+			switch ops[i] % 4 {
+			case 0:
+				err = db.Put(key, value)
+				values[key] = value
+			case 1:
+				if err = db.Delete(key); err == ErrNotFound {
+					err = nil
+				}
+				delete(values, key)
+			case 2:
+				db.SetAllocStrategy(AllocStrategy(size % 2))
+			case 3:
+				err = db.Append(key, value)
+				values[key] = append(values[key], value...)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		// загружаем файл заново и проверяем размеры и значения записей
+		reloaded, err := loadFile(context.Background(), file, true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, err := file.Seek(0, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, index := range reloaded.indexes {
+			if int64(index.Offset)+reloaded.recordHeaderSize()+
+				int64(index.Size()) > size {
+				t.Fatalf("record out of file: %v", index)
+			}
+		}
+		for _, index := range reloaded.deleted.slice() {
+			if int64(index.Offset)+reloaded.recordHeaderSize()+
+				int64(index.Size()) > size {
+				t.Fatalf("free slot out of file: %v", index)
+			}
+		}
+		if len(reloaded.indexes) != len(values) {
+			t.Fatalf("bad count: %d vs %d", len(reloaded.indexes), len(values))
+		}
+		for key, value := range values {
+			data, err := reloaded.get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, value) {
+				t.Fatalf("bad value for %s", key)
+			}
+		}
+		if err := reloaded.Verify(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestMaxFreeSlots(t *testing.T) {
+	var file = newMemFile("maxfree")
+	db, err := loadFile(context.Background(), file, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxFreeSlots(4)
+	// удаляемые значения разделены другими, чтобы места не объединялись
+	for i := 0; i < 10; i++ {
+		var key = fmt.Sprintf("key%d", i)
+		if err := db.Put(key, bytes.Repeat([]byte{'v'}, 10*(i+1))); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("sep"+key, []byte("separator")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Delete(fmt.Sprintf("key%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var stats = db.Stats()
+	if stats.FreeSlots != 4 || stats.AbandonedSlots != 6 || stats.Keys != 10 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+	// сохраняются наибольшие места
+	for _, slot := range db.DeletedSlots() {
+		if slot.Size < 70 {
+			t.Errorf("small slot kept: %+v", slot)
+		}
+	}
+	db.SetMaxFreeSlots(2)
+	if stats = db.Stats(); stats.FreeSlots != 2 || stats.AbandonedSlots != 8 {
+		t.Fatalf("bad stats after trim: %+v", stats)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	// отброшенные места остаются в файле
+	if db, err = loadFile(context.Background(), file, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if stats = db.Stats(); stats.FreeSlots != 10 || stats.AbandonedSlots != 0 {
+		t.Fatalf("bad stats after reload: %+v", stats)
+	}
+}
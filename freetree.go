@@ -0,0 +1,181 @@
+package keystore
+
+// freeTree хранит свободные места в файле, упорядоченные по размеру и
+// смещению, в виде декартова дерева (treap). Добавление, удаление и поиск
+// наименьшего подходящего по размеру места выполняются в среднем за
+// логарифмическое от количества мест время.
+type freeTree struct {
+	root *freeNode // корень дерева
+	n    int       // количество мест
+	size uint64    // суммарный размер мест
+	seed uint32    // состояние генератора приоритетов
+}
+
+// freeNode описывает узел дерева свободных мест.
+type freeNode struct {
+	index       index     // свободное место
+	priority    uint32    // приоритет узла в куче
+	left, right *freeNode // меньшие и большие места
+}
+
+// freeLess возвращает true, если место a должно идти в списке раньше b:
+// места упорядочены по размеру, а места одного размера — по смещению.
+func freeLess(a, b index) bool {
+	var s1, s2 = a.Size(), b.Size()
+	return s1 < s2 || (s1 == s2 && a.Offset < b.Offset)
+}
+
+// len возвращает количество свободных мест.
+func (t *freeTree) len() int {
+	return t.n
+}
+
+// insert добавляет место в дерево. Если такое место уже есть, то возвращает
+// false.
+func (t *freeTree) insert(index index) bool {
+	if t.has(index) {
+		return false
+	}
+	// xorshift: равномерное распределение приоритетов сохраняет дерево
+	// сбалансированным в среднем независимо от порядка добавления
+	if t.seed == 0 {
+		t.seed = 2463534242
+	}
+	t.seed ^= t.seed << 13
+	t.seed ^= t.seed >> 17
+	t.seed ^= t.seed << 5
+	t.root = insertNode(t.root, &freeNode{index: index, priority: t.seed})
+	t.n++
+	t.size += uint64(index.Size())
+	return true
+}
+
+// insertNode добавляет узел в поддерево и возвращает его новый корень.
+func insertNode(root, node *freeNode) *freeNode {
+	if root == nil {
+		return node
+	}
+	if node.priority > root.priority {
+		node.left, node.right = splitNodes(root, node.index)
+		return node
+	}
+	if freeLess(node.index, root.index) {
+		root.left = insertNode(root.left, node)
+	} else {
+		root.right = insertNode(root.right, node)
+	}
+	return root
+}
+
+// splitNodes разделяет поддерево на места, идущие раньше index, и все
+// остальные.
+func splitNodes(root *freeNode, index index) (left, right *freeNode) {
+	if root == nil {
+		return nil, nil
+	}
+	if freeLess(root.index, index) {
+		root.right, right = splitNodes(root.right, index)
+		return root, right
+	}
+	left, root.left = splitNodes(root.left, index)
+	return left, root
+}
+
+// mergeNodes объединяет два поддерева, все места первого из которых идут
+// раньше мест второго.
+func mergeNodes(left, right *freeNode) *freeNode {
+	switch {
+	case left == nil:
+		return right
+	case right == nil:
+		return left
+	case left.priority > right.priority:
+		left.right = mergeNodes(left.right, right)
+		return left
+	default:
+		right.left = mergeNodes(left, right.left)
+		return right
+	}
+}
+
+// remove удаляет место из дерева. Если такого места нет, то возвращает false.
+func (t *freeTree) remove(index index) bool {
+	var link = &t.root
+	for node := *link; node != nil; node = *link {
+		switch {
+		case node.index.Offset == index.Offset && node.index.Size() == index.Size():
+			*link = mergeNodes(node.left, node.right)
+			t.n--
+			t.size -= uint64(node.index.Size())
+			return true
+		case freeLess(index, node.index):
+			link = &node.left
+		default:
+			link = &node.right
+		}
+	}
+	return false
+}
+
+// has возвращает true, если место есть в дереве.
+func (t *freeTree) has(index index) bool {
+	for node := t.root; node != nil; {
+		switch {
+		case node.index.Offset == index.Offset && node.index.Size() == index.Size():
+			return true
+		case freeLess(index, node.index):
+			node = node.left
+		default:
+			node = node.right
+		}
+	}
+	return false
+}
+
+// ceil возвращает наименьшее место размером не меньше size, а среди мест
+// одного размера — место с наименьшим смещением.
+func (t *freeTree) ceil(size uint32) (index, bool) {
+	var found *freeNode
+	for node := t.root; node != nil; {
+		if node.index.Size() >= size {
+			found, node = node, node.left
+		} else {
+			node = node.right
+		}
+	}
+	if found == nil {
+		return index{}, false
+	}
+	return found.index, true
+}
+
+// min возвращает наименьшее место.
+func (t *freeTree) min() (index, bool) {
+	var node = t.root
+	if node == nil {
+		return index{}, false
+	}
+	for node.left != nil {
+		node = node.left
+	}
+	return node.index, true
+}
+
+// each вызывает fn для всех мест в порядке возрастания размера.
+func (t *freeTree) each(fn func(index index)) {
+	var stack []*freeNode
+	for node := t.root; node != nil || len(stack) > 0; node = node.right {
+		for ; node != nil; node = node.left {
+			stack = append(stack, node)
+		}
+		node, stack = stack[len(stack)-1], stack[:len(stack)-1]
+		fn(node.index)
+	}
+}
+
+// slice возвращает список всех мест в порядке возрастания размера.
+func (t *freeTree) slice() []index {
+	var list = make([]index, 0, t.n)
+	t.each(func(index index) { list = append(list, index) })
+	return list
+}
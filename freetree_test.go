@@ -0,0 +1,147 @@
+package keystore
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// freeSlice — прежняя реализация списка свободных мест в виде
+// отсортированного среза, с которой сравнивается freeTree.
+type freeSlice []index
+
+func (s *freeSlice) insert(index index) {
+	var found = sort.Search(len(*s), func(i int) bool {
+		return !freeLess((*s)[i], index)
+	})
+	*s = append(*s, index)
+	copy((*s)[found+1:], (*s)[found:])
+	(*s)[found] = index
+}
+
+func (s *freeSlice) remove(index index) bool {
+	var found = sort.Search(len(*s), func(i int) bool {
+		return !freeLess((*s)[i], index)
+	})
+	if found == len(*s) || (*s)[found] != index {
+		return false
+	}
+	*s = append((*s)[:found], (*s)[found+1:]...)
+	return true
+}
+
+func (s freeSlice) ceil(size uint32) (index, bool) {
+	var found = sort.Search(len(s), func(i int) bool {
+		return s[i].Size() >= size
+	})
+	if found == len(s) {
+		return index{}, false
+	}
+	return s[found], true
+}
+
+func TestFreeTree(t *testing.T) {
+	var (
+		tree   freeTree
+		list   freeSlice
+		random = rand.New(rand.NewSource(1))
+	)
+	// newSlot возвращает место со случайным размером и уникальным смещением
+	var offset uint32
+	var newSlot = func() index {
+		offset++
+		return index{Offset: offset, EmptySize: uint32(random.Intn(64))}
+	}
+	for i := 0; i < 20000; i++ {
+		switch random.Intn(3) {
+		case 0, 1:
+			var slot = newSlot()
+			list.insert(slot)
+			if !tree.insert(slot) {
+				t.Fatal("slot not inserted:", slot)
+			}
+			if tree.insert(slot) {
+				t.Fatal("duplicate slot inserted:", slot)
+			}
+		default:
+			var size = uint32(random.Intn(80))
+			want, ok1 := list.ceil(size)
+			got, ok2 := tree.ceil(size)
+			if got != want || ok1 != ok2 {
+				t.Fatalf("bad ceil %d: %v vs %v", size, got, want)
+			}
+			if ok1 && (!list.remove(want) || !tree.remove(got)) {
+				t.Fatal("slot not removed:", got)
+			}
+			if tree.remove(got) || tree.has(got) {
+				t.Fatal("removed slot found:", got)
+			}
+		}
+		if tree.len() != len(list) {
+			t.Fatalf("bad length: %d vs %d", tree.len(), len(list))
+		}
+	}
+	if smallest, ok := tree.min(); !ok || smallest != list[0] {
+		t.Fatal("bad min:", smallest, list[0])
+	}
+	var slots = tree.slice()
+	var size uint64
+	for i := range slots {
+		if slots[i] != list[i] {
+			t.Fatalf("bad order at %d: %v vs %v", i, slots[i], list[i])
+		}
+		size += uint64(slots[i].Size())
+	}
+	if tree.size != size {
+		t.Fatalf("bad size: %d vs %d", tree.size, size)
+	}
+	if _, ok := new(freeTree).ceil(0); ok {
+		t.Error("empty tree has slot")
+	}
+}
+
+// BenchmarkFreeList сравнивает отсортированный срез и дерево свободных мест
+// при чередовании записи (поиск подходящего места и его удаление из списка)
+// и удаления (добавление нового свободного места) при разном количестве
+// свободных мест.
+func BenchmarkFreeList(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		var slots = make([]index, n)
+		for i := range slots {
+			slots[i] = index{Offset: uint32(i), EmptySize: uint32(rand.Intn(4096))}
+		}
+		b.Run(fmt.Sprintf("slice/%d", n), func(b *testing.B) {
+			var list = make(freeSlice, 0, n+1)
+			for _, slot := range slots {
+				list.insert(slot)
+			}
+			var offset = uint32(n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var size = uint32(rand.Intn(4096))
+				if slot, ok := list.ceil(size); ok {
+					list.remove(slot)
+				}
+				offset++
+				list.insert(index{Offset: offset, EmptySize: size})
+			}
+		})
+		b.Run(fmt.Sprintf("tree/%d", n), func(b *testing.B) {
+			var tree freeTree
+			for _, slot := range slots {
+				tree.insert(slot)
+			}
+			var offset = uint32(n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var size = uint32(rand.Intn(4096))
+				if slot, ok := tree.ceil(size); ok {
+					tree.remove(slot)
+				}
+				offset++
+				tree.insert(index{Offset: offset, EmptySize: size})
+			}
+		})
+	}
+}
@@ -1,10 +1,15 @@
 package keystore
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 )
 
 var (
@@ -14,7 +19,9 @@ var (
 
 // Open возвращает открытую базу с хранилищем в указанном файле. Если база уже
 // была открыта, то повторного открытия не происходит, а возвращается ссылка на
-// ранее открытую.
+// ранее открытую. Для этого имя файла приводится к абсолютному пути с
+// раскрытыми символическими ссылками, поэтому разные пути к одному файлу
+// возвращают одну и ту же базу.
 //
 // При первом открытии файла происходит построение индекса ключей и проверка
 // целостности данных, в процессе чего файл читается от начала и до конца.
@@ -22,39 +29,132 @@ var (
 // не рекомендуется использовать эту библиотеку для хранения большого
 // количества данных.
 //
+// Если файл уже открыт другим процессом, то возвращается ошибка ErrLocked.
+// Если файл обрезан или поврежден так, что записи в нем невозможно прочитать
+// или они выходят за его пределы, то возвращается ошибка ErrCorruptIndex с
+// указанием смещения записи. Восстановить такой файл можно с помощью Recover.
+//
 // По умолчанию хранилище открывается в синхронном режиме: т.е. любая запись
 // в хранилище приводит к принудительному сбросу данных в файл, что сильно
 // замедляет работу. Если вы хотите самостоятельно управлять процессом сброса
 // кеша или довериться операционной системе, то используйте вызов метода
-// db.SetSync(false).
+// db.SetSync(false) или задайте политику сброса при открытии с помощью
+// OpenWithOptions: вызов Open(filename) равнозначен OpenWithOptions(filename,
+// nil).
 func Open(filename string) (db *DB, err error) {
+	return OpenContext(context.Background(), filename)
+}
+
+// OpenContext открывает хранилище аналогично Open, но позволяет прервать
+// построение индекса при открытии файла с помощью контекста. В случае отмены
+// контекста файл закрывается и возвращается ошибка контекста.
+func OpenContext(ctx context.Context, filename string) (db *DB, err error) {
+	return openShared(ctx, filename, new(Options))
+}
+
+// OpenEncrypted открывает хранилище с шифрованием значений. Ключ шифрования
+// должен быть длиной 16, 24 или 32 байта для использования AES-128, AES-192
+// или AES-256 соответственно.
+//
+// Каждое значение шифруется перед записью в файл с помощью AES-GCM со своим
+// случайным nonce, который сохраняется вместе с данными. Ключи записей
+// сохраняются в открытом виде. Признак шифрования сохраняется в заголовке
+// файла вместе с блоком для проверки ключа, поэтому попытка открыть
+// зашифрованное хранилище с неверным ключом сразу возвращает ошибку ErrBadKey,
+// а без ключа — ErrEncrypted. Зашифровать уже существующее хранилище без
+// шифрования таким образом нельзя.
+//
+// Размер значений в файле при шифровании увеличивается на размер nonce и
+// кода аутентификации.
+func OpenEncrypted(filename string, secret []byte) (*DB, error) {
+	return openShared(context.Background(), filename,
+		&Options{EncryptionKey: secret})
+}
+
+// openShared возвращает открытое хранилище из глобального списка или
+// открывает его и добавляет в этот список.
+func openShared(ctx context.Context, filename string, opts *Options) (db *DB, err error) {
+	aead, err := opts.cipher() // шифрование значений
+	if err != nil {
+		return nil, err
+	}
+	var name = canonical(filename)
 	mu.Lock()
 	defer mu.Unlock()
-	db, ok := dbs[filename]
-	if !ok {
-		// создаем каталог, если он еще не создан
-		if dir := filepath.Dir(filename); dir != "." {
-			err = os.MkdirAll(dir, 0777)
-			if err != nil {
-				return nil, err
-			}
+	db, ok := dbs[name]
+	if ok {
+		// проверяем, что ключ шифрования подходит к открытому хранилищу
+		var head = &header{Flags: db.flags, Check: db.check}
+		if err = verifyCheck(aead, head); err != nil {
+			return nil, &os.PathError{Op: "check", Path: filename, Err: err}
 		}
-		db, err = open(filename)
+		return db, nil
+	}
+	// создаем каталог, если он еще не создан
+	if dir := filepath.Dir(filename); dir != "." {
+		err = os.MkdirAll(dir, opts.dirMode())
 		if err != nil {
 			return nil, err
 		}
-		dbs[filename] = db
 	}
+	db, err = open(ctx, osFileOpener(opts.fileMode()), filename, false, aead)
+	if err != nil {
+		return nil, err
+	}
+	if err = opts.apply(db); err != nil {
+		_ = db.close() // еще не добавлено в список открытых
+		return nil, err
+	}
+	db.name = name
+	dbs[name] = db
 	return db, nil
 }
 
+// canonical возвращает имя файла, под которым хранилище сохраняется в списке
+// открытых. Это абсолютный путь к файлу без символических ссылок, поэтому
+// разные пути к одному и тому же файлу дают одно и то же имя. Если файла еще
+// нет, то символические ссылки раскрываются только для его каталога.
+func canonical(filename string) string {
+	name, err := filepath.Abs(filename)
+	if err != nil {
+		return filepath.Clean(filename)
+	}
+	if path, err := filepath.EvalSymlinks(name); err == nil {
+		return path
+	}
+	if dir, err := filepath.EvalSymlinks(filepath.Dir(name)); err == nil {
+		return filepath.Join(dir, filepath.Base(name))
+	}
+	return name
+}
+
+// OpenReadOnly открывает хранилище в указанном файле только для чтения. Файл
+// при этом должен уже существовать. Все методы, изменяющие хранилище,
+// возвращают ошибку ErrReadOnly, а db.Sync ничего не делает.
+//
+// В отличие от Open, хранилище, открытое таким образом, не кешируется в
+// глобальном списке открытых хранилищ и каждый вызов возвращает новое
+// хранилище. Закрывать такое хранилище необходимо самостоятельно: CloseAll
+// его не затрагивает.
+//
+// Файл хранилища, открытого на запись, блокируется, поэтому одновременно с
+// ним открыть тот же файл не сможет никто другой, в том числе и в том же
+// процессе: в этом случае возвращается ошибка ErrLocked. Хранилище, открытое
+// только для чтения, устанавливает разделяемую блокировку, которая позволяет
+// открыть файл для чтения сколько угодно раз, но не позволяет открыть его на
+// запись.
+func OpenReadOnly(filename string) (*DB, error) {
+	return open(context.Background(), openOSFile, filename, true, nil)
+}
+
 // Close закрывает хранилище с указанным именем. Не возвращает ошибку, если
 // хранилище не было открыто.
 func Close(filename string) error {
+	var name = canonical(filename)
 	mu.Lock()
 	defer mu.Unlock()
-	if db, ok := dbs[filename]; ok {
-		delete(dbs, filename)
+	if db, ok := dbs[name]; ok {
+		delete(dbs, name)
 		return db.close()
 	}
 	return nil
@@ -73,18 +173,50 @@ func OpenAll(filenames ...string) error {
 }
 
 // CloseAll закрывает все открытые хранилища. Ошибка закрытия хранилищ не
-// обрабатывается.
+// обрабатывается: если она важна, то используйте CloseAllErr.
 func CloseAll() {
+	_ = CloseAllErr()
+}
+
+// CloseAllErr закрывает все открытые хранилища и возвращает объединенную с
+// помощью errors.Join ошибку с описанием всех хранилищ, которые не удалось
+// корректно закрыть, например, из-за ошибки сброса данных в файл. Хранилища
+// удаляются из списка открытых в любом случае.
+func CloseAllErr() error {
 	mu.Lock()
-	for name, db := range dbs {
+	defer mu.Unlock()
+	var names = make([]string, 0, len(dbs))
+	for name := range dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names) // закрываем всегда в одном и том же порядке
+	var errs []error
+	for _, name := range names {
+		var db = dbs[name]
 		delete(dbs, name)
-		db.close()
+		if err := db.close(); err != nil {
+			errs = append(errs, &os.PathError{Op: "close", Path: name, Err: err})
+		}
 	}
-	mu.Unlock()
+	return errors.Join(errs...)
+}
+
+// OpenCount возвращает количество хранилищ в списке открытых. Хранилища,
+// открытые только для чтения или в памяти, в этот список не входят.
+func OpenCount() int {
+	mu.Lock()
+	defer mu.Unlock()
+	return len(dbs)
 }
 
 // Remove удаляет файл с хранилищем с заданным именем, предварительно его
-// закрывая, если оно было открыто.
+// закрывая, если оно было открыто. Если при закрытии хранилища произошла
+// ошибка, то файл не удаляется, а хранилище все равно удаляется из списка
+// открытых.
+//
+// Remove не проверяет, используется ли файл кем-то еще: хранилищем, ранее
+// полученным из списка открытых, хранилищем, открытым только для чтения, или
+// другим процессом. Для такой проверки используйте RemoveIfClosed.
 func Remove(filename string) error {
 	if err := Close(filename); err != nil {
 		return err
@@ -92,6 +224,45 @@ func Remove(filename string) error {
 	return os.Remove(filename)
 }
 
+// ErrInUse возвращается RemoveIfClosed, если файл хранилища используется.
+var ErrInUse = errors.New("store is in use")
+
+// RemoveIfClosed удаляет файл с хранилищем, только если оно не открыто. Если
+// хранилище есть в списке открытых или файл заблокирован другим хранилищем,
+// в том числе открытым в другом процессе, то возвращается ошибка ErrInUse, а
+// файл не удаляется.
+//
+// Проверка и удаление выполняются с блокировкой списка открытых хранилищ,
+// поэтому одновременный вызов Open в этом же процессе дождется удаления
+// файла. Блокировка файла от других процессов рекомендательная и снимается
+// непосредственно перед удалением, поэтому другой процесс все еще может
+// успеть открыть файл между проверкой и удалением.
+func RemoveIfClosed(filename string) error {
+	var name = canonical(filename)
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := dbs[name]; ok {
+		return &os.PathError{Op: "remove", Path: filename, Err: ErrInUse}
+	}
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = lockFile(file, true)
+	if err == nil {
+		err = unlockFile(file)
+	} else if err == errWouldBlock {
+		err = ErrInUse
+	}
+	if err2 := file.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: filename, Err: err}
+	}
+	return os.Remove(filename)
+}
+
 // Count возвращает количество записей в хранилище.
 func Count(filename string) (uint32, error) {
 	db, err := Open(filename)
@@ -101,6 +272,24 @@ func Count(filename string) (uint32, error) {
 	return db.Count(), nil
 }
 
+// CountPrefix возвращает количество ключей в хранилище с указанным префиксом.
+func CountPrefix(filename, prefix string) (uint32, error) {
+	db, err := Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	return db.CountPrefix(prefix), nil
+}
+
+// Size возвращает размер значения с указанным ключом без его чтения.
+func Size(filename, key string) (uint32, error) {
+	db, err := Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	return db.Size(key)
+}
+
 // NextSequence возвращает значение счетчика, которое увеличивается при каждом
 // обращении к данной функции хранилища.
 func NextSequence(filename string) (uint64, error) {
@@ -111,6 +300,45 @@ func NextSequence(filename string) (uint64, error) {
 	return db.NextSequence()
 }
 
+// Sequence возвращает текущее значение счетчика хранилища, не изменяя его.
+func Sequence(filename string) (uint64, error) {
+	db, err := Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	return db.Sequence(), nil
+}
+
+// SetSequence увеличивает значение счетчика хранилища до v. Уменьшить
+// значение счетчика нельзя.
+func SetSequence(filename string, v uint64) error {
+	db, err := Open(filename)
+	if err != nil {
+		return err
+	}
+	return db.SetSequence(v)
+}
+
+// ReserveSequence резервирует n последовательных значений счетчика хранилища
+// и возвращает первое из них.
+func ReserveSequence(filename string, n uint64) (uint64, error) {
+	db, err := Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	return db.ReserveSequence(n)
+}
+
+// NextUID возвращает уникальный идентификатор, основанный на текущем времени
+// и счетчике хранилища.
+func NextUID(filename string) (UID, error) {
+	db, err := Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	return db.NextUID()
+}
+
 // Get возвращает данные, сохраненные с указанным ключом. Если данных с таким
 // ключем в хранилище нет, то возвращается ошибка ErrNotFound.
 func Get(filename, key string) ([]byte, error) {
@@ -131,6 +359,36 @@ func GetJSON(filename, key string, v interface{}) error {
 	return db.GetJSON(key, v)
 }
 
+// GetGob преобразует значение из хранилища в объект. Значение в хранилище
+// должно быть представлено в формате encoding/gob, иначе вернется ошибка.
+func GetGob(filename, key string, v interface{}) error {
+	db, err := Open(filename)
+	if err != nil {
+		return err
+	}
+	return db.GetGob(key, v)
+}
+
+// GetRawJSON возвращает значение из хранилища в формате json.RawMessage,
+// проверяя, что оно представлено в формате JSON.
+func GetRawJSON(filename, key string) (json.RawMessage, error) {
+	db, err := Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetRawJSON(key)
+}
+
+// GetCodec преобразует значение из хранилища в объект с помощью указанного
+// формата сериализации.
+func GetCodec(filename, key string, v interface{}, codec Codec) error {
+	db, err := Open(filename)
+	if err != nil {
+		return err
+	}
+	return db.GetCodec(key, v, codec)
+}
+
 // Gets возвращает список значений, соответствующих списку ключей. Игнорирует
 // ошибки с ненайденными ключами: в этом случае в качестве значения для данного
 // ключа будет возвращен nil.
@@ -142,6 +400,36 @@ func Gets(filename string, keys ...string) (result [][]byte, err error) {
 	return db.Gets(keys...)
 }
 
+// GetsWithFound возвращает список значений для указанных ключей и признаки
+// того, что они найдены.
+func GetsWithFound(filename string, keys ...string) (values [][]byte, found []bool, err error) {
+	db, err := Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	return db.GetsWithFound(keys...)
+}
+
+// GetMap возвращает словарь со значениями для найденных ключей.
+func GetMap(filename string, keys ...string) (map[string][]byte, error) {
+	db, err := Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetMap(keys...)
+}
+
+// GetsRawUnchecked возвращает массив значений для указанных ключей в формате
+// json.RawMessage без проверки формата значений. Подробнее смотри описание
+// метода db.GetsRawUnchecked.
+func GetsRawUnchecked(filename string, keys ...string) ([]json.RawMessage, error) {
+	db, err := Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetsRawUnchecked(keys...)
+}
+
 // GetsJSON возвращает массив значений для указанных ключей в формате
 // json.RawMessage. Возвращает ошибку, если данные не соответствуют формату
 // JSON. Для ненайденных ключей возвращается значение nil.
@@ -153,6 +441,15 @@ func GetsJSON(filename string, keys ...string) (result []json.RawMessage, err er
 	return db.GetsJSON(keys...)
 }
 
+// ModTime возвращает время последнего сохранения значения с указанным ключом.
+func ModTime(filename, key string) (time.Time, error) {
+	db, err := Open(filename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return db.ModTime(key)
+}
+
 // Has возвращает true, если значение с таким ключом задано в хранилище.
 func Has(filename, key string) (bool, error) {
 	db, err := Open(filename)
@@ -173,6 +470,68 @@ func Keys(filename, prefix, last string, offset, limit uint32, asc bool) ([]stri
 	return db.Keys(prefix, last, offset, limit, asc), nil
 }
 
+// KeysFunc возвращает список ключей с префиксом prefix, отсортированный с
+// помощью функции сравнения less.
+//
+// Подробную информацию по параметрам смотри в описании метода db.KeysFunc.
+func KeysFunc(filename, prefix string, less func(a, b string) bool,
+	offset, limit uint32) ([]string, error) {
+	db, err := Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return db.KeysFunc(prefix, less, offset, limit), nil
+}
+
+// Page возвращает страницу ключей, идущих после cursor, и курсор для
+// получения следующей страницы.
+//
+// Подробную информацию по параметрам смотри в описании метода db.Page.
+func Page(filename, prefix, cursor string, limit uint32, asc bool) (keys []string, next string, err error) {
+	db, err := Open(filename)
+	if err != nil {
+		return nil, "", err
+	}
+	keys, next = db.Page(prefix, cursor, limit, asc)
+	return keys, next, nil
+}
+
+// Items возвращает список ключей, подходящих под запрос, вместе с их
+// значениями.
+//
+// Подробную информацию по параметрам смотри в описании метода db.Items.
+func Items(filename, prefix, last string, offset, limit uint32, asc bool) ([]Item, error) {
+	db, err := Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return db.Items(prefix, last, offset, limit, asc)
+}
+
+// ForEach последовательно вызывает fn для всех ключей с префиксом prefix и
+// их значений.
+//
+// Подробную информацию по параметрам смотри в описании метода db.ForEach.
+func ForEach(filename, prefix string, fn func(key string, value []byte) error) error {
+	db, err := Open(filename)
+	if err != nil {
+		return err
+	}
+	return db.ForEach(prefix, fn)
+}
+
+// Range возвращает список ключей в диапазоне от start (включительно) до end
+// (не включая его).
+//
+// Подробную информацию по параметрам смотри в описании метода db.Range.
+func Range(filename, start, end string, asc bool) ([]string, error) {
+	db, err := Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return db.Range(start, end, asc), nil
+}
+
 // Delete удаляет значение с указанным ключом из хранилища.
 func Delete(filename, key string) error {
 	db, err := Open(filename)
@@ -193,6 +552,65 @@ func Deletes(filename string, keys ...string) error {
 	return db.Deletes(keys...)
 }
 
+// DeletePrefix удаляет из хранилища все ключи с указанным префиксом и
+// возвращает их количество.
+func DeletePrefix(filename, prefix string) (int, error) {
+	db, err := Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	return db.DeletePrefix(prefix)
+}
+
+// Truncate удаляет все значения из хранилища, не удаляя сам файл.
+func Truncate(filename string) error {
+	db, err := Open(filename)
+	if err != nil {
+		return err
+	}
+	return db.Truncate()
+}
+
+// DeleteRange удаляет из хранилища все ключи в указанном диапазоне и
+// возвращает их количество.
+func DeleteRange(filename, start, end string) (int, error) {
+	db, err := Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	return db.DeleteRange(start, end)
+}
+
+// Undelete восстанавливает удаленное значение с указанным ключом, если его
+// место в файле еще не занято другими данными (см. db.Undelete).
+func Undelete(filename, key string) error {
+	db, err := Open(filename)
+	if err != nil {
+		return err
+	}
+	return db.Undelete(key)
+}
+
+// Purge окончательно удаляет из корзины значения с указанными ключами или,
+// если ключи не заданы, все значения в корзине (см. db.Purge).
+func Purge(filename string, keys ...string) (int, error) {
+	db, err := Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	return db.Purge(keys...)
+}
+
+// Compact сжимает файл хранилища, удаляя из него удаленные записи и
+// свободное место (см. db.Compact).
+func Compact(filename string) error {
+	db, err := Open(filename)
+	if err != nil {
+		return err
+	}
+	return db.Compact()
+}
+
 // Put сохраняет данные в хранилище с указанным ключом. Если данные с таким
 // ключом уже были сохранены в хранилище, то они удаляются и перезаписываются
 // на новые. Значение автоматически преобразуется в формат []byte, используя
@@ -209,6 +627,24 @@ func Put(filename, key string, value interface{}) error {
 	return db.Put(key, bvalue)
 }
 
+// Append добавляет данные в конец значения с указанным ключом.
+func Append(filename, key string, suffix []byte) error {
+	db, err := Open(filename)
+	if err != nil {
+		return err
+	}
+	return db.Append(key, suffix)
+}
+
+// PutReader сохраняет в хранилище значение размером size байт, читая его из r.
+func PutReader(filename, key string, r io.Reader, size uint32) error {
+	db, err := Open(filename)
+	if err != nil {
+		return err
+	}
+	return db.PutReader(key, r, size)
+}
+
 // PutJSON сохраняет данные в хранилище с указанным ключом в формате JSON.
 // Возвращает ошибку, если не удалось преобразовать объект в формат JSON.
 func PutJSON(filename, key string, value interface{}) error {
@@ -219,6 +655,26 @@ func PutJSON(filename, key string, value interface{}) error {
 	return db.PutJSON(key, value)
 }
 
+// PutGob сохраняет данные в хранилище с указанным ключом в формате
+// encoding/gob. Такие значения могут быть прочитаны только программами на Go.
+func PutGob(filename, key string, value interface{}) error {
+	db, err := Open(filename)
+	if err != nil {
+		return err
+	}
+	return db.PutGob(key, value)
+}
+
+// PutCodec сохраняет данные в хранилище с указанным ключом, используя заданный
+// формат сериализации.
+func PutCodec(filename, key string, value interface{}, codec Codec) error {
+	db, err := Open(filename)
+	if err != nil {
+		return err
+	}
+	return db.PutCodec(key, value, codec)
+}
+
 // Puts позволяет записать сразу несколько значений в хранилище. Для передачи
 // списка данных используется словарь с именем ключа и связанным с ним
 // значением. Для приведения значений к формату []byte используется функция
@@ -249,3 +705,54 @@ func PutsJSON(filename string, values map[string]interface{}) error {
 	}
 	return db.PutsJSON(values)
 }
+
+// PutsGob сохраняет в хранилище объекты в формате encoding/gob. Если хотя бы
+// один объект не удалось преобразовать, то ни одно из значений не
+// сохраняется.
+func PutsGob(filename string, values map[string]interface{}) error {
+	db, err := Open(filename)
+	if err != nil {
+		return err
+	}
+	return db.PutsGob(values)
+}
+
+// CompareAndSwap заменяет значение ключа на new, только если текущее значение
+// совпадает с old. Подробнее смотри описание метода db.CompareAndSwap.
+func CompareAndSwap(filename, key string, old, new []byte) (bool, error) {
+	db, err := Open(filename)
+	if err != nil {
+		return false, err
+	}
+	return db.CompareAndSwap(key, old, new)
+}
+
+// PutIfAbsent сохраняет значение, только если такого ключа в хранилище еще
+// нет. Подробнее смотри описание метода db.PutIfAbsent.
+func PutIfAbsent(filename, key string, value []byte) (bool, error) {
+	db, err := Open(filename)
+	if err != nil {
+		return false, err
+	}
+	return db.PutIfAbsent(key, value)
+}
+
+// DeleteIf удаляет ключ, только если его текущее значение совпадает с
+// expected. Подробнее смотри описание метода db.DeleteIf.
+func DeleteIf(filename, key string, expected []byte) (bool, error) {
+	db, err := Open(filename)
+	if err != nil {
+		return false, err
+	}
+	return db.DeleteIf(key, expected)
+}
+
+// Increment увеличивает числовое значение ключа на delta и возвращает
+// получившийся результат. Подробнее смотри описание метода db.Increment.
+func Increment(filename, key string, delta int64) (int64, error) {
+	db, err := Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	return db.Increment(key, delta)
+}
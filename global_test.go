@@ -1,7 +1,11 @@
 package keystore
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -56,3 +60,260 @@ func TestGlobal(t *testing.T) {
 	}
 
 }
+
+func TestIncrement(t *testing.T) {
+	var filename = "db/increment.db"
+	defer Remove(filename)
+	for i := int64(1); i <= 5; i++ {
+		value, err := Increment(filename, "counter", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != i*2 {
+			t.Fatalf("bad counter value: %d", value)
+		}
+	}
+	value, err := Increment(filename, "counter", -10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 0 {
+		t.Fatalf("bad decremented value: %d", value)
+	}
+	if err := Put(filename, "text", "text"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Increment(filename, "text", 1); err == nil {
+		t.Fatal("increment of non-number value")
+	}
+}
+
+// textCodec сохраняет строки в обратном порядке символов.
+type textCodec struct{}
+
+func (textCodec) Marshal(v interface{}) ([]byte, error) {
+	var s = []byte(v.(string))
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = s[j], s[i]
+	}
+	return s, nil
+}
+
+func (c textCodec) Unmarshal(data []byte, v interface{}) error {
+	s, _ := c.Marshal(string(data))
+	*(v.(*string)) = string(s)
+	return nil
+}
+
+func TestCodec(t *testing.T) {
+	var filename = "db/codec.db"
+	defer Remove(filename)
+	if err := PutCodec(filename, "key", "value", textCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := Get(filename, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "eulav" {
+		t.Fatalf("bad encoded value: %q", data)
+	}
+	var s string
+	if err := GetCodec(filename, "key", &s, textCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	if s != "value" {
+		t.Fatalf("bad decoded value: %q", s)
+	}
+	// формат по умолчанию
+	if err := PutCodec(filename, "json", "value", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := GetJSON(filename, "json", &s); err != nil || s != "value" {
+		t.Fatalf("bad default codec: %q, %v", s, err)
+	}
+}
+
+func TestSequence(t *testing.T) {
+	var filename = "db/sequence.db"
+	defer Remove(filename)
+	if err := SetSequence(filename, 100); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := Sequence(filename); err != nil || n != 100 {
+		t.Fatalf("bad sequence: %d, %v", n, err)
+	}
+	if err := SetSequence(filename, 99); err != ErrSequenceDecrease {
+		t.Fatalf("sequence decreased: %v", err)
+	}
+	if err := SetSequence(filename, 100); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := NextSequence(filename); err != nil || n != 101 {
+		t.Fatalf("bad next sequence: %d, %v", n, err)
+	}
+	// значение сохраняется в файле
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := Sequence(filename); err != nil || n != 101 {
+		t.Fatalf("bad sequence after reopen: %d, %v", n, err)
+	}
+}
+
+func TestGob(t *testing.T) {
+	var filename = "db/gob.db"
+	defer Remove(filename)
+	type value struct {
+		Name   string
+		Number complex128
+		Set    map[[2]int]bool
+	}
+	var original = value{
+		Name:   "gob",
+		Number: 1 + 2i,
+		Set:    map[[2]int]bool{{1, 2}: true},
+	}
+	if err := PutGob(filename, "key", original); err != nil {
+		t.Fatal(err)
+	}
+	var v value
+	if err := GetGob(filename, "key", &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Name != original.Name || v.Number != original.Number || !v.Set[[2]int{1, 2}] {
+		t.Fatalf("bad decoded value: %+v", v)
+	}
+	if err := PutsGob(filename, map[string]interface{}{
+		"a": 1, "b": "text",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var s string
+	if err := GetGob(filename, "b", &s); err != nil || s != "text" {
+		t.Fatalf("bad decoded string: %q, %v", s, err)
+	}
+	// значение, которое не может быть закодировано, не сохраняет остальные
+	if err := PutsGob(filename, map[string]interface{}{
+		"c": 1, "d": func() {},
+	}); err == nil {
+		t.Fatal("encoded function")
+	}
+	if err := GetGob(filename, "c", new(int)); err != ErrNotFound {
+		t.Fatalf("partial save: %v", err)
+	}
+	if err := GetGob(filename, "none", &s); err != ErrNotFound {
+		t.Fatalf("bad not found error: %v", err)
+	}
+}
+
+func TestOpenAliases(t *testing.T) {
+	var filename = "db/alias.db"
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(filename)
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var link = "db/alias_link.db"
+	os.Remove(link)
+	if err := os.Symlink(abs, link); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(link)
+	for _, name := range []string{"./db/alias.db", "db/../db/alias.db", abs, link} {
+		alias, err := Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if alias != db {
+			t.Fatalf("%s opened as separate store", name)
+		}
+	}
+	if err := Close(abs); err != nil {
+		t.Fatal(err)
+	}
+	if reopened, err := Open(filename); err != nil || reopened == db {
+		t.Fatal("store is not closed by alias:", err)
+	}
+}
+
+// failFile возвращает ошибку при сбросе данных в файл.
+type failFile struct {
+	File
+}
+
+func (failFile) Sync() error { return errors.New("sync failed") }
+
+func TestCloseAllErr(t *testing.T) {
+	if err := CloseAllErr(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"db/close1.db", "db/close2.db"} {
+		if _, err := Open(name); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(name)
+	}
+	db, err := OpenFile("fail", func(filename string, readOnly bool) (File, error) {
+		return failFile{newMemFile(filename)}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	db.name = "fail"
+	dbs[db.name] = db
+	mu.Unlock()
+	if n := OpenCount(); n != 3 {
+		t.Fatalf("bad open count: %d", n)
+	}
+	err = CloseAllErr()
+	if err == nil || !strings.Contains(err.Error(), "close fail: sync failed") {
+		t.Fatal("bad close error:", err)
+	}
+	if n := OpenCount(); n != 0 {
+		t.Fatalf("bad open count after close: %d", n)
+	}
+}
+
+func TestRemoveIfClosed(t *testing.T) {
+	var filename = "db/remove.db"
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filename)
+	if err := RemoveIfClosed(filename); !errors.Is(err, ErrInUse) {
+		t.Fatal("bad open store error:", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ro, err := OpenReadOnly(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveIfClosed(filename); !errors.Is(err, ErrInUse) {
+		t.Fatal("bad locked file error:", err)
+	}
+	if err := ro.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveIfClosed(filename); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatal("file not removed:", err)
+	}
+	if err := RemoveIfClosed(filename); !os.IsNotExist(err) {
+		t.Fatal("bad missing file error:", err)
+	}
+}
@@ -1,25 +1,274 @@
 package keystore
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 )
 
+// Сигнатуры, с которых начинается файл хранилища. По сигнатуре определяется
+// версия формата файла.
+const (
+	signatureV1 uint32 = 0xD3EFAA03 // исходный формат файла
+	signatureV2 uint32 = 0xD3EFAA04 // формат с флагами в заголовке
+	signatureV3 uint32 = 0xD3EFAA05 // формат с концом данных в заголовке
+)
+
+// Флаги формата файла, которые сохраняются в заголовке, начиная со второй
+// версии формата.
+const (
+	flagChecksum     uint32 = 1 << iota // записи содержат контрольную сумму
+	flagEncrypted                       // значения записей зашифрованы
+	flagCounterSlots                    // счетчик хранится в двух слотах
+)
+
+// Если установлен флаг flagCounterSlots, то значение счетчика хранится не в
+// основном заголовке, а в двух слотах сразу за флагами. Каждый слот содержит
+// значение счетчика и его контрольную сумму. Новое значение записывается
+// поочередно то в один, то в другой слот, поэтому при сбое во время записи
+// повреждается только один из них, а во втором остается предыдущее значение.
+// При чтении используется наибольшее значение с правильной контрольной
+// суммой.
+const (
+	counterSlotsOffset = 16 // смещение слотов от начала файла
+	counterSlotSize    = 12 // размер слота: значение и контрольная сумма
+)
+
+// counterSlot возвращает содержимое слота для указанного значения счетчика.
+func counterSlot(counter uint64) []byte {
+	var slot = make([]byte, counterSlotSize)
+	binary.BigEndian.PutUint64(slot, counter)
+	binary.BigEndian.PutUint32(slot[8:], crc32.ChecksumIEEE(slot[:8]))
+	return slot
+}
+
+// Начиная с третьей версии формата, в заголовке сразу за флагами и слотами
+// счетчика хранится слот со смещением конца данных в файле и его контрольной
+// суммой. Он обновляется при каждом изменении конца данных уже после записи
+// самих данных, поэтому при загрузке точно известно, где заканчиваются
+// записи: все, что находится за этим смещением, игнорируется, а файл
+// меньшего размера считается обрезанным. Если слот поврежден или содержит
+// ноль, то конец данных определяется так же, как в предыдущих версиях, — по
+// концу файла или заголовку записи из одних нулей.
+const endSlotSize = 12 // размер слота: смещение и контрольная сумма
+
+// endSlot возвращает содержимое слота для указанного конца данных.
+func endSlot(end int64) []byte {
+	var slot = make([]byte, endSlotSize)
+	binary.BigEndian.PutUint64(slot, uint64(end))
+	binary.BigEndian.PutUint32(slot[8:], crc32.ChecksumIEEE(slot[:8]))
+	return slot
+}
+
+// ErrBadSignature возвращается, если файл начинается с неизвестной сигнатуры
+// и, скорее всего, вообще не является хранилищем.
+var ErrBadSignature = errors.New("bad file signature")
+
+// ErrCorruptIndex возвращается, если заголовок файла или записи в нем
+// обрезаны или повреждены так, что их невозможно прочитать.
+var ErrCorruptIndex = errors.New("corrupt index")
+
+// errOutOfBounds возвращается при чтении записи, которая по размерам из ее
+// заголовка выходит за пределы файла: обычно это обрезанный файл.
+var errOutOfBounds = fmt.Errorf("%w: record exceeds file size", ErrCorruptIndex)
+
+// errTruncated возвращается, если файл меньше конца данных, сохраненного в
+// его заголовке.
+var errTruncated = fmt.Errorf("%w: file truncated", ErrCorruptIndex)
+
+// errDataEnd возвращается, если записи заканчиваются раньше конца данных,
+// сохраненного в заголовке файла.
+var errDataEnd = fmt.Errorf("%w: records end before data end", ErrCorruptIndex)
+
+// header описывает заголовок файла с индексом и данными.
+type header struct {
+	Signature uint32 // заголовок файла
+	Counter   uint64 // глобальный счетчик для генерации уникальых значений
+	Flags     uint32 // флаги формата файла, начиная со второй версии
+	Slot      int    // номер слота с действующим значением счетчика
+	End       int64  // конец данных, начиная с третьей версии, или 0
+	Check     []byte // блок для проверки ключа шифрования
+}
+
+// newHeader возвращает заголовок нового файла в текущей версии формата.
+func newHeader(counter uint64) *header {
+	return &header{
+		Signature: signatureV3,
+		Counter:   counter,
+		Flags:     flagChecksum | flagCounterSlots,
+	}
+}
+
+// current возвращает заголовок в текущей версии формата файла с тем же
+// значением счетчика и настройками шифрования.
+func (h *header) current() *header {
+	var head = newHeader(h.Counter)
+	if h.Flags&flagEncrypted != 0 {
+		head.Flags |= flagEncrypted
+		head.Check = h.Check
+	}
+	return head
+}
+
+// read читает заголовок файла и проверяет его сигнатуру.
+func (h *header) read(r io.Reader) error {
+	var v1 struct {
+		Signature uint32
+		Counter   uint64
+	}
+	if err := binary.Read(r, binary.BigEndian, &v1); err != nil {
+		return err
+	}
+	h.Signature, h.Counter, h.Flags, h.Check = v1.Signature, v1.Counter, 0, nil
+	h.End = 0
+	switch h.Signature {
+	case signatureV1:
+		return nil
+	case signatureV2, signatureV3:
+		if err := binary.Read(r, binary.BigEndian, &h.Flags); err != nil {
+			return err
+		}
+		if h.Flags&flagCounterSlots != 0 {
+			if err := h.readSlots(r); err != nil {
+				return err
+			}
+		}
+		if h.Signature == signatureV3 {
+			var slot = make([]byte, endSlotSize)
+			if _, err := io.ReadFull(r, slot); err != nil {
+				return err
+			}
+			// при поврежденном слоте конец данных считается неизвестным
+			if crc32.ChecksumIEEE(slot[:8]) == binary.BigEndian.Uint32(slot[8:]) {
+				h.End = int64(binary.BigEndian.Uint64(slot))
+			}
+		}
+		if h.Flags&flagEncrypted != 0 {
+			h.Check = make([]byte, checkSize)
+			_, err := io.ReadFull(r, h.Check)
+			return err
+		}
+		return nil
+	default:
+		return ErrBadSignature
+	}
+}
+
+// readSlots читает слоты со значением счетчика и выбирает из них наибольшее
+// значение с правильной контрольной суммой. Если оба слота повреждены, то
+// возвращает ErrCorruptIndex.
+func (h *header) readSlots(r io.Reader) error {
+	var slots = make([]byte, 2*counterSlotSize)
+	if _, err := io.ReadFull(r, slots); err != nil {
+		return err
+	}
+	var valid bool
+	for i := 0; i < 2; i++ {
+		var slot = slots[i*counterSlotSize : (i+1)*counterSlotSize]
+		if crc32.ChecksumIEEE(slot[:8]) != binary.BigEndian.Uint32(slot[8:]) {
+			continue // слот поврежден
+		}
+		var counter = binary.BigEndian.Uint64(slot)
+		if !valid || counter > h.Counter {
+			h.Counter, h.Slot, valid = counter, i, true
+		}
+	}
+	if !valid {
+		return ErrCorruptIndex
+	}
+	return nil
+}
+
+// write записывает заголовок файла.
+func (h *header) write(w io.Writer) error {
+	var fields = []interface{}{h.Signature, h.Counter}
+	if h.Signature != signatureV1 {
+		fields = append(fields, h.Flags)
+		if h.Flags&flagCounterSlots != 0 {
+			// в оба слота записывается одно и то же значение
+			var slot = counterSlot(h.Counter)
+			fields = append(fields, slot, slot)
+		}
+		if h.Signature == signatureV3 {
+			fields = append(fields, endSlot(h.End))
+		}
+		fields = append(fields, h.Check)
+	}
+	for _, field := range fields {
+		if err := binary.Write(w, binary.BigEndian, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Size возвращает размер заголовка файла.
+func (h *header) Size() int64 {
+	if h.Signature == signatureV1 {
+		return 12
+	}
+	var size = 16 + int64(len(h.Check))
+	if h.Flags&flagCounterSlots != 0 {
+		size += 2 * counterSlotSize
+	}
+	if h.Signature == signatureV3 {
+		size += endSlotSize
+	}
+	return size
+}
+
+// endOffset возвращает смещение слота с концом данных от начала файла или 0,
+// если версия формата его не поддерживает.
+func (h *header) endOffset() int64 {
+	if h.Signature != signatureV3 {
+		return 0
+	}
+	var offset int64 = counterSlotsOffset
+	if h.Flags&flagCounterSlots != 0 {
+		offset += 2 * counterSlotSize
+	}
+	return offset
+}
+
 // storedIndex описывает формат хранимого индекса.
 type storedIndex struct {
 	Time      uint32 // timestamp
-	Deleted   bool   // флаг удаленного ключа
+	Flags     uint8  // флаги записи
 	KeySize   uint8  // размер ключа
 	DataSize  uint32 // размер данных
 	EmptySize uint32 // размер свободного места за данными
 }
 
+// Флаги записи. Изначально вместо флагов в записи сохранялся только признак
+// удаления в виде bool, поэтому флаг удаления должен оставаться первым.
+const (
+	recordDeleted    uint8 = 1 << iota // запись удалена
+	recordCompressed                   // данные записи сжаты
+	recordRetained                     // удаленная запись хранится в корзине
+)
+
+// Deleted возвращает true, если запись помечена как удаленная.
+func (i storedIndex) Deleted() bool {
+	return i.Flags&recordDeleted != 0
+}
+
 var storedIndexSize = int64(binary.Size(new(storedIndex)))
 
-// Size возвращает размер, реально занимаемый данными, включая индекс.
-func (i storedIndex) Size() int64 {
-	// плюс размер данных storedIndex
-	return storedIndexSize + int64(i.KeySize) + int64(i.DataSize+i.EmptySize)
+// checksumSize задает размер контрольной суммы записи.
+const checksumSize = 4
+
+// recordHeaderSize возвращает размер заголовка записи для указанных флагов
+// формата файла: это размер storedIndex и контрольной суммы, если она
+// используется.
+func recordHeaderSize(flags uint32) int64 {
+	if flags&flagChecksum != 0 {
+		return storedIndexSize + checksumSize
+	}
+	return storedIndexSize
 }
 
 // index описывает данные, хранимые об индексе в памяти.
@@ -28,22 +277,153 @@ type index struct {
 	KeySize   uint8  // длина названия ключа
 	DataSize  uint32 // размер данных
 	EmptySize uint32 // размер свободного места за данными
+	Time      uint32 // время сохранения
+	Flags     uint8  // флаги записи
 }
 
-var indexSize = int64(binary.Size(new(index)))
-
 // Size возвращает суммарный размер ключа и данных, но без учета метаданных.
 func (i index) Size() uint32 {
 	return uint32(i.KeySize) + i.DataSize + i.EmptySize
 }
 
-// DataOffset возвращает смещение относительно начала файла для чтения данных.
-func (i index) DataOffset() int64 {
-	// плюс размер данных storedIndex и размер ключа
-	return int64(i.Offset) + indexSize + int64(i.KeySize) + 1
-}
-
 // String возвращает строковое представление индекса, используемое для отладки.
 func (i index) String() string {
 	return fmt.Sprintf("%d:%d", i.Offset, i.Size())
 }
+
+// ErrChecksum возвращается, если контрольная сумма записи в файле хранилища
+// не совпадает с ее содержимым.
+var ErrChecksum = errors.New("checksum mismatch")
+
+// checksum возвращает контрольную сумму для ключа и данных записи.
+func checksum(key string, value []byte) uint32 {
+	var crc = crc32.ChecksumIEEE([]byte(key))
+	return crc32.Update(crc, crc32.IEEETable, value)
+}
+
+// record описывает запись, прочитанную из файла хранилища.
+type record struct {
+	storedIndex
+	Offset int64  // смещение записи от начала файла
+	Key    []byte // ключ
+	Data   []byte // данные, если было запрошено их чтение
+	Valid  bool   // контрольная сумма записи совпадает
+}
+
+// index возвращает описание индекса для записи.
+func (r *record) index() index {
+	return index{
+		Offset:    uint32(r.Offset),
+		KeySize:   r.KeySize,
+		DataSize:  r.DataSize,
+		EmptySize: r.EmptySize,
+		Time:      r.Time,
+		Flags:     r.Flags &^ (recordDeleted | recordRetained),
+	}
+}
+
+// recordReader последовательно читает записи из файла хранилища.
+type recordReader struct {
+	r      *bufio.Reader
+	offset int64  // смещение следующей записи
+	flags  uint32 // флаги формата файла
+	data   bool   // читать данные действующих записей
+	size   int64  // размер файла, если он известен
+}
+
+// newRecordReader возвращает новый recordReader, читающий записи из r,
+// который должен быть установлен на начало записи со смещением offset.
+func newRecordReader(r io.Reader, offset int64, flags uint32) *recordReader {
+	return &recordReader{
+		r:      bufio.NewReader(r),
+		offset: offset,
+		flags:  flags,
+	}
+}
+
+// next читает следующую запись. Возвращает io.EOF, если записей больше нет
+// или вместо заголовка записи в файле одни нули, и io.ErrUnexpectedEOF, если
+// запись обрезана.
+//
+// Для действующих записей с контрольной суммой данные читаются целиком и
+// сверяются с ней: результат проверки сохраняется в Valid. Для всех
+// остальных записей Valid всегда взведен.
+func (rr *recordReader) next(rec *record) (err error) {
+	defer func() {
+		if err == io.EOF && rec.Offset != rr.offset {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+	rec.Offset, rec.Data, rec.Valid = rr.offset, nil, true
+	// нулевой заголовок отмечает конец данных перед местом, которое
+	// зарезервировано в файле, но еще не занято записями. Так же считается
+	// и неполный заголовок из нулей в самом конце файла: такой хвост может
+	// остаться после сбоя во время увеличения файла.
+	if head, err := rr.r.Peek(int(storedIndexSize)); (err == nil ||
+		err == io.EOF) && zeroed(head) {
+		return io.EOF
+	}
+	if err = binary.Read(rr.r, binary.BigEndian, &rec.storedIndex); err != nil {
+		return err
+	}
+	rr.offset += storedIndexSize
+	// если размер файла известен, то сразу проверяем, что запись целиком
+	// помещается в файл
+	if rr.size > 0 && rec.Offset+recordHeaderSize(rr.flags)+int64(rec.KeySize)+
+		int64(rec.DataSize)+int64(rec.EmptySize) > rr.size {
+		return errOutOfBounds
+	}
+	var sum uint32 // сохраненная контрольная сумма
+	if rr.flags&flagChecksum != 0 {
+		if err = binary.Read(rr.r, binary.BigEndian, &sum); err != nil {
+			return err
+		}
+		rr.offset += checksumSize
+	}
+	// читаем имя ключа
+	rec.Key = make([]byte, rec.KeySize)
+	if _, err = io.ReadFull(rr.r, rec.Key); err != nil {
+		return err
+	}
+	rr.offset += int64(rec.KeySize)
+	var skip = int64(rec.DataSize) + int64(rec.EmptySize)
+	if !rec.Deleted() && (rr.data || rr.flags&flagChecksum != 0) {
+		// читаем данные для проверки контрольной суммы
+		var hash = crc32.NewIEEE()
+		_, _ = hash.Write(rec.Key)
+		if rr.data {
+			// память под данные выделяется по мере их чтения, а не сразу по
+			// размеру из заголовка, который может быть поврежден
+			var buf bytes.Buffer
+			_, err = io.CopyN(io.MultiWriter(&buf, hash), rr.r,
+				int64(rec.DataSize))
+			rec.Data = buf.Bytes()
+		} else {
+			_, err = io.CopyN(hash, rr.r, int64(rec.DataSize))
+		}
+		if err != nil {
+			return err
+		}
+		rr.offset += int64(rec.DataSize)
+		skip = int64(rec.EmptySize)
+		if rr.flags&flagChecksum != 0 {
+			rec.Valid = hash.Sum32() == sum
+		}
+	}
+	// пропускаем данные и возможное свободное пространство за ними
+	if _, err = rr.r.Discard(int(skip)); err != nil {
+		return err
+	}
+	rr.offset += skip
+	return nil
+}
+
+// zeroed возвращает true, если все байты b нулевые.
+func zeroed(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
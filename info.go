@@ -0,0 +1,113 @@
+package keystore
+
+import "time"
+
+// Info описывает запись хранилища так, как она сохранена в файле.
+type Info struct {
+	Offset    uint32    // смещение записи от начала файла
+	KeySize   uint8     // длина ключа
+	DataSize  uint32    // размер данных в файле
+	EmptySize uint32    // размер свободного места за данными
+	ModTime   time.Time // время сохранения
+}
+
+// IndexInfo возвращает описание записи с указанным ключом без чтения самого
+// значения. Если ключа в хранилище нет, то второе значение равно false.
+//
+// Размер данных указывается в том виде, в котором они сохранены в файле, т.е.
+// с учетом сжатия и шифрования.
+func (db *DB) IndexInfo(key string) (Info, bool) {
+	db.mu.RLock()
+	index, ok := db.indexes[key]
+	db.mu.RUnlock()
+	if !ok {
+		return Info{}, false
+	}
+	return Info{
+		Offset:    index.Offset,
+		KeySize:   index.KeySize,
+		DataSize:  index.DataSize,
+		EmptySize: index.EmptySize,
+		ModTime:   time.Unix(int64(index.Time), 0),
+	}, true
+}
+
+// SlotInfo описывает свободное место в файле хранилища.
+type SlotInfo struct {
+	Offset uint32 // смещение от начала файла
+	Size   uint32 // размер, доступный для ключа и данных
+}
+
+// DeletedSlots возвращает список свободных мест в файле хранилища,
+// отсортированный по размеру. Используется для оценки фрагментации файла.
+func (db *DB) DeletedSlots() []SlotInfo {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var slots = make([]SlotInfo, 0, db.deleted.len())
+	db.deleted.each(func(index index) {
+		slots = append(slots, SlotInfo{Offset: index.Offset, Size: index.Size()})
+	})
+	return slots
+}
+
+// Size возвращает размер значения с указанным ключом без его чтения. Если
+// ключа в хранилище нет, то возвращается ошибка ErrNotFound.
+//
+// Возвращается размер данных в файле: для сжатых или зашифрованных значений
+// он отличается от размера самого значения.
+func (db *DB) Size(key string) (uint32, error) {
+	db.mu.RLock()
+	index, ok := db.indexes[key]
+	var closed = db.closed
+	db.mu.RUnlock()
+	if closed {
+		return 0, ErrClosed
+	}
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return index.DataSize, nil
+}
+
+// TotalSize возвращает суммарный размер всех значений хранилища в файле без
+// учета ключей, заголовков записей и свободного места.
+func (db *DB) TotalSize() uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var total uint64
+	for _, index := range db.indexes {
+		total += uint64(index.DataSize)
+	}
+	return total
+}
+
+// Stats описывает состояние хранилища.
+type Stats struct {
+	Keys      int    // количество ключей
+	Size      int64  // размер данных в файле, включая свободные места
+	FreeSlots int    // количество свободных мест, доступных для записи
+	FreeSize  uint64 // суммарный размер свободных мест
+	// AbandonedSlots и AbandonedSize задают количество и суммарный размер
+	// свободных мест, отброшенных из-за ограничения db.SetMaxFreeSlots.
+	AbandonedSlots uint64
+	AbandonedSize  uint64
+}
+
+// Stats возвращает текущее состояние хранилища. Для закрытого хранилища
+// возвращается пустое состояние.
+func (db *DB) Stats() Stats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return Stats{}
+	}
+	var stats = Stats{
+		Keys:           len(db.indexes),
+		Size:           db.size,
+		FreeSlots:      db.deleted.len(),
+		FreeSize:       db.deleted.size,
+		AbandonedSlots: db.lost,
+		AbandonedSize:  db.lostSize,
+	}
+	return stats
+}
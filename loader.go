@@ -0,0 +1,101 @@
+package keystore
+
+import "sync"
+
+// Loader описывает функцию загрузки значения для ключа, который отсутствует
+// в хранилище. Если значение найдено, то функция должна вернуть его и true.
+type Loader func(key string) (value []byte, found bool, err error)
+
+// SetLoader задает функцию загрузки отсутствующих значений, превращая
+// хранилище в заполняемый по запросу кеш: если запрошенного через db.Get
+// ключа нет в хранилище, то вызывается указанная функция, а возвращенное ей
+// значение сохраняется в хранилище и возвращается как результат.
+//
+// Одновременные запросы одного и того же отсутствующего ключа приводят только
+// к одному вызову функции загрузки: остальные запросы дожидаются ее результата.
+// Сама функция вызывается без блокировки хранилища, а вот сохранение
+// полученного значения происходит уже с блокировкой на запись. Для хранилища,
+// открытого только для чтения, загруженное значение только возвращается, но
+// не сохраняется.
+//
+// Для отмены загрузки можно передать nil.
+func (db *DB) SetLoader(loader Loader) {
+	db.mu.Lock()
+	db.loader = loader
+	db.mu.Unlock()
+}
+
+// load описывает выполняющуюся загрузку значения.
+type load struct {
+	wg    sync.WaitGroup
+	value []byte
+	err   error
+}
+
+// load загружает значение ключа с помощью функции загрузки и сохраняет его
+// в хранилище. Повторные запросы на загрузку того же ключа, пока первая
+// загрузка не завершена, ожидают ее результата.
+func (db *DB) load(key string, loader Loader) ([]byte, error) {
+	db.lmu.Lock()
+	if l, ok := db.loads[key]; ok {
+		db.lmu.Unlock()
+		l.wg.Wait() // ждем окончания уже запущенной загрузки
+		return l.value, l.err
+	}
+	// значение могло быть сохранено, пока не была зарегистрирована
+	// загрузка, в том числе предыдущей загрузкой того же ключа
+	db.mu.RLock()
+	if _, ok := db.indexes[key]; ok {
+		value, err := db.get(key)
+		db.mu.RUnlock()
+		db.lmu.Unlock()
+		return value, err
+	}
+	db.mu.RUnlock()
+	var l = new(load)
+	l.wg.Add(1)
+	if db.loads == nil {
+		db.loads = make(map[string]*load)
+	}
+	db.loads[key] = l
+	db.lmu.Unlock()
+
+	l.value, l.err = db.loadValue(key, loader)
+	l.wg.Done()
+
+	db.lmu.Lock()
+	delete(db.loads, key)
+	db.lmu.Unlock()
+	return l.value, l.err
+}
+
+// loadValue вызывает функцию загрузки и сохраняет полученное значение.
+func (db *DB) loadValue(key string, loader Loader) ([]byte, error) {
+	value, found, err := loader(key)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+	if value == nil {
+		value = []byte{} // пустое значение всегда возвращается как []byte{}
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// значение могло быть сохранено, пока выполнялась загрузка
+	if _, ok := db.indexes[key]; ok {
+		return db.get(key)
+	}
+	if db.ro {
+		return value, nil
+	}
+	err = db.put(key, value)
+	if err == nil {
+		err = db.flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
@@ -0,0 +1,64 @@
+package keystore
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLoader(t *testing.T) {
+	var filename = "db/loader.db"
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(filename)
+	db.SetSync(false)
+
+	// загрузка завершается только после того, как все запросы уже начаты
+	var calls int32
+	var started sync.WaitGroup
+	started.Add(10)
+	db.SetLoader(func(key string) ([]byte, bool, error) {
+		atomic.AddInt32(&calls, 1)
+		if key == "missing" {
+			return nil, false, nil
+		}
+		started.Wait()
+		return []byte("loaded " + key), true, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			started.Done()
+			value, err := db.Get("key")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if string(value) != "loaded key" {
+				t.Errorf("bad loaded value: %q", value)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("loader called %d times", calls)
+	}
+	// значение должно быть сохранено в хранилище
+	if !db.Has("key") {
+		t.Fatal("loaded value not stored")
+	}
+	if _, err := db.Get("key"); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Fatalf("loader called %d times after caching", calls)
+	}
+	if _, err := db.Get("missing"); err != ErrNotFound {
+		t.Fatal("bad not found from loader:", err)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+
+package keystore
+
+import (
+	"errors"
+	"os"
+)
+
+// errWouldBlock возвращается lockFile, если файл уже заблокирован.
+var errWouldBlock = errors.New("would block")
+
+// lockFile ничего не делает: на этой платформе блокировка файлов не
+// поддерживается.
+func lockFile(file *os.File, exclusive bool) error {
+	return nil
+}
+
+// unlockFile ничего не делает.
+func unlockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,32 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package keystore
+
+import (
+	"os"
+	"syscall"
+)
+
+// errWouldBlock возвращается lockFile, если файл уже заблокирован.
+var errWouldBlock error = syscall.EWOULDBLOCK
+
+// lockFile устанавливает на файл рекомендательную блокировку: эксклюзивную
+// или разделяемую. Если файл уже заблокирован, то не ожидает снятия
+// блокировки, а сразу возвращает ошибку errWouldBlock.
+func lockFile(file *os.File, exclusive bool) error {
+	var how = syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// unlockFile снимает блокировку с файла.
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,53 @@
+package keystore
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x00000001
+	lockfileExclusiveLock   = 0x00000002
+)
+
+// errWouldBlock возвращается lockFile, если файл уже заблокирован.
+var errWouldBlock error = syscall.Errno(33) // ERROR_LOCK_VIOLATION
+
+// lockOverlapped задает блокируемый диапазон: один байт в самом конце
+// возможного размера файла, чтобы блокировка не мешала чтению данных.
+func lockOverlapped() *syscall.Overlapped {
+	return &syscall.Overlapped{Offset: ^uint32(0), OffsetHigh: ^uint32(0)}
+}
+
+// lockFile устанавливает на файл блокировку: эксклюзивную или разделяемую.
+// Если файл уже заблокирован, то не ожидает снятия блокировки, а сразу
+// возвращает ошибку errWouldBlock.
+func lockFile(file *os.File, exclusive bool) error {
+	var flags uint32 = lockfileFailImmediately
+	if exclusive {
+		flags |= lockfileExclusiveLock
+	}
+	r, _, err := procLockFileEx.Call(file.Fd(), uintptr(flags), 0, 1, 0,
+		uintptr(unsafe.Pointer(lockOverlapped())))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// unlockFile снимает блокировку с файла.
+func unlockFile(file *os.File) error {
+	r, _, err := procUnlockFileEx.Call(file.Fd(), 0, 1, 0,
+		uintptr(unsafe.Pointer(lockOverlapped())))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package keystore
+
+import "log/slog"
+
+// loggerValue позволяет хранить *slog.Logger в atomic.Value, в том числе nil.
+type loggerValue struct {
+	*slog.Logger
+}
+
+// SetLogger устанавливает журнал для отладочных сообщений и предупреждений о
+// работе хранилища: загрузке индекса, записи и удалении значений, повторном
+// использовании свободного места и укорачивании файла. Ко всем сообщениям
+// добавляется атрибут path с именем файла хранилища.
+//
+// Значение nil отключает журнал: в этом случае сообщения не формируются и не
+// требуют никаких дополнительных затрат. По умолчанию журнал не используется.
+func (db *DB) SetLogger(logger *slog.Logger) {
+	if logger != nil {
+		logger = logger.With("path", db.Path())
+	}
+	db.log.Store(loggerValue{logger})
+}
+
+// logger возвращает журнал хранилища или nil, если он не задан.
+func (db *DB) logger() *slog.Logger {
+	value, _ := db.log.Load().(loggerValue)
+	return value.Logger
+}
+
+// logLoad записывает в журнал сведения о загруженном индексе и предупреждения,
+// обнаруженные при загрузке файла.
+func (db *DB) logLoad() {
+	var logger = db.logger()
+	if logger == nil {
+		return
+	}
+	logger.Debug("load index", "keys", len(db.indexes),
+		"free", db.deleted.len(), "size", db.size)
+	for _, warning := range db.warnings {
+		logger.Warn("load index", "warning", warning)
+	}
+}
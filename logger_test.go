@@ -0,0 +1,58 @@
+package keystore
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	db, err := OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var buf bytes.Buffer
+	var logger = slog.New(slog.NewTextHandler(&buf,
+		&slog.HandlerOptions{Level: slog.LevelDebug}))
+	if err := (&Options{Logger: logger}).apply(db); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Put(key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("d", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("c"); err != nil { // последняя запись в файле
+		t.Fatal(err)
+	}
+	var output = buf.String()
+	for _, msg := range []string{
+		"msg=\"load index\" path=:memory: keys=0",
+		"msg=put path=:memory: key=a",
+		"msg=delete path=:memory: key=a",
+		"msg=\"reuse slot\"",
+		"msg=shrink",
+	} {
+		if !strings.Contains(output, msg) {
+			t.Errorf("missing %s in log:\n%s", msg, output)
+		}
+	}
+
+	// без журнала сообщения не выводятся
+	db.SetLogger(nil)
+	buf.Reset()
+	if err := db.Put("e", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() > 0 {
+		t.Errorf("unexpected log output: %s", buf.String())
+	}
+}
@@ -0,0 +1,152 @@
+package keystore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// memFile реализует файл, данные которого хранятся в памяти.
+type memFile struct {
+	name   string
+	data   []byte
+	offset int64 // текущая позиция для Seek
+	closed bool
+	mu     sync.RWMutex
+}
+
+// newMemFile возвращает новый пустой файл в памяти.
+func newMemFile(name string) *memFile {
+	return &memFile{name: name}
+}
+
+// openMemFile возвращает новый пустой файл в памяти. Реализует FileOpener.
+func openMemFile(filename string, readOnly bool) (File, error) {
+	return newMemFile(filename), nil
+}
+
+// Name возвращает имя файла.
+func (f *memFile) Name() string {
+	return f.name
+}
+
+// ReadAt читает данные файла, начиная с указанного смещения.
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if len(p) == 0 {
+		return 0, nil // как и у os.File, пустое чтение всегда успешно
+	}
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	var n = copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt записывает данные в файл, начиная с указанного смещения, и при
+// необходимости увеличивает его размер.
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if end := off + int64(len(p)); end > int64(len(f.data)) {
+		f.resize(end)
+	}
+	return copy(f.data[off:], p), nil
+}
+
+// Seek изменяет текущую позицию в файле и возвращает ее новое значение.
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.data))
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Truncate изменяет размер файла.
+func (f *memFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	if size < 0 {
+		return errors.New("negative size")
+	}
+	f.resize(size)
+	return nil
+}
+
+// resize изменяет размер данных файла. Добавленное место заполняется нулями.
+func (f *memFile) resize(size int64) {
+	if size <= int64(cap(f.data)) {
+		var n = len(f.data)
+		f.data = f.data[:size]
+		for i := n; i < int(size); i++ {
+			f.data[i] = 0 // могли остаться данные после Truncate
+		}
+		return
+	}
+	var data = make([]byte, size, 2*size)
+	copy(data, f.data)
+	f.data = data
+}
+
+// Sync ничего не делает, так как данные и так находятся в памяти.
+func (f *memFile) Sync() error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+// Close закрывает файл и освобождает занимаемую им память.
+func (f *memFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed, f.data = true, nil
+	return nil
+}
+
+// OpenMemory открывает новое пустое хранилище, данные которого хранятся
+// только в памяти и теряются при его закрытии. Такое хранилище не
+// добавляется в список открытых и закрывать его необходимо самостоятельно.
+//
+// Обычно используется в тестах, чтобы не создавать файлы на диске.
+func OpenMemory() (*DB, error) {
+	return open(context.Background(), openMemFile, ":memory:", false, nil)
+}
@@ -0,0 +1,100 @@
+package keystore
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestOpenMemory(t *testing.T) {
+	db, err := OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Path() != ":memory:" {
+		t.Fatalf("bad path: %q", db.Path())
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Put(key, []byte("value "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("c", bytes.Repeat([]byte("c"), 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := db.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "value a" {
+		t.Fatalf("bad value: %q", data)
+	}
+	if db.Count() != 2 {
+		t.Fatalf("bad count: %d", db.Count())
+	}
+
+	// данные переносятся в обычное хранилище без изменений
+	backup, err := db.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone, err := OpenBinary(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clone.Close()
+	if data, err := clone.Get("c"); err != nil || len(data) != 100 {
+		t.Fatalf("bad clone value: %q, %v", data, err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != ErrClosed {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(":memory:"); !os.IsNotExist(err) {
+		t.Fatal("memory store created file on disk")
+	}
+}
+
+func TestMemFile(t *testing.T) {
+	var f = newMemFile("test")
+	if _, err := f.WriteAt([]byte("hello"), 3); err != nil {
+		t.Fatal(err)
+	}
+	var buf = make([]byte, 8)
+	if n, err := f.ReadAt(buf, 0); err != nil || n != 8 {
+		t.Fatal(n, err)
+	}
+	if !bytes.Equal(buf, []byte("\x00\x00\x00hello")) {
+		t.Fatalf("bad data: %q", buf)
+	}
+	if n, err := f.ReadAt(buf, 4); err == nil || n != 4 {
+		t.Fatal("expected EOF", n, err)
+	}
+	if err := f.Truncate(4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("!"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := f.Seek(0, 2); err != nil || size != 7 {
+		t.Fatal(size, err)
+	}
+	if n, _ := f.ReadAt(buf, 0); !bytes.Equal(buf[:n], []byte("\x00\x00\x00h\x00\x00!")) {
+		t.Fatalf("bad data after truncate: %q", buf[:n])
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.ReadAt(buf, 0); err != os.ErrClosed {
+		t.Fatal("expected closed error", err)
+	}
+}
@@ -0,0 +1,50 @@
+package keystore
+
+// Metrics описывает получателя статистики операций с хранилищем, например,
+// для экспорта в Prometheus. Методы вызываются синхронно при выполнении
+// операций, в том числе под блокировкой хранилища, поэтому должны
+// выполняться быстро и не обращаться к самому хранилищу.
+type Metrics interface {
+	// ObserveGet вызывается при каждом чтении значения с помощью Get и
+	// производных от него методов. hit равен false, если значение не найдено
+	// или не может быть прочитано, а bytes задает размер значения.
+	ObserveGet(hit bool, bytes int)
+	// ObservePut вызывается после каждого сохранения значения. reused равен
+	// true, если значение записано на место ранее удаленных данных, и false,
+	// если оно добавлено в конец файла. bytes задает размер данных,
+	// записанных в файл, с учетом сжатия и шифрования.
+	ObservePut(reused bool, bytes int)
+	// ObserveDelete вызывается при каждой попытке удаления ключа. found равен
+	// false, если ключа в хранилище не было.
+	ObserveDelete(found bool)
+}
+
+// metricsValue позволяет хранить Metrics в atomic.Value, в том числе nil.
+type metricsValue struct {
+	Metrics
+}
+
+// SetMetrics устанавливает получателя статистики операций с хранилищем.
+// Значение nil отключает сбор статистики: в этом случае он не требует
+// никаких дополнительных затрат.
+func (db *DB) SetMetrics(metrics Metrics) {
+	db.meter.Store(metricsValue{metrics})
+}
+
+// metrics возвращает получателя статистики или nil, если он не задан.
+func (db *DB) metrics() Metrics {
+	value, _ := db.meter.Load().(metricsValue)
+	return value.Metrics
+}
+
+// observePut передает сведения о сохранении значения с ключом key в запись
+// index получателю статистики и в журнал.
+func (db *DB) observePut(key string, index index, reused bool, bytes int) {
+	if metrics := db.metrics(); metrics != nil {
+		metrics.ObservePut(reused, bytes)
+	}
+	if logger := db.logger(); logger != nil {
+		logger.Debug("put", "key", key, "offset", index.Offset,
+			"size", bytes, "reused", reused)
+	}
+}
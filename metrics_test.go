@@ -0,0 +1,101 @@
+package keystore
+
+import (
+	"sync"
+	"testing"
+)
+
+// countMetrics подсчитывает количество наблюдаемых операций.
+type countMetrics struct {
+	mu                     sync.Mutex
+	hits, misses, getBytes int
+	appends, reuses        int
+	putBytes               int
+	deleted, notFound      int
+}
+
+func (m *countMetrics) ObserveGet(hit bool, bytes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if hit {
+		m.hits++
+	} else {
+		m.misses++
+	}
+	m.getBytes += bytes
+}
+
+func (m *countMetrics) ObservePut(reused bool, bytes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if reused {
+		m.reuses++
+	} else {
+		m.appends++
+	}
+	m.putBytes += bytes
+}
+
+func (m *countMetrics) ObserveDelete(found bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if found {
+		m.deleted++
+	} else {
+		m.notFound++
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	var metrics = new(countMetrics)
+	db, err := OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := (&Options{Metrics: metrics}).apply(db); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Put(key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("a"); err != ErrNotFound {
+		t.Fatalf("bad delete error: %v", err)
+	}
+	// новое значение записывается на место удаленного
+	if err := db.Put("d", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("a"); err != ErrNotFound {
+		t.Fatalf("bad get error: %v", err)
+	}
+	if metrics.appends != 3 || metrics.reuses != 1 || metrics.putBytes == 0 {
+		t.Errorf("bad put metrics: %d appends, %d reuses, %d bytes",
+			metrics.appends, metrics.reuses, metrics.putBytes)
+	}
+	if metrics.hits != 1 || metrics.misses != 1 || metrics.getBytes != 5 {
+		t.Errorf("bad get metrics: %d hits, %d misses, %d bytes",
+			metrics.hits, metrics.misses, metrics.getBytes)
+	}
+	if metrics.deleted != 1 || metrics.notFound != 1 {
+		t.Errorf("bad delete metrics: %d deleted, %d not found",
+			metrics.deleted, metrics.notFound)
+	}
+
+	// без получателя статистика не собирается
+	db.SetMetrics(nil)
+	if _, err := db.Get("b"); err != nil {
+		t.Fatal(err)
+	}
+	if metrics.hits != 1 {
+		t.Errorf("metrics observed after reset: %d hits", metrics.hits)
+	}
+}
@@ -0,0 +1,88 @@
+package keystore
+
+import (
+	"errors"
+	"io"
+)
+
+// minMmapSize задает минимальный размер отображения файла в память. Файл
+// отображается с запасом, чтобы не выполнять повторное отображение после
+// каждой записи, добавленной в конец файла.
+const minMmapSize = 1 << 20
+
+// errMmapUnsupported возвращается, если файл не может быть отображен в
+// память на этой платформе или не является обычным файлом на диске.
+var errMmapUnsupported = errors.New("mmap not supported")
+
+// SetMmap включает или выключает чтение значений через отображение файла
+// хранилища в память. Это позволяет не выполнять системный вызов при каждом
+// чтении значения, что заметно ускоряет Get для часто запрашиваемых данных,
+// если файл целиком помещается в памяти.
+//
+// Значение все равно копируется из отображения в новый срез: оно может быть
+// перезаписано при изменении хранилища, а возвращенный срез можно изменять.
+// По мере увеличения файла отображение расширяется, а при закрытии
+// хранилища — освобождается.
+//
+// Отображение в память поддерживается только для файлов на диске в unix. В
+// остальных случаях, в том числе в Windows, значения по-прежнему читаются из
+// файла, а SetMmap ничего не делает.
+func (db *DB) SetMmap(use bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return
+	}
+	db.usemmap = use
+	db.resetView() // при отображении в память чтение только под блокировкой
+	if !use {
+		db.unmap()
+		return
+	}
+	if size, err := db.f.Seek(0, io.SeekEnd); err == nil {
+		db.remap(size)
+	}
+}
+
+// remap отображает файл в память так, чтобы отображение охватывало не
+// меньше size байт. Если файл не удается отобразить, то значения читаются
+// непосредственно из файла. Вызывающий должен удерживать эксклюзивную
+// блокировку хранилища: при повторном отображении прежнее освобождается.
+func (db *DB) remap(size int64) {
+	if !db.usemmap || size <= int64(len(db.mmap)) {
+		return
+	}
+	var length = int64(2 * len(db.mmap))
+	if length < minMmapSize {
+		length = minMmapSize
+	}
+	for length < size {
+		length *= 2
+	}
+	db.unmap()
+	if int64(int(length)) != length {
+		return // не помещается в адресное пространство
+	}
+	if data, err := mmapFile(db.f, int(length)); err == nil {
+		db.mmap = data
+	}
+}
+
+// unmap освобождает отображение файла в память, если оно есть.
+func (db *DB) unmap() {
+	if db.mmap != nil {
+		_ = munmapFile(db.mmap)
+		db.mmap = nil
+	}
+}
+
+// readMapped копирует в p данные файла, начиная со смещения offset, из
+// отображения в память. Возвращает false, если эти данные не попадают в
+// отображение и их нужно читать из файла.
+func (db *DB) readMapped(p []byte, offset int64) bool {
+	if offset+int64(len(p)) > int64(len(db.mmap)) {
+		return false
+	}
+	copy(p, db.mmap[offset:])
+	return true
+}
@@ -0,0 +1,13 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+
+package keystore
+
+// mmapFile не поддерживается на этой платформе и всегда возвращает ошибку.
+func mmapFile(file File, length int) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+// munmapFile ничего не делает.
+func munmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,124 @@
+package keystore
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestMmap(t *testing.T) {
+	var filename = filepath.Join("db", "mmap.db")
+	os.Remove(filename)
+	defer os.Remove(filename)
+	db, err := OpenWithOptions(filename, &Options{UseMmap: true,
+		SyncPolicy: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if runtime.GOOS != "windows" && runtime.GOOS != "plan9" && db.mmap == nil {
+		t.Fatal("file not mapped")
+	}
+	// значения больше начального размера отображения
+	var value = bytes.Repeat([]byte("0123456789abcdef"), 1<<14)
+	for i := 0; i < 100; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), value[:i*len(value)/100+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key10"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key20", []byte("short")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		var want = value[:i*len(value)/100+1]
+		switch i {
+		case 10:
+			want = nil
+		case 20:
+			want = []byte("short")
+		}
+		data, err := db.Get(fmt.Sprintf("key%d", i))
+		if want == nil {
+			if err != ErrNotFound {
+				t.Fatal("deleted key:", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, want) {
+			t.Fatalf("key%d: bad value", i)
+		}
+	}
+	if db.mmap != nil && int64(len(db.mmap)) < int64(len(value))*50 {
+		t.Errorf("mapping not grown: %d", len(db.mmap))
+	}
+	// возвращенное значение можно изменять
+	data, err := db.Get("key20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[0] = 'S'
+	if data, _ = db.Get("key20"); string(data) != "short" {
+		t.Fatalf("value changed: %q", data)
+	}
+	db.SetMmap(false)
+	if db.mmap != nil {
+		t.Fatal("file not unmapped")
+	}
+	if data, _ = db.Get("key20"); string(data) != "short" {
+		t.Fatalf("bad value: %q", data)
+	}
+	db.SetMmap(true)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db.mmap != nil {
+		t.Fatal("file not unmapped on close")
+	}
+}
+
+// BenchmarkGet читает значения из хранилища, открытого только для чтения,
+// с отображением файла в память и без него.
+func BenchmarkGet(b *testing.B) {
+	var filename = filepath.Join("db", "get.db")
+	os.Remove(filename)
+	defer os.Remove(filename)
+	db, err := Open(filename)
+	if err != nil {
+		b.Fatal(err)
+	}
+	db.SetSync(false)
+	var value = make([]byte, 256)
+	for i := 0; i < 1000; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := Close(filename); err != nil {
+		b.Fatal(err)
+	}
+	for _, mmap := range []bool{false, true} {
+		b.Run(fmt.Sprintf("mmap=%v", mmap), func(b *testing.B) {
+			db, err := OpenWithOptions(filename, &Options{ReadOnly: true,
+				UseMmap: mmap})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Get(fmt.Sprintf("key%d", i%1000)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
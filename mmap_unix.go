@@ -0,0 +1,22 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package keystore
+
+import "syscall"
+
+// mmapFile отображает в память только для чтения первые length байт файла.
+// Отображение может быть больше самого файла: данные за его концом
+// становятся доступны после того, как будут записаны в файл.
+func mmapFile(file File, length int) ([]byte, error) {
+	f, ok := file.(interface{ Fd() uintptr })
+	if !ok {
+		return nil, errMmapUnsupported
+	}
+	return syscall.Mmap(int(f.Fd()), 0, length, syscall.PROT_READ,
+		syscall.MAP_SHARED)
+}
+
+// munmapFile освобождает отображение файла в память.
+func munmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,172 @@
+package keystore
+
+import (
+	"context"
+	"crypto/cipher"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Права доступа по умолчанию к создаваемым файлам хранилища и каталогам для
+// них. Итоговые права, как обычно, ограничиваются umask процесса.
+const (
+	defaultFileMode os.FileMode = 0666
+	defaultDirMode  os.FileMode = 0777
+)
+
+// Options задает параметры открытия хранилища. Нулевое значение любого поля
+// соответствует значению по умолчанию, поэтому пустые Options полностью
+// соответствуют открытию с помощью Open.
+//
+// Все параметры применяются до того, как хранилище станет доступно, поэтому,
+// в отличие от вызова соответствующих методов после открытия, между
+// открытием и первой записью нет момента, когда действуют другие настройки.
+type Options struct {
+	// ReadOnly открывает хранилище только для чтения, как OpenReadOnly. Такое
+	// хранилище не добавляется в список открытых и закрывать его необходимо
+	// самостоятельно. По умолчанию хранилище открывается на запись.
+	ReadOnly bool
+	// SyncPolicy задает политику сброса данных в файл после записи, а
+	// SyncInterval — интервал для политики SyncEveryInterval (см.
+	// db.SetSyncPolicy). По умолчанию используется SyncAlways.
+	SyncPolicy   SyncPolicy
+	SyncInterval time.Duration
+	// Compression задает способ сжатия новых значений (см. db.SetCompression).
+	// По умолчанию значения не сжимаются.
+	Compression Compression
+	// CompressionThreshold задает минимальный размер сжимаемых значений. По
+	// умолчанию используется DefaultCompressionThreshold.
+	CompressionThreshold int
+	// EncryptionKey задает ключ шифрования значений (см. OpenEncrypted). По
+	// умолчанию значения не шифруются.
+	EncryptionKey []byte
+	// AllocStrategy задает стратегию выделения свободного места в файле. По
+	// умолчанию используется BestFit.
+	AllocStrategy AllocStrategy
+	// Loader задает функцию загрузки отсутствующих значений (см.
+	// db.SetLoader). По умолчанию не используется.
+	Loader Loader
+	// FileMode задает права доступа к файлу хранилища, если он создается при
+	// открытии. По умолчанию используется 0666.
+	FileMode os.FileMode
+	// DirMode задает права доступа к каталогам, которые создаются для файла
+	// хранилища. По умолчанию используется 0777.
+	DirMode os.FileMode
+	// UseMmap включает чтение значений через отображение файла в память (см.
+	// db.SetMmap). По умолчанию значения читаются из файла.
+	UseMmap bool
+	// InitialSize задает размер, до которого файл хранилища заранее
+	// увеличивается при открытии (см. db.Preallocate). Для хранилища,
+	// открытого только для чтения, не используется.
+	InitialSize int64
+	// ParallelWrites включает параллельную запись значений (см.
+	// db.SetParallelWrites). По умолчанию запись выполняется последовательно.
+	ParallelWrites bool
+	// Metrics задает получателя статистики операций с хранилищем (см.
+	// db.SetMetrics). По умолчанию статистика не собирается.
+	Metrics Metrics
+	// Logger задает журнал для отладочных сообщений и предупреждений о работе
+	// хранилища (см. db.SetLogger). По умолчанию журнал не используется.
+	Logger *slog.Logger
+	// JSONOnly разрешает сохранять в хранилище только значения в формате
+	// JSON (см. db.SetJSONOnly). По умолчанию значения не проверяются.
+	JSONOnly bool
+	// MaxFreeSlots ограничивает количество свободных мест в файле, которые
+	// хранятся в памяти для повторного использования (см.
+	// db.SetMaxFreeSlots). По умолчанию количество не ограничено.
+	MaxFreeSlots int
+	// SoftDelete включает режим, в котором удаленные значения не стираются, а
+	// помещаются в корзину до окончательного удаления (см. db.SetSoftDelete).
+	SoftDelete bool
+	// MaxValueSize ограничивает размер сохраняемых значений (см.
+	// db.SetMaxValueSize). По умолчанию размер не ограничен.
+	MaxValueSize uint32
+	// MaxFileSize ограничивает размер файла хранилища (см.
+	// db.SetMaxFileSize). По умолчанию размер не ограничен.
+	MaxFileSize int64
+	// AutoCompact задает долю свободного места в файле, при превышении
+	// которой хранилище автоматически сжимается в фоне (см.
+	// db.SetAutoCompact). По умолчанию автоматическое сжатие не используется.
+	AutoCompact float64
+}
+
+// fileMode возвращает права доступа к создаваемому файлу хранилища.
+func (o *Options) fileMode() os.FileMode {
+	if o.FileMode == 0 {
+		return defaultFileMode
+	}
+	return o.FileMode
+}
+
+// dirMode возвращает права доступа к создаваемым каталогам.
+func (o *Options) dirMode() os.FileMode {
+	if o.DirMode == 0 {
+		return defaultDirMode
+	}
+	return o.DirMode
+}
+
+// cipher возвращает шифр для ключа шифрования или nil, если ключ не задан.
+func (o *Options) cipher() (cipher.AEAD, error) {
+	if o.EncryptionKey == nil {
+		return nil, nil
+	}
+	return newCipher(o.EncryptionKey)
+}
+
+// apply устанавливает параметры только что открытого хранилища.
+func (o *Options) apply(db *DB) error {
+	db.SetSyncPolicy(o.SyncPolicy, o.SyncInterval)
+	db.SetCompression(o.Compression)
+	if o.CompressionThreshold > 0 {
+		db.SetCompressionThreshold(o.CompressionThreshold)
+	}
+	db.SetAllocStrategy(o.AllocStrategy)
+	db.SetLoader(o.Loader)
+	db.SetMmap(o.UseMmap)
+	db.SetParallelWrites(o.ParallelWrites)
+	db.SetMetrics(o.Metrics)
+	db.SetJSONOnly(o.JSONOnly)
+	db.SetMaxFreeSlots(o.MaxFreeSlots)
+	db.SetSoftDelete(o.SoftDelete)
+	db.SetMaxValueSize(o.MaxValueSize)
+	db.SetMaxFileSize(o.MaxFileSize)
+	db.SetAutoCompact(o.AutoCompact)
+	db.SetLogger(o.Logger)
+	db.logLoad()
+	if o.InitialSize > 0 && !db.ro {
+		return db.Preallocate(o.InitialSize)
+	}
+	return nil
+}
+
+// OpenWithOptions открывает хранилище с указанными параметрами. Вызов с nil
+// вместо параметров полностью соответствует Open.
+//
+// Параметры используются только при открытии файла: если хранилище уже было
+// открыто ранее, то возвращается ссылка на него с прежними настройками, как и
+// в случае Open. При этом проверяется только то, что ключ шифрования
+// подходит к уже открытому хранилищу.
+func OpenWithOptions(filename string, opts *Options) (*DB, error) {
+	if opts == nil {
+		opts = new(Options)
+	}
+	if !opts.ReadOnly {
+		return openShared(context.Background(), filename, opts)
+	}
+	aead, err := opts.cipher()
+	if err != nil {
+		return nil, err
+	}
+	db, err := open(context.Background(), osFileOpener(opts.fileMode()),
+		filename, true, aead)
+	if err != nil {
+		return nil, err
+	}
+	if err = opts.apply(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
@@ -0,0 +1,99 @@
+package keystore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestOpenWithOptions(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("unix permissions not supported")
+	}
+	var dir = filepath.Join("db", "private")
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	var filename = filepath.Join(dir, "options.db")
+	db, err := OpenWithOptions(filename, &Options{FileMode: 0600, DirMode: 0700})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("bad file mode: %v", perm)
+	}
+	if info, err = os.Stat(dir); err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0700 {
+		t.Errorf("bad dir mode: %v", perm)
+	}
+	// повторное открытие возвращает то же хранилище
+	same, err := OpenWithOptions(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same != db {
+		t.Error("store reopened")
+	}
+}
+
+func TestOptions(t *testing.T) {
+	var filename = filepath.Join("db", "options.db")
+	os.Remove(filename)
+	defer os.Remove(filename)
+	var secret = []byte("0123456789abcdef")
+	db, err := OpenWithOptions(filename, &Options{
+		SyncPolicy:           SyncNever,
+		Compression:          CompressionGzip,
+		CompressionThreshold: 10,
+		EncryptionKey:        secret,
+		AllocStrategy:        BestFitSplit,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.policy != SyncNever || db.compress != CompressionGzip ||
+		db.minsize != 10 || db.aead == nil || db.alloc != BestFitSplit {
+		t.Fatalf("options not applied: %v %v %v %v", db.policy, db.compress,
+			db.minsize, db.alloc)
+	}
+	if err := db.Put("key", []byte("value value value value")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenWithOptions(filename, &Options{EncryptionKey: []byte("fedcba9876543210")}); !errors.Is(err, ErrBadKey) {
+		t.Fatal("bad key error:", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// значения по умолчанию
+	db, err = OpenWithOptions(filename, &Options{EncryptionKey: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.policy != SyncAlways || db.compress != CompressionNone ||
+		db.alloc != BestFit {
+		t.Fatal("bad default options")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ro, err := OpenWithOptions(filename, &Options{ReadOnly: true, EncryptionKey: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if value, err := ro.Get("key"); err != nil || string(value) != "value value value value" {
+		t.Fatalf("bad value: %q, %v", value, err)
+	}
+	if err := ro.Put("key", nil); err != ErrReadOnly {
+		t.Fatal("bad read only error:", err)
+	}
+}
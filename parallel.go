@@ -0,0 +1,122 @@
+package keystore
+
+import "sync"
+
+// writeShards задает количество блокировок ключей при параллельной записи.
+const writeShards = 64
+
+// SetParallelWrites включает или выключает параллельную запись значений с
+// помощью Put и PutX.
+//
+// Обычно запись выполняется целиком под одной блокировкой хранилища, поэтому
+// одновременная запись из нескольких горутин выполняется последовательно. При
+// параллельной записи под общей блокировкой только выделяется место в файле
+// и обновляется индекс, а сжатие, шифрование, запись данных в файл и сброс их
+// на диск выполняются параллельно. Запись значений с одним и тем же ключом по
+// прежнему выполняется последовательно: ключи распределяются между
+// несколькими блокировками по их хешу.
+//
+// Индекс хранилища остается общим, поэтому Keys, Range и другие методы
+// по-прежнему видят согласованный отсортированный список всех ключей.
+// Значение становится видимым для чтения только после того, как оно
+// полностью записано в файл. Остальные методы записи, такие как Append или
+// CompareAndSwap, всегда выполняются под общей блокировкой. Если они
+// добавляют записи в конец файла во время параллельной записи, то конец
+// данных в заголовке файла охватит их только после завершения начатых ранее
+// Put, поэтому до этого момента при сбое такие записи могут быть потеряны.
+//
+// Наибольший выигрыш параллельная запись дает при политиках SyncNever и
+// SyncEveryInterval: при SyncAlways сброс данных на диск, который сдвигает
+// конец данных, по-прежнему выполняется под общей блокировкой.
+func (db *DB) SetParallelWrites(parallel bool) {
+	db.pmu.Lock()
+	defer db.pmu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !parallel {
+		db.shards, db.pending = nil, nil
+	} else if db.shards == nil {
+		db.shards = make([]sync.Mutex, writeShards)
+		db.pending = make(map[uint32]bool)
+		db.written = sync.NewCond(&db.mu)
+	}
+}
+
+// shard возвращает блокировку для записи значения с указанным ключом.
+func (db *DB) shard(key string) *sync.Mutex {
+	var hash uint32 = 2166136261 // FNV-1a
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return &db.shards[hash%uint32(len(db.shards))]
+}
+
+// putParallel сохраняет значение с указанным ключом при параллельной записи.
+// Вызывающий должен удерживать блокировку db.pmu на чтение.
+func (db *DB) putParallel(key string, value []byte) (created bool, err error) {
+	var shard = db.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	// сжатие и шифрование не изменяют состояние хранилища
+	db.mu.RLock()
+	var data []byte
+	var flags uint8
+	err = db.checkPut(key, value)
+	if err == nil {
+		data, flags, err = db.encode(key, value)
+	}
+	old, exists := db.indexes[key]
+	var policy = db.policy
+	db.mu.RUnlock()
+	if err != nil {
+		return false, err
+	}
+	if exists && len(value) == 0 && old.DataSize == 0 {
+		return false, nil // не требуется перезапись пустого значения
+	}
+	// выделяем место: пока запись не сохранена, конец данных в заголовке
+	// файла не может ее охватывать
+	db.mu.Lock()
+	index, reused, err := db.reserve(key, data, flags)
+	var pending = err == nil && int64(index.Offset) >= db.stored
+	if pending {
+		db.pending[index.Offset] = true
+	}
+	db.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	// записываем данные без общей блокировки
+	err = db.store(index, key, data)
+	if err == nil && policy == SyncAlways {
+		err = db.f.Sync()
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if pending {
+		delete(db.pending, index.Offset)
+		defer db.written.Broadcast() // конец данных мог сдвинуться
+	}
+	if err == nil {
+		err = db.commitEnd()
+	}
+	if err != nil {
+		db.release(index)
+		_ = db.commitEnd() // запись больше не задерживает остальные
+		return false, err
+	}
+	// при политике SyncAlways запись должна сохраниться после возврата из
+	// Put, поэтому ждем, пока конец данных в заголовке файла не охватит ее:
+	// его сдвигает последняя из завершившихся записей, выделенных раньше
+	for policy == SyncAlways && db.endAt != 0 &&
+		db.stored < int64(db.end(index)) {
+		db.written.Wait()
+	}
+	db.observePut(key, index, reused, len(data))
+	_, exists = db.indexes[key]
+	if err = db.publish(key, index, value); err != nil {
+		return false, err
+	}
+	return !exists, db.flush()
+}
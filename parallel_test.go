@@ -0,0 +1,161 @@
+package keystore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParallelWrites(t *testing.T) {
+	var filename = filepath.Join("db", "parallel.db")
+	os.Remove(filename)
+	defer os.Remove(filename)
+	db, err := OpenWithOptions(filename, &Options{ParallelWrites: true,
+		SyncPolicy: SyncNever, Compression: CompressionGzip,
+		CompressionThreshold: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				// часть ключей записывается одновременно несколькими горутинами
+				var key = fmt.Sprintf("key%03d", (g%4)*100+i)
+				var value = bytes.Repeat([]byte(key), 1+i%20)
+				if _, err := db.PutX(key, value); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	var keys = db.Keys("", "", 0, 0, true)
+	if len(keys) != 400 || !sort.StringsAreSorted(keys) {
+		t.Fatalf("bad keys: %d", len(keys))
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenReadOnly(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if len(db.LoadWarnings()) != 0 {
+		t.Fatalf("duplicate records: %v", db.LoadWarnings())
+	}
+	for i, key := range db.Keys("", "", 0, 0, true) {
+		value, err := db.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(value, bytes.Repeat([]byte(key), 1+i%100%20)) {
+			t.Fatalf("bad value %q: %q", key, value)
+		}
+	}
+}
+
+// blockFile задерживает запись данных, содержащих block, до закрытия
+// канала release.
+type blockFile struct {
+	File
+	block   []byte
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (f *blockFile) WriteAt(p []byte, off int64) (int, error) {
+	if bytes.Contains(p, f.block) {
+		close(f.blocked)
+		<-f.release
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func TestParallelDataEnd(t *testing.T) {
+	var file = &blockFile{File: newMemFile("parallel"), block: []byte("slow"),
+		blocked: make(chan struct{}), release: make(chan struct{})}
+	db, err := loadFile(context.Background(), file, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetParallelWrites(true) // с политикой SyncAlways
+	var slow = make(chan error)
+	go func() { slow <- db.Put("slow", []byte("value")) }()
+	<-file.blocked
+	var fast = make(chan error)
+	go func() { fast <- db.Put("fast", []byte("value")) }()
+	// запись за еще не записанной не завершается, пока конец данных в
+	// заголовке не может ее охватить
+	select {
+	case err := <-fast:
+		t.Fatalf("write completed before previous one: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if db.Has("slow") {
+		t.Fatal("value visible before write")
+	}
+	close(file.release)
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-fast; err != nil {
+		t.Fatal(err)
+	}
+	if db.stored != db.size {
+		t.Fatalf("bad data end: %d of %d", db.stored, db.size)
+	}
+	if db, err = loadFile(context.Background(), file.File, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if db.Count() != 2 {
+		t.Fatalf("bad count: %d", db.Count())
+	}
+}
+
+// BenchmarkPutParallel записывает значения из нескольких горутин с
+// параллельной записью и без нее.
+func BenchmarkPutParallel(b *testing.B) {
+	var filename = filepath.Join("db", "parallel.db")
+	for _, parallel := range []bool{false, true} {
+		b.Run(fmt.Sprintf("parallel=%v", parallel), func(b *testing.B) {
+			os.Remove(filename)
+			defer os.Remove(filename)
+			db, err := OpenWithOptions(filename, &Options{SyncPolicy: SyncNever,
+				ParallelWrites: parallel})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			var value = make([]byte, 4096)
+			var mu sync.Mutex
+			var n int
+			b.SetParallelism(4)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					mu.Lock()
+					n++
+					var key = fmt.Sprintf("key%d", n)
+					mu.Unlock()
+					if err := db.Put(key, value); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
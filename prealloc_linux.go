@@ -0,0 +1,18 @@
+package keystore
+
+import "syscall"
+
+// fallocate выделяет на диске место для length байт файла, начиная со
+// смещения offset, и при необходимости увеличивает размер файла.
+func fallocate(file File, offset, length int64) error {
+	f, ok := file.(interface{ Fd() uintptr })
+	if !ok {
+		return errPreallocUnsupported
+	}
+	for {
+		err := syscall.Fallocate(int(f.Fd()), 0, offset, length)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
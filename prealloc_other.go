@@ -0,0 +1,8 @@
+//go:build !linux
+
+package keystore
+
+// fallocate не поддерживается на этой платформе и всегда возвращает ошибку.
+func fallocate(file File, offset, length int64) error {
+	return errPreallocUnsupported
+}
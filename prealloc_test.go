@@ -0,0 +1,87 @@
+package keystore
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreallocate(t *testing.T) {
+	var filename = filepath.Join("db", "prealloc.db")
+	os.Remove(filename)
+	defer os.Remove(filename)
+	const size = 1 << 16
+	db, err := OpenWithOptions(filename, &Options{InitialSize: size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filename); err != nil || info.Size() != size {
+		t.Fatalf("bad file size: %v", err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Put(key, []byte("value "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// удаление последней записи не затрагивает зарезервированное место
+	if err := db.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filename); err != nil || info.Size() != size {
+		t.Fatalf("bad file size after close: %v", err)
+	}
+	if db, err = OpenReadOnly(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.Count() != 2 || !db.Has("a") || !db.Has("b") {
+		t.Fatalf("bad keys: %v", db.Keys("", "", 0, 0, true))
+	}
+	if slots := db.DeletedSlots(); len(slots) != 0 {
+		t.Fatalf("preallocated space used as free slots: %v", slots)
+	}
+	if err := db.Preallocate(2 * size); err != ErrReadOnly {
+		t.Fatalf("bad read-only error: %v", err)
+	}
+}
+
+func TestPreallocateTruncate(t *testing.T) {
+	// файл без поддержки fallocate просто увеличивается
+	var file = newMemFile("prealloc")
+	db, err := loadFile(context.Background(), file, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Preallocate(1024); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := file.Seek(0, io.SeekEnd); size != 1024 {
+		t.Fatalf("bad file size: %d", size)
+	}
+	if err := db.Preallocate(100); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("next", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := file.Seek(0, io.SeekEnd); size != 1024 {
+		t.Fatalf("file grown: %d", size)
+	}
+	if db, err = loadFile(context.Background(), file, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if db.Count() != 2 {
+		t.Fatalf("bad count: %d", db.Count())
+	}
+}
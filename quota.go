@@ -0,0 +1,36 @@
+package keystore
+
+import "errors"
+
+// ErrQuotaExceeded возвращается, если для записи значения пришлось бы
+// увеличить файл хранилища больше ограничения, заданного db.SetMaxFileSize.
+var ErrQuotaExceeded = errors.New("store quota exceeded")
+
+// SetMaxFileSize ограничивает размер файла хранилища size байтами. Запись
+// значения, которое не помещается ни в одно из свободных мест и должно быть
+// добавлено в конец файла, завершается ошибкой ErrQuotaExceeded, если конец
+// данных при этом оказался бы дальше size. Запись на место удаленных
+// значений по-прежнему разрешена, так как не увеличивает файл. По умолчанию
+// (size равно 0) размер не ограничен.
+//
+// Ограничение проверяется по концу данных в файле, который отслеживается
+// при записи, поэтому место, зарезервированное с помощью db.Preallocate, в
+// нем не учитывается. Если файл уже больше ограничения, то он не
+// уменьшается, но новые значения в конец файла не добавляются. Удаление
+// значений освобождает место для записи новых, а удаление последних записей
+// в файле (в том числе окончательное удаление из корзины с помощью
+// db.Purge) укорачивает сам файл. Сжатие хранилища (см. db.Compact и
+// db.SetAutoCompact) удаляет из файла все свободное место и возвращает его
+// размер в пределы ограничения, если его превышали только удаленные записи.
+//
+// Новое значение существующего ключа записывается раньше, чем удаляется
+// прежнее, поэтому перезапись значения большего размера может завершиться
+// ошибкой, даже если после удаления прежнего значения новое уместилось бы.
+func (db *DB) SetMaxFileSize(size int64) {
+	if size < 0 {
+		size = 0
+	}
+	db.mu.Lock()
+	db.maxfile = size
+	db.mu.Unlock()
+}
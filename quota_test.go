@@ -0,0 +1,64 @@
+package keystore
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMaxFileSize(t *testing.T) {
+	var filename = "db/quota.db"
+	os.Remove(filename)
+	if err := os.MkdirAll("db", 0777); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filename)
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var value = make([]byte, 100)
+	for _, key := range []string{"a", "b"} {
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var size = db.size
+	db.SetMaxFileSize(size + 50)
+	if err := db.Put("c", value); err != ErrQuotaExceeded {
+		t.Fatalf("bad quota error: %v", err)
+	}
+	if db.Has("c") || db.size != size {
+		t.Fatal("value saved over quota:", db.size)
+	}
+	// запись на место удаленного значения не увеличивает файл
+	if err := db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("c", value); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("d", value[:10]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("e", value); err != ErrQuotaExceeded {
+		t.Fatalf("bad quota error: %v", err)
+	}
+	// удаление последней записи укорачивает файл
+	if err := db.Delete("d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("e", value[:20]); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filename); err != nil || info.Size() > size+50 {
+		t.Fatal("file size over quota:", info.Size(), err)
+	}
+	db.SetMaxFileSize(0)
+	if err := db.Put("f", value); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
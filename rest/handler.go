@@ -0,0 +1,220 @@
+// Package rest предоставляет HTTP-обработчик, открывающий доступ к хранилищу
+// keystore в виде REST API.
+//
+// Обработчик вынесен в отдельный пакет, чтобы программы, которые используют
+// только само хранилище, не зависели от net/http.
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/mdigger/keystore"
+)
+
+// Handler возвращает HTTP-обработчик для работы с хранилищем db:
+//
+//	GET    /{key}   возвращает значение с указанным ключом
+//	PUT    /{key}   сохраняет тело запроса как значение с указанным ключом
+//	DELETE /{key}   удаляет значение с указанным ключом
+//	GET    /        возвращает список ключей и значений в формате JSON
+//
+// Ключ задается путем запроса без начального слеша и может содержать любые
+// символы, в том числе экранированные (например, %2F для слеша). Для
+// подключения обработчика не к корню сайта используйте http.StripPrefix.
+//
+// Значения отдаются с помощью http.ServeContent, поэтому поддерживаются
+// запросы HEAD, частичная загрузка и проверка If-Modified-Since по времени
+// сохранения значения.
+//
+// Выборка списка ключей задается параметрами запроса prefix, last, offset,
+// limit и asc, которые соответствуют параметрам db.Keys (по умолчанию ключи
+// сортируются по возрастанию). Список возвращается в виде массива объектов с
+// полями key и value, поэтому все выбранные значения должны быть в формате
+// JSON (см. db.GetsJSON).
+//
+// Если значения с ключом нет или оно удалено в корзину (см.
+// db.SetSoftDelete), то возвращается статус 404, для пустого или слишком
+// длинного ключа, неверных параметров запроса и записи значения не в формате
+// JSON в хранилище с db.SetJSONOnly — 400, для значения больше допустимого
+// размера (см. db.SetMaxValueSize) — 413, при превышении размера файла
+// хранилища (см. db.SetMaxFileSize) — 507, а при записи в хранилище,
+// открытое только для чтения, — 403.
+func Handler(db *keystore.DB) http.Handler {
+	return &handler{db: db}
+}
+
+// handler обрабатывает HTTP-запросы к хранилищу.
+type handler struct {
+	db *keystore.DB
+}
+
+// ServeHTTP обрабатывает запрос.
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if key == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		h.list(w, r)
+		return
+	}
+	if key == "" {
+		err = keystore.ErrEmptyKey
+	} else if len(key) > keystore.MaxKeySize {
+		err = keystore.ErrKeyTooLong
+	}
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		err = h.get(w, r, key)
+	case http.MethodPut:
+		err = h.put(w, r, key)
+		// в отличие от чтения, здесь неверный JSON — ошибка запроса, а не
+		// данных в хранилище
+		if errors.Is(err, keystore.ErrInvalidJSON) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		err = h.db.Delete(key)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return
+	}
+	switch {
+	case err != nil:
+		httpError(w, err)
+	case r.Method == http.MethodPut || r.Method == http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// get отдает значение с указанным ключом.
+func (h *handler) get(w http.ResponseWriter, r *http.Request, key string) error {
+	// значение читается в память целиком, так как иначе оно может быть
+	// изменено другим запросом прямо во время отдачи
+	value, err := h.db.Get(key)
+	if err != nil {
+		return err
+	}
+	modtime, err := h.db.ModTime(key)
+	if err != nil {
+		return err
+	}
+	http.ServeContent(w, r, "", modtime, bytes.NewReader(value))
+	return nil
+}
+
+// put сохраняет тело запроса как значение с указанным ключом.
+//
+// Тело запроса читается в память целиком до записи в хранилище: иначе
+// медленный клиент удерживал бы блокировку хранилища все время передачи
+// данных. Размер тела ограничивается размером значения, установленным
+// db.SetMaxValueSize, а если он не задан — максимальным размером записи.
+func (h *handler) put(w http.ResponseWriter, r *http.Request, key string) error {
+	var limit = int64(h.db.MaxValueSize())
+	if limit == 0 {
+		limit = math.MaxUint32 - int64(len(key))
+	}
+	if r.ContentLength > limit {
+		return keystore.ErrValueTooLarge
+	}
+	value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return keystore.ErrValueTooLarge
+		}
+		return err
+	}
+	return h.db.Put(key, value)
+}
+
+// item описывает элемент списка ключей со значениями.
+type item struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// list отдает список ключей со значениями, выбранный по параметрам запроса.
+func (h *handler) list(w http.ResponseWriter, r *http.Request) {
+	var query = r.URL.Query()
+	offset, err := parseUint32(query.Get("offset"), 0)
+	if err != nil {
+		http.Error(w, "bad offset: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := parseUint32(query.Get("limit"), 0)
+	if err != nil {
+		http.Error(w, "bad limit: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var asc = true
+	if value := query.Get("asc"); value != "" {
+		if asc, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, "bad asc: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var keys = h.db.Keys(query.Get("prefix"), query.Get("last"),
+		offset, limit, asc)
+	values, err := h.db.GetsJSON(keys...)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	var items = make([]item, len(keys))
+	for i, key := range keys {
+		items[i] = item{Key: key, Value: values[i]}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	_ = json.NewEncoder(w).Encode(items)
+}
+
+// parseUint32 разбирает число из параметра запроса. Для пустого значения
+// возвращается def.
+func parseUint32(value string, def uint32) (uint32, error) {
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseUint(value, 10, 32)
+	return uint32(n), err
+}
+
+// httpError отдает ошибку хранилища с соответствующим ей статусом ответа.
+func httpError(w http.ResponseWriter, err error) {
+	var code = http.StatusInternalServerError
+	switch {
+	case errors.Is(err, keystore.ErrNotFound),
+		errors.Is(err, keystore.ErrDeleted):
+		code = http.StatusNotFound
+	case errors.Is(err, keystore.ErrEmptyKey),
+		errors.Is(err, keystore.ErrKeyTooLong),
+		errors.Is(err, keystore.ErrSizeMismatch):
+		code = http.StatusBadRequest
+	case errors.Is(err, keystore.ErrValueTooLarge):
+		code = http.StatusRequestEntityTooLarge
+	case errors.Is(err, keystore.ErrReadOnly):
+		code = http.StatusForbidden
+	case errors.Is(err, keystore.ErrQuotaExceeded):
+		code = http.StatusInsufficientStorage
+	}
+	http.Error(w, err.Error(), code)
+}
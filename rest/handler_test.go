@@ -0,0 +1,183 @@
+package rest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdigger/keystore"
+)
+
+func TestHandler(t *testing.T) {
+	db, err := keystore.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var server = httptest.NewServer(Handler(db))
+	defer server.Close()
+
+	// do выполняет запрос и возвращает статус и тело ответа
+	var do = func(method, path, body string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(data)
+	}
+
+	for _, test := range []struct {
+		method, path, body string
+		code               int
+		response           string
+	}{
+		{"PUT", "/a", `"value a"`, 204, ""},
+		{"PUT", "/dir%2Fb", `{"b":1}`, 204, ""},
+		{"PUT", "/c%20d", `[1,2]`, 204, ""},
+		{"GET", "/a", "", 200, `"value a"`},
+		{"GET", "/dir%2Fb", "", 200, `{"b":1}`},
+		{"GET", "/dir/b", "", 200, `{"b":1}`},
+		{"GET", "/c%20d", "", 200, `[1,2]`},
+		{"GET", "/none", "", 404, ""},
+		{"DELETE", "/none", "", 404, ""},
+		{"PUT", "/" + strings.Repeat("k", keystore.MaxKeySize+1), "x", 400, ""},
+		{"GET", "/" + strings.Repeat("k", keystore.MaxKeySize+1), "", 400, ""},
+		{"PUT", "/", "x", 400, ""},
+		{"POST", "/a", "x", 405, ""},
+		{"GET", "/?limit=x", "", 400, ""},
+		{"GET", "/", "", 200,
+			`[{"key":"a","value":"value a"},{"key":"c d","value":[1,2]},{"key":"dir/b","value":{"b":1}}]`},
+		{"GET", "/?prefix=d", "", 200, `[{"key":"dir/b","value":{"b":1}}]`},
+		{"GET", "/?asc=false&limit=1", "", 200, `[{"key":"dir/b","value":{"b":1}}]`},
+		{"GET", "/?last=a&offset=1", "", 200, `[{"key":"dir/b","value":{"b":1}}]`},
+		{"DELETE", "/a", "", 204, ""},
+		{"GET", "/a", "", 404, ""},
+	} {
+		code, body := do(test.method, test.path, test.body)
+		if code != test.code {
+			t.Errorf("%s %s: bad status %d: %s", test.method, test.path, code, body)
+			continue
+		}
+		if test.response != "" && strings.TrimSpace(body) != test.response {
+			t.Errorf("%s %s: bad response: %s", test.method, test.path, body)
+		}
+	}
+
+	// значение в корзине отсутствует так же, как и просто удаленное
+	db.SetSoftDelete(true)
+	if err := db.Put("trash", []byte(`"value"`)); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := do("DELETE", "/trash", ""); code != 204 {
+		t.Errorf("bad status for soft delete: %d", code)
+	}
+	if code, _ := do("GET", "/trash", ""); code != 404 {
+		t.Errorf("bad status for deleted value: %d", code)
+	}
+	db.SetSoftDelete(false)
+
+	// размер тела запроса ограничивается и без указания его длины
+	db.SetMaxValueSize(4)
+	if code, _ := do("PUT", "/big", "12345"); code != 413 {
+		t.Errorf("bad status for too large value: %d", code)
+	}
+	req, err := http.NewRequest("PUT", server.URL+"/big",
+		io.MultiReader(strings.NewReader("12345")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if req.ContentLength != 0 || resp.StatusCode != 413 {
+		t.Errorf("bad status for too large chunked value: %d", resp.StatusCode)
+	}
+	if code, _ := do("PUT", "/big", "1234"); code != 204 {
+		t.Errorf("bad status for value within limit: %d", code)
+	}
+	db.SetMaxValueSize(0)
+
+	// хранилище принимает только значения в формате JSON
+	db.SetJSONOnly(true)
+	if code, _ := do("PUT", "/json", "not json"); code != 400 {
+		t.Errorf("bad status for invalid JSON: %d", code)
+	}
+	db.SetJSONOnly(false)
+
+	// файл хранилища не может превышать заданный размер
+	db.SetMaxFileSize(db.Stats().Size)
+	if code, _ := do("PUT", "/quota", strings.Repeat("1", 1000)); code != 507 {
+		t.Errorf("bad status for exceeded quota: %d", code)
+	}
+	db.SetMaxFileSize(0)
+
+	// медленный клиент не блокирует запись в хранилище
+	var pr, pw = io.Pipe()
+	if req, err = http.NewRequest("PUT", server.URL+"/slow", pr); err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = 10
+	var done = make(chan int)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			close(done)
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	if _, err := pw.Write([]byte("12345")); err != nil {
+		t.Fatal(err)
+	}
+	var put = make(chan error)
+	go func() { put <- db.Put("fast", []byte("1")) }()
+	select {
+	case err := <-put:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("put blocked by slow request")
+	}
+	if _, err := pw.Write([]byte("67890")); err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+	if code := <-done; code != 204 {
+		t.Errorf("bad status for slow request: %d", code)
+	}
+
+	// список с не JSON значениями не может быть отдан
+	if err := db.Put("binary", []byte{0xff}); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := do("GET", "/", ""); code != 500 {
+		t.Errorf("bad status for not JSON values: %d", code)
+	}
+	var items []item
+	code, body := do("GET", "/?prefix=c", "")
+	if err := json.Unmarshal([]byte(body), &items); err != nil || code != 200 {
+		t.Fatalf("bad list: %d, %s, %v", code, body, err)
+	}
+	if len(items) != 1 || items[0].Key != "c d" {
+		t.Errorf("bad items: %v", items)
+	}
+}
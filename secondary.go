@@ -0,0 +1,403 @@
+package keystore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ErrNoIndex возвращается QueryIndex, если вторичный индекс с таким именем не
+// был добавлен с помощью AddIndex.
+var ErrNoIndex = errors.New("index not found")
+
+// ErrBadIndexName возвращается AddIndex для пустого имени индекса или имени,
+// которое не может быть использовано в имени файла.
+var ErrBadIndexName = errors.New("invalid index name")
+
+// secondaryIndexes описывает вторичные индексы хранилища по их именам.
+type secondaryIndexes map[string]*secondaryIndex
+
+// secondaryIndex описывает вторичный индекс: для каждого значения, которое
+// возвращает функция extract, в отдельном хранилище сохраняется
+// отсортированный список ключей, значения которых его содержат.
+type secondaryIndex struct {
+	extract func(value []byte) [][]byte // выделение значений для индекса
+	db      *DB                         // хранилище с индексом
+	saved   bool                        // индекс хранится в файле
+}
+
+// Ключи в хранилище вторичного индекса. Значения индекса сохраняются с
+// префиксом termPrefix, чтобы не пересекаться с ключом состояния индекса.
+const (
+	indexStateKey = "\x00" // отпечаток данных, по которым построен индекс
+	termPrefix    = "\x01" // префикс ключей со значениями индекса
+)
+
+// AddIndex добавляет вторичный индекс с указанным именем, который позволяет
+// искать ключи по значениям, выделенным из сохраненных данных функцией
+// extract, например, по полю JSON. Функция вызывается для каждого
+// сохраняемого значения и должна возвращать список значений для индекса
+// (terms): пустые значения и значения длиннее MaxKeySize-1 байт в индекс не
+// попадают. Функция вызывается под блокировкой хранилища и не должна к нему
+// обращаться.
+//
+// Индекс обновляется при каждом сохранении и удалении значений. Функции
+// выделения значений нельзя сохранить в файле, поэтому индексы нужно
+// добавлять заново при каждом открытии хранилища. Повторный вызов с тем же
+// именем заменяет функцию и перестраивает индекс.
+//
+// Для хранилища в обычном файле индекс сохраняется рядом с ним в файле с
+// расширением ".<name>.idx", который сам является хранилищем keystore: ключами
+// в нем служат значения индекса, а значениями — упакованные списки ключей
+// основного хранилища. Если при добавлении индекса этот файл соответствует
+// данным хранилища, то он используется без построения индекса заново. Если
+// же функция выделения значений изменилась, то индекс нужно перестроить с
+// помощью RebuildIndex.
+//
+// Соответствие файла индекса данным отслеживается по отпечатку индексной
+// информации всех записей хранилища (смещения, размеры и время записи), который
+// сохраняется в файле индекса только при закрытии хранилища, после сброса его
+// данных на диск. При подключении индекса отпечаток удаляется, поэтому после
+// сбоя или закрытия без сохранения отпечатка, а также после изменения
+// хранилища без подключенного индекса он не совпадет с данными и индекс будет
+// построен заново по всем значениям.
+//
+// Для хранилищ в памяти, открытых только для чтения или с шифрованием
+// значений (чтобы не сохранять их части в открытом виде) индекс хранится
+// только в памяти и строится заново при каждом добавлении.
+//
+// Если при обновлении индекса произошла ошибка, то она возвращается методом
+// записи, хотя само значение уже сохранено. В этом случае индекс следует
+// перестроить с помощью RebuildIndex.
+func (db *DB) AddIndex(name string, extract func(value []byte) [][]byte) error {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") {
+		return ErrBadIndexName
+	}
+	db.pmu.Lock()
+	defer db.pmu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return &os.PathError{Op: "index", Path: db.Path(), Err: ErrClosed}
+	}
+	var idx = db.lookups[name]
+	if idx != nil {
+		idx.extract = extract
+		return idx.rebuild(db)
+	}
+	idx, err := db.openIndex(name)
+	if err != nil {
+		return err
+	}
+	idx.extract = extract
+	if idx.current(db) {
+		err = idx.markDirty() // индекс будет изменяться вместе с данными
+	} else {
+		err = idx.rebuild(db)
+	}
+	if err != nil {
+		_ = idx.db.Close()
+		return err
+	}
+	if db.lookups == nil {
+		db.lookups = make(secondaryIndexes)
+	}
+	db.lookups[name] = idx
+	return nil
+}
+
+// RebuildIndex строит вторичный индекс с указанным именем заново по всем
+// значениям хранилища. Это необходимо, если функция выделения значений для
+// индекса изменилась, или после ошибки обновления индекса. Если индекса с
+// таким именем нет, то возвращается ошибка ErrNoIndex.
+func (db *DB) RebuildIndex(name string) error {
+	db.pmu.Lock()
+	defer db.pmu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	var idx = db.lookups[name]
+	if idx == nil {
+		return ErrNoIndex
+	}
+	return idx.rebuild(db)
+}
+
+// QueryIndex возвращает отсортированный список ключей, для значений которых
+// функция выделения индекса с указанным именем вернула term. Если индекса с
+// таким именем нет, то возвращается ошибка ErrNoIndex.
+func (db *DB) QueryIndex(name string, term []byte) ([]string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	var idx = db.lookups[name]
+	if idx == nil {
+		return nil, ErrNoIndex
+	}
+	return idx.query(string(term))
+}
+
+// openIndex открывает хранилище для вторичного индекса с указанным именем.
+func (db *DB) openIndex(name string) (*secondaryIndex, error) {
+	var (
+		idx = new(secondaryIndex)
+		err error
+	)
+	if _, ok := db.f.(*lockedFile); ok && !db.ro && db.aead == nil {
+		idx.db, err = open(context.Background(), openOSFile,
+			db.Path()+"."+name+".idx", false, nil)
+		idx.saved = true
+	} else {
+		idx.db, err = OpenMemory()
+	}
+	if err != nil {
+		return nil, err
+	}
+	// после сбоя индекс все равно строится заново, поэтому изменения
+	// сбрасываются на диск только при закрытии хранилища
+	idx.db.SetSyncPolicy(SyncNever, 0)
+	return idx, nil
+}
+
+// fingerprint возвращает отпечаток индексной информации всех записей
+// хранилища, который изменяется при любом сохранении или удалении значений.
+// Отпечаток не зависит от порядка ключей.
+func (db *DB) fingerprint() []byte {
+	var (
+		sum  uint64
+		hash = fnv.New64a()
+		buf  [13]byte
+	)
+	for key, index := range db.indexes {
+		hash.Reset()
+		_, _ = hash.Write([]byte(key))
+		binary.BigEndian.PutUint32(buf[0:], index.Offset)
+		binary.BigEndian.PutUint32(buf[4:], index.DataSize)
+		binary.BigEndian.PutUint32(buf[8:], index.Time)
+		buf[12] = index.Flags
+		_, _ = hash.Write(buf[:])
+		sum += hash.Sum64()
+	}
+	var data = make([]byte, 24)
+	binary.BigEndian.PutUint64(data, uint64(len(db.indexes)))
+	binary.BigEndian.PutUint64(data[8:], uint64(db.size))
+	binary.BigEndian.PutUint64(data[16:], sum)
+	return data
+}
+
+// current возвращает true, если сохраненный в файле индекс соответствует
+// данным хранилища db.
+func (idx *secondaryIndex) current(db *DB) bool {
+	if !idx.saved {
+		return false
+	}
+	state, err := idx.db.Get(indexStateKey)
+	return err == nil && bytes.Equal(state, db.fingerprint())
+}
+
+// markDirty удаляет из файла индекса отпечаток данных хранилища, чтобы после
+// сбоя индекс был построен заново.
+func (idx *secondaryIndex) markDirty() error {
+	if !idx.saved {
+		return nil
+	}
+	if err := idx.db.Delete(indexStateKey); err != nil && err != ErrNotFound {
+		return err
+	}
+	return idx.db.Sync()
+}
+
+// markClean сохраняет в файле индекса отпечаток данных хранилища, которым
+// индекс соответствует. Данные самого хранилища к этому моменту уже должны
+// быть сброшены на диск.
+func (idx *secondaryIndex) markClean(state []byte) error {
+	if !idx.saved {
+		return nil
+	}
+	if err := idx.db.Put(indexStateKey, state); err != nil {
+		return err
+	}
+	return idx.db.Sync()
+}
+
+// reindex обновляет все вторичные индексы после изменения значения с
+// указанным ключом. Значение nil для old или value означает отсутствие
+// значения до или после изменения.
+func (db *DB) reindex(key string, old, value []byte) error {
+	for _, idx := range db.lookups {
+		if err := idx.update(key, old, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexed возвращает текущее значение ключа для обновления вторичных
+// индексов. Если индексов нет или значения с таким ключом нет, то
+// возвращается nil.
+func (db *DB) indexed(key string) ([]byte, error) {
+	if len(db.lookups) == 0 {
+		return nil, nil
+	}
+	value, err := db.get(key)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	return value, err
+}
+
+// terms возвращает список уникальных значений для индекса, выделенных из
+// value. Для отсутствующего значения возвращается пустой список.
+func (idx *secondaryIndex) terms(value []byte) map[string]bool {
+	var terms = make(map[string]bool)
+	if value == nil {
+		return terms
+	}
+	for _, term := range idx.extract(value) {
+		if len(term) > 0 && len(term) < MaxKeySize {
+			terms[string(term)] = true
+		}
+	}
+	return terms
+}
+
+// rebuild строит индекс заново по всем значениям хранилища db. Отпечаток
+// данных в файле индекса при этом не сохраняется.
+func (idx *secondaryIndex) rebuild(db *DB) error {
+	var postings = make(map[string][]string)
+	for key := range db.indexes {
+		value, err := db.get(key)
+		if err != nil {
+			return err
+		}
+		for term := range idx.terms(value) {
+			postings[term] = append(postings[term], key)
+		}
+	}
+	if err := idx.db.Truncate(); err != nil {
+		return err
+	}
+	return idx.db.BulkLoad(func(put func(key string, value []byte) error) error {
+		for term, keys := range postings {
+			sort.Strings(keys)
+			if err := put(termPrefix+term, encodeKeys(keys)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// update обновляет индекс после изменения значения с указанным ключом.
+func (idx *secondaryIndex) update(key string, old, value []byte) error {
+	var removed, added = idx.terms(old), idx.terms(value)
+	for term := range added {
+		if removed[term] {
+			delete(removed, term) // значение для индекса не изменилось
+			delete(added, term)
+		}
+	}
+	for term := range removed {
+		keys, err := idx.query(term)
+		if err != nil {
+			return err
+		}
+		var i = sort.SearchStrings(keys, key)
+		if i == len(keys) || keys[i] != key {
+			continue
+		}
+		if keys = append(keys[:i], keys[i+1:]...); len(keys) == 0 {
+			err = idx.db.Delete(termPrefix + term)
+		} else {
+			err = idx.db.Put(termPrefix+term, encodeKeys(keys))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for term := range added {
+		keys, err := idx.query(term)
+		if err != nil {
+			return err
+		}
+		var i = sort.SearchStrings(keys, key)
+		if i < len(keys) && keys[i] == key {
+			continue
+		}
+		keys = append(keys, "")
+		copy(keys[i+1:], keys[i:])
+		keys[i] = key
+		if err := idx.db.Put(termPrefix+term, encodeKeys(keys)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// query возвращает отсортированный список ключей для значения индекса term.
+func (idx *secondaryIndex) query(term string) ([]string, error) {
+	data, err := idx.db.Get(termPrefix + term)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeKeys(data)
+}
+
+// encodeKeys кодирует список ключей: перед каждым ключом записывается его
+// длина.
+func encodeKeys(keys []string) []byte {
+	var size int
+	for _, key := range keys {
+		size += 1 + len(key)
+	}
+	var data = make([]byte, 0, size)
+	for _, key := range keys {
+		data = append(data, byte(len(key)))
+		data = append(data, key...)
+	}
+	return data
+}
+
+// decodeKeys декодирует список ключей, закодированный encodeKeys.
+func decodeKeys(data []byte) ([]string, error) {
+	var keys []string
+	for len(data) > 0 {
+		var size = int(data[0]) + 1
+		if size > len(data) {
+			return nil, ErrCorruptIndex
+		}
+		keys = append(keys, string(data[1:size]))
+		data = data[size:]
+	}
+	return keys, nil
+}
+
+// closeIndexes закрывает хранилища вторичных индексов. Если указан отпечаток
+// данных хранилища state, то перед закрытием он сохраняется в файлах
+// индексов.
+func closeIndexes(indexes secondaryIndexes, state []byte) error {
+	var err error
+	for _, idx := range indexes {
+		if state != nil {
+			if err2 := idx.markClean(state); err == nil {
+				err = err2
+			}
+		}
+		if err2 := idx.db.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
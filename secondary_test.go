@@ -0,0 +1,213 @@
+package keystore
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// cityIndex выделяет из значения в формате JSON поле city.
+func cityIndex(value []byte) [][]byte {
+	var v struct {
+		City string `json:"city"`
+	}
+	if json.Unmarshal(value, &v) != nil {
+		return nil
+	}
+	return [][]byte{[]byte(v.City)}
+}
+
+func TestSecondaryIndex(t *testing.T) {
+	var filename = "db/secondary.db"
+	os.RemoveAll(filename)
+	os.RemoveAll(filename + ".city.idx")
+	defer os.Remove(filename)
+	defer os.Remove(filename + ".city.idx")
+	db, err := OpenWithOptions(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var query = func(city string, keys ...string) {
+		t.Helper()
+		found, err := db.QueryIndex("city", []byte(city))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 0 || len(keys) != 0 {
+			if !reflect.DeepEqual(found, keys) {
+				t.Fatalf("bad keys for %q: %q", city, found)
+			}
+		}
+	}
+	for key, city := range map[string]string{
+		"alice": "Moscow", "bob": "Paris", "carol": "Moscow",
+	} {
+		if err := db.PutJSON(key, map[string]string{"city": city}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("binary", []byte{0xff}); err != nil {
+		t.Fatal(err)
+	}
+	// индекс строится по уже сохраненным значениям
+	if err := db.AddIndex("city", cityIndex); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename + ".city.idx"); err != nil {
+		t.Fatal(err)
+	}
+	query("Moscow", "alice", "carol")
+	query("Paris", "bob")
+	// и обновляется при изменении значений
+	if err := db.PutJSON("alice", map[string]string{"city": "Paris"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutJSON("dave", map[string]string{"city": "Moscow"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("bob"); err != nil {
+		t.Fatal(err)
+	}
+	query("Moscow", "carol", "dave")
+	query("Paris", "alice")
+	if err := db.PutReader("carol", strings.NewReader(`{"city":"Rome"}`), 15); err != nil {
+		t.Fatal(err)
+	}
+	query("Moscow", "dave")
+	query("Rome", "carol")
+	if err := db.Truncate(); err != nil {
+		t.Fatal(err)
+	}
+	query("Moscow")
+
+	if _, err := db.QueryIndex("none", []byte("Moscow")); err != ErrNoIndex {
+		t.Fatalf("bad error for unknown index: %v", err)
+	}
+	if err := db.AddIndex("../city", cityIndex); err != ErrBadIndexName {
+		t.Fatalf("bad error for invalid index name: %v", err)
+	}
+}
+
+func TestSecondaryIndexMemory(t *testing.T) {
+	db, err := OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddIndex("city", cityIndex); err != nil {
+		t.Fatal(err)
+	}
+	db.SetParallelWrites(true)
+	if err := db.PutJSON("alice", map[string]string{"city": "Moscow"}); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := db.QueryIndex("city", []byte("Moscow"))
+	if err != nil || len(keys) != 1 || keys[0] != "alice" {
+		t.Fatalf("bad keys: %q, %v", keys, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.QueryIndex("city", []byte("Moscow")); err != ErrClosed {
+		t.Fatalf("index after close: %v", err)
+	}
+}
+
+func TestSecondaryIndexSaved(t *testing.T) {
+	var filename = "db/saved.db"
+	var idxname = filename + ".city.idx"
+	os.RemoveAll(filename)
+	os.RemoveAll(idxname)
+	defer os.Remove(filename)
+	defer os.Remove(idxname)
+	var calls int
+	var extract = func(value []byte) [][]byte {
+		calls++
+		return cityIndex(value)
+	}
+	// reopen открывает хранилище с индексом и возвращает количество вызовов
+	// функции выделения значений при его добавлении
+	var reopen = func() (*DB, int) {
+		t.Helper()
+		db, err := OpenFile(filename, openOSFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		calls = 0
+		if err := db.AddIndex("city", extract); err != nil {
+			t.Fatal(err)
+		}
+		return db, calls
+	}
+	var query = func(db *DB, city string, count int) {
+		t.Helper()
+		keys, err := db.QueryIndex("city", []byte(city))
+		if err != nil || len(keys) != count {
+			t.Fatalf("bad keys for %q: %q, %v", city, keys, err)
+		}
+	}
+
+	db, _ := reopen()
+	for _, key := range []string{"alice", "bob", "carol"} {
+		if err := db.PutJSON(key, map[string]string{"city": "Moscow"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// сохраненный индекс используется без построения заново
+	db, n := reopen()
+	if n != 0 {
+		t.Fatalf("index rebuilt: %d calls", n)
+	}
+	query(db, "Moscow", 3)
+	// после сбоя отпечаток данных в индексе отсутствует
+	dirty, err := os.ReadFile(idxname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(idxname, dirty, 0666); err != nil {
+		t.Fatal(err)
+	}
+	db, n = reopen()
+	if n != 3 {
+		t.Fatalf("dirty index not rebuilt: %d calls", n)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// хранилище изменено без подключенного индекса
+	db, err = OpenFile(filename, openOSFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutJSON("bob", map[string]string{"city": "Paris"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, n = reopen()
+	defer db.Close()
+	if n != 3 {
+		t.Fatalf("stale index not rebuilt: %d calls", n)
+	}
+	query(db, "Moscow", 2)
+	query(db, "Paris", 1)
+	// функция выделения значений изменилась
+	if err := db.AddIndex("city", func(value []byte) [][]byte {
+		return [][]byte{[]byte("any")}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	query(db, "any", 3)
+	if err := db.RebuildIndex("none"); err != ErrNoIndex {
+		t.Fatalf("bad error for unknown index: %v", err)
+	}
+}
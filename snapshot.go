@@ -0,0 +1,112 @@
+package keystore
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Get читает значения без блокировки хранилища, поэтому чтение не ожидает
+// завершения записи и не задерживает ее. Для этого хранилище поддерживает
+// копию индекса в sync.Map, которая обновляется при каждом изменении, а сами
+// данные читаются из файла оптимистично.
+//
+// Запись в файл никогда не изменяет данные действующей записи: новое значение
+// всегда записывается на новое место. Поэтому прочитанные по устаревшему
+// индексу данные могут оказаться неверными, только если освободившееся место
+// уже успели занять другим значением или укоротить файл. Перед этим
+// увеличивается счетчик повторного использования места, и если за время
+// чтения он изменился, то значение читается заново под блокировкой.
+
+// viewIndex описывает запись в копии индекса для чтения без блокировки.
+type viewIndex struct {
+	offset int64  // смещение данных от начала файла
+	size   uint32 // размер данных
+	flags  uint8  // флаги записи
+}
+
+// viewMap возвращает копию индекса для чтения без блокировки или nil, если
+// такое чтение не используется.
+func (db *DB) viewMap() *sync.Map {
+	view, _ := db.view.Load().(*sync.Map)
+	return view
+}
+
+// resetView заново строит копию индекса для чтения без блокировки. При
+// использовании отображения файла в память значения читаются только под
+// блокировкой, поэтому копия индекса не строится. Вызывающий должен
+// удерживать эксклюзивную блокировку хранилища.
+func (db *DB) resetView() {
+	var view *sync.Map
+	if !db.usemmap {
+		view = new(sync.Map)
+		for key, index := range db.indexes {
+			view.Store(key, db.viewIndex(index))
+		}
+	}
+	db.view.Store(view)
+	db.reuse() // прежние индексы больше не действительны
+}
+
+// viewIndex возвращает описание записи для копии индекса.
+func (db *DB) viewIndex(index index) viewIndex {
+	return viewIndex{
+		offset: db.dataOffset(index),
+		size:   index.DataSize,
+		flags:  index.Flags,
+	}
+}
+
+// setIndex сохраняет индекс записи с указанным ключом.
+func (db *DB) setIndex(key string, index index) {
+	db.indexes[key] = index
+	db.touch(key)
+	if view := db.viewMap(); view != nil {
+		view.Store(key, db.viewIndex(index))
+	}
+}
+
+// dropIndex удаляет индекс записи с указанным ключом.
+func (db *DB) dropIndex(key string) {
+	delete(db.indexes, key)
+	db.touch(key)
+	if view := db.viewMap(); view != nil {
+		view.Delete(key)
+	}
+}
+
+// reuse увеличивает счетчик повторного использования места в файле. Должна
+// вызываться до того, как освободившееся место будет перезаписано или
+// отрезано от файла.
+func (db *DB) reuse() {
+	atomic.AddUint64(&db.reused, 1)
+}
+
+// getView возвращает значение с указанным ключом, прочитанное без
+// блокировки хранилища. Если значение не найдено или его не удалось
+// прочитать, например, из-за закрытия хранилища во время чтения, то второе
+// значение равно false и значение нужно читать под блокировкой.
+func (db *DB) getView(key string) ([]byte, bool) {
+	var reused = atomic.LoadUint64(&db.reused)
+	var view = db.viewMap()
+	if view == nil {
+		return nil, false
+	}
+	v, ok := view.Load(key)
+	if !ok {
+		return nil, false
+	}
+	var index = v.(viewIndex)
+	var data = make([]byte, index.size)
+	if _, err := db.f.ReadAt(data, index.offset); err != nil {
+		return nil, false
+	}
+	// место могли занять другим значением, пока данные читались
+	if atomic.LoadUint64(&db.reused) != reused {
+		return nil, false
+	}
+	value, err := db.decode(key, data, index.flags)
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}
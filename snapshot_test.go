@@ -0,0 +1,202 @@
+package keystore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// snapshotValue возвращает значение для ключа, по которому можно проверить,
+// что оно было прочитано целиком и относится именно к этому ключу.
+func snapshotValue(key string, version int) []byte {
+	var value = []byte(fmt.Sprintf("%s:%d:", key, version))
+	return append(value, bytes.Repeat([]byte(key), version%50)...)
+}
+
+// checkSnapshotValue проверяет значение, сохраненное snapshotValue.
+func checkSnapshotValue(key string, value []byte) bool {
+	var version int
+	if _, err := fmt.Sscanf(string(value), key+":%d:", &version); err != nil {
+		return false
+	}
+	return bytes.Equal(value, snapshotValue(key, version))
+}
+
+func TestSnapshotRead(t *testing.T) {
+	db, err := loadFile(context.Background(), newMemFile("snapshot"), false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetSync(false)
+	var keys = []string{"a", "bb", "ccc", "dddd", "eeeee"}
+	for _, key := range keys {
+		if err := db.Put(key, snapshotValue(key, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				var key = keys[rand.Intn(len(keys))]
+				value, err := db.Get(key)
+				if err == ErrNotFound {
+					continue
+				}
+				if err != nil || !checkSnapshotValue(key, value) {
+					t.Errorf("bad value %q: %q, %v", key, value, err)
+					return
+				}
+			}
+		}()
+	}
+	// перезапись значений разного размера постоянно занимает освободившееся
+	// место в файле
+	for version := 1; version < 2000; version++ {
+		var key = keys[version%len(keys)]
+		if version%7 == 0 {
+			if err := db.Delete(key); err != nil && err != ErrNotFound {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := db.Put(key, snapshotValue(key, version)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Truncate(); err != nil {
+		t.Fatal(err)
+	}
+	close(done)
+	wg.Wait()
+	if _, err := db.Get("a"); err != ErrNotFound {
+		t.Fatalf("value after truncate: %v", err)
+	}
+	if err := db.Put("a", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("a"); err != nil || string(value) != "value" {
+		t.Fatalf("bad value: %q, %v", value, err)
+	}
+}
+
+// hookFile вызывает функцию перед первым чтением из файла.
+type hookFile struct {
+	File
+	hook func()
+}
+
+func (f *hookFile) ReadAt(p []byte, off int64) (int, error) {
+	if hook := f.hook; hook != nil {
+		f.hook = nil
+		hook()
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func TestSnapshotReuse(t *testing.T) {
+	var file = &hookFile{File: newMemFile("reuse")}
+	db, err := loadFile(context.Background(), file, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Put(key, []byte("value "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// пока значение читается, его место занимает другое значение
+	file.hook = func() {
+		if err := db.Delete("b"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("d", []byte("value d")); err != nil {
+			t.Fatal(err)
+		}
+		if db.indexes["d"].Offset != db.end(db.indexes["a"]) { // место "b"
+			t.Error("slot not reused")
+		}
+	}
+	if value, err := db.Get("b"); err != ErrNotFound {
+		t.Fatalf("read reused slot: %q, %v", value, err)
+	}
+}
+
+// BenchmarkGetWhileWriting читает значения во время непрерывной записи в
+// хранилище и сообщает 99-й процентиль времени чтения.
+func BenchmarkGetWhileWriting(b *testing.B) {
+	var filename = filepath.Join("db", "snapshot.db")
+	os.Remove(filename)
+	defer os.Remove(filename)
+	db, err := Open(filename)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	db.SetSync(false)
+	var value = make([]byte, 256)
+	for i := 0; i < 1000; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+	var done = make(chan struct{})
+	var writer sync.WaitGroup
+	writer.Add(1)
+	go func() {
+		defer writer.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			_ = db.Put(fmt.Sprintf("key%d", i%1000), value[:128+i%128])
+		}
+	}()
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+	)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var local []time.Duration
+		for i := 0; pb.Next(); i++ {
+			var start = time.Now()
+			if _, err := db.Get(fmt.Sprintf("key%d", i%1000)); err != nil {
+				b.Error(err)
+				return
+			}
+			local = append(local, time.Since(start))
+		}
+		mu.Lock()
+		latencies = append(latencies, local...)
+		mu.Unlock()
+	})
+	b.StopTimer()
+	close(done)
+	writer.Wait()
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		b.ReportMetric(float64(latencies[len(latencies)*99/100]), "p99-ns")
+	}
+}
@@ -0,0 +1,126 @@
+package keystore
+
+import "time"
+
+// SyncPolicy задает политику сброса данных в файл после операций записи.
+type SyncPolicy uint8
+
+// Поддерживаемые политики сброса данных в файл. Политика по умолчанию имеет
+// нулевое значение, поэтому ее не обязательно указывать в Options.
+const (
+	// SyncAlways сбрасывает данные в файл после каждой операции записи.
+	// Используется по умолчанию.
+	SyncAlways SyncPolicy = iota
+	// SyncNever не сбрасывает данные в файл, полагаясь на операционную
+	// систему. Не выполняет сброс данных и при закрытии хранилища.
+	SyncNever
+	// SyncEveryInterval сбрасывает данные в файл в фоне не чаще одного раза
+	// за заданный интервал: все записи, сделанные за это время, сбрасываются
+	// вместе. При сбое могут быть потеряны данные, записанные за последний
+	// интервал.
+	SyncEveryInterval
+)
+
+// SetSyncPolicy устанавливает политику сброса данных в файл после записи.
+// Интервал используется только для политики SyncEveryInterval и должен быть
+// положительным, иначе вместо нее используется SyncAlways.
+//
+// Фоновый сброс данных останавливается при смене политики или закрытии
+// хранилища и выполняется с блокировкой чтения, как и db.Sync. При закрытии
+// хранилища с любой политикой, кроме SyncNever, данные принудительно
+// сбрасываются в файл.
+func (db *DB) SetSyncPolicy(policy SyncPolicy, interval time.Duration) {
+	if policy == SyncEveryInterval && interval <= 0 {
+		policy = SyncAlways
+	}
+	db.mu.Lock()
+	var old = db.flusher
+	db.policy, db.flusher = policy, nil
+	if policy == SyncEveryInterval && !db.ro && !db.closed {
+		db.flusher = newFlusher(db, interval)
+	}
+	db.mu.Unlock()
+	// останавливаем без блокировки и сбрасываем то, что не успели; сброс
+	// выполняется с блокировкой, чтобы не пересечься со сжатием и закрытием
+	if old != nil {
+		old.stop()
+		_ = db.Sync()
+	}
+}
+
+// flush сбрасывает данные в файл в соответствии с политикой хранилища и при
+// необходимости запускает его сжатие в фоне (см. db.SetAutoCompact).
+// Вызывается после успешной записи с установленной блокировкой.
+func (db *DB) flush() error {
+	db.autoCompact()
+	switch db.policy {
+	case SyncAlways:
+		return db.sync()
+	case SyncEveryInterval:
+		db.flusher.notify()
+	}
+	return nil
+}
+
+// flusher периодически сбрасывает данные хранилища в файл, если с момента
+// последнего сброса в него что-то записывалось.
+type flusher struct {
+	dirty chan struct{} // уведомление о записи
+	quit  chan struct{} // остановка фонового сброса
+	done  chan struct{} // закрывается после остановки
+}
+
+// newFlusher запускает фоновый сброс данных хранилища в файл с указанным
+// интервалом.
+func newFlusher(db *DB, interval time.Duration) *flusher {
+	var f = &flusher{
+		dirty: make(chan struct{}, 1),
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go f.run(db, interval)
+	return f
+}
+
+// run ожидает уведомлений о записи и сбрасывает данные в файл не чаще одного
+// раза за интервал. Все уведомления, полученные за интервал, объединяются.
+func (f *flusher) run(db *DB, interval time.Duration) {
+	defer close(f.done)
+	var timer = time.NewTimer(interval)
+	timer.Stop()
+	for {
+		select {
+		case <-f.dirty:
+		case <-f.quit:
+			return
+		}
+		timer.Reset(interval)
+		select {
+		case <-timer.C:
+		case <-f.quit:
+			timer.Stop()
+			return // данные сбрасываются при закрытии или смене политики
+		}
+		// сброс выполняется с блокировкой чтения, иначе он может попасть на
+		// файл, уже замененный сжатием или закрытый; после закрытия
+		// хранилища db.Sync вернет ErrClosed, не обращаясь к файлу
+		_ = db.Sync()
+	}
+}
+
+// notify сообщает о записи данных, не блокируя вызывающего.
+func (f *flusher) notify() {
+	select {
+	case f.dirty <- struct{}{}:
+	default: // сброс уже запланирован
+	}
+}
+
+// stop останавливает фоновый сброс и ожидает его завершения.
+func (f *flusher) stop() {
+	if f == nil {
+		return
+	}
+	close(f.quit)
+	<-f.done
+}
@@ -5,7 +5,8 @@ import (
 	"time"
 )
 
-// Timestamp подменяет представление времени в формате JSON в виде числа.
+// Timestamp подменяет представление времени в формате JSON в виде числа
+// секунд Unix.
 type Timestamp struct {
 	time.Time
 }
@@ -15,17 +16,53 @@ func (t Timestamp) MarshalJSON() ([]byte, error) {
 	return json.Marshal(t.Time.Unix())
 }
 
-// UnmarshalJSON десериализует представление времени из формата JSON.
+// UnmarshalJSON десериализует представление времени из формата JSON. Помимо
+// числа секунд поддерживается и строка в формате RFC3339, чтобы можно было
+// загружать данные, сохраненные другими программами.
 func (t *Timestamp) UnmarshalJSON(b []byte) error {
-	var i int64
-	if err := json.Unmarshal(b, &i); err != nil {
-		return err
-	}
-	t.Time = time.Unix(i, 0)
-	return nil
+	return unmarshalTime(b, &t.Time, func(i int64) time.Time {
+		return time.Unix(i, 0)
+	})
 }
 
 // Now возвращает текущее время в виде Timestamp.
 func Now() Timestamp {
 	return Timestamp{time.Now()}
 }
+
+// TimestampMilli подменяет представление времени в формате JSON в виде числа
+// миллисекунд Unix. В отличие от Timestamp, сохраняет время с точностью до
+// миллисекунды, как это принято в JavaScript.
+type TimestampMilli struct {
+	time.Time
+}
+
+// MarshalJSON представляет время в формате JSON в виде числа миллисекунд.
+func (t TimestampMilli) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.Time.UnixMilli())
+}
+
+// UnmarshalJSON десериализует представление времени из формата JSON. Помимо
+// числа миллисекунд поддерживается и строка в формате RFC3339.
+func (t *TimestampMilli) UnmarshalJSON(b []byte) error {
+	return unmarshalTime(b, &t.Time, time.UnixMilli)
+}
+
+// NowMilli возвращает текущее время в виде TimestampMilli.
+func NowMilli() TimestampMilli {
+	return TimestampMilli{time.Now()}
+}
+
+// unmarshalTime разбирает время из формата JSON: из строки в формате RFC3339
+// или из числа, которое преобразуется во время с помощью функции unix.
+func unmarshalTime(b []byte, t *time.Time, unix func(int64) time.Time) error {
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, t)
+	}
+	var i int64
+	if err := json.Unmarshal(b, &i); err != nil {
+		return err
+	}
+	*t = unix(i)
+	return nil
+}
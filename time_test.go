@@ -0,0 +1,55 @@
+package keystore
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTimestamp(t *testing.T) {
+	var date = time.Date(2024, 3, 1, 12, 30, 15, 123456789, time.UTC)
+	data, err := json.Marshal(Timestamp{date})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "1709296215" {
+		t.Fatalf("bad timestamp: %s", data)
+	}
+	var ts Timestamp
+	if err := json.Unmarshal(data, &ts); err != nil {
+		t.Fatal(err)
+	}
+	if !ts.Equal(date.Truncate(time.Second)) {
+		t.Fatalf("bad unmarshaled timestamp: %v", ts)
+	}
+
+	data, err = json.Marshal(TimestampMilli{date})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "1709296215123" {
+		t.Fatalf("bad milli timestamp: %s", data)
+	}
+	var tsm TimestampMilli
+	if err := json.Unmarshal(data, &tsm); err != nil {
+		t.Fatal(err)
+	}
+	if !tsm.Equal(date.Truncate(time.Millisecond)) {
+		t.Fatalf("bad unmarshaled milli timestamp: %v", tsm)
+	}
+
+	// строка в формате RFC3339
+	var text = []byte(`"2024-03-01T12:30:15.123456789Z"`)
+	if err := json.Unmarshal(text, &ts); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(text, &tsm); err != nil {
+		t.Fatal(err)
+	}
+	if !ts.Equal(date) || !tsm.Equal(date) {
+		t.Fatalf("bad RFC3339 timestamp: %v, %v", ts, tsm)
+	}
+	if err := json.Unmarshal([]byte(`"yesterday"`), &ts); err == nil {
+		t.Fatal("bad time parsed")
+	}
+}
@@ -0,0 +1,180 @@
+package keystore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Tombstone описывает удаленную запись, место которой в файле еще не занято
+// другими данными.
+type Tombstone struct {
+	Key     string    // ключ или пустая строка, если он не сохранился
+	ModTime time.Time // время удаления
+	Offset  uint32    // смещение записи от начала файла
+	Size    uint32    // размер места, доступного для ключа и данных
+}
+
+// Tombstones возвращает список удаленных записей, упорядоченный по их
+// смещению в файле. Используется для поиска причин потери данных и
+// восстановления удаленных значений с помощью db.Undelete.
+//
+// Ключ возвращается только для тех записей, заголовок которых остался
+// нетронутым. У мест, объединенных с соседними свободными местами или
+// отделенных от занятых (см. BestFitSplit), ключа нет. Записи, которые
+// были последними в файле, при удалении отрезаются от него и в список не
+// попадают, как и отброшенные свободные места (см. db.SetMaxFreeSlots) и
+// значения в корзине (см. db.ListDeleted).
+func (db *DB) Tombstones() []Tombstone {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var list = make([]Tombstone, 0, db.deleted.len())
+	db.deleted.each(func(slot index) {
+		var tombstone = Tombstone{
+			ModTime: time.Unix(int64(slot.Time), 0),
+			Offset:  slot.Offset,
+			Size:    slot.Size(),
+		}
+		if head, key, _, err := db.tombstone(slot); err == nil {
+			tombstone.Key = key
+			tombstone.ModTime = time.Unix(int64(head.Time), 0)
+		}
+		list = append(list, tombstone)
+	})
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Offset < list[j].Offset
+	})
+	return list
+}
+
+// tombstone читает из файла заголовок и ключ удаленной записи, которая
+// занимает свободное место slot. Если заголовок не совпадает с описанием
+// места, то ключ возвращается пустым.
+func (db *DB) tombstone(slot index) (head storedIndex, key string, sum uint32, err error) {
+	var buf = make([]byte, db.recordHeaderSize()+int64(slot.KeySize))
+	if _, err = db.f.ReadAt(buf, int64(slot.Offset)); err != nil {
+		return head, "", 0, err
+	}
+	var reader = bytes.NewReader(buf)
+	_ = binary.Read(reader, binary.BigEndian, &head)
+	if db.flags&flagChecksum != 0 {
+		_ = binary.Read(reader, binary.BigEndian, &sum)
+	}
+	if head.Flags&recordDeleted == 0 || head.KeySize != slot.KeySize ||
+		head.DataSize != slot.DataSize || head.EmptySize != slot.EmptySize {
+		return head, "", 0, nil
+	}
+	return head, string(buf[db.recordHeaderSize():]), sum, nil
+}
+
+// ErrKeyExists возвращается при попытке восстановить удаленное значение с
+// ключом, который уже есть в хранилище.
+var ErrKeyExists = errors.New("key already exists")
+
+// Undelete восстанавливает удаленное значение с указанным ключом, если
+// занимаемое им место в файле еще не было использовано для записи других
+// данных. Если таких удаленных записей несколько, например остались прежние
+// значения перезаписанного ключа, то восстанавливается удаленная последней
+// (время удаления сохраняется с точностью до секунды).
+//
+// Удаление только помечает запись в файле удаленной, поэтому ее данные
+// остаются в файле до тех пор, пока место не будет занято. Как только оно
+// будет использовано при записи другого значения (db.Put и т.д.), объединено
+// с соседним свободным местом или отрезано от конца файла, восстановить
+// значение уже нельзя и возвращается ошибка ErrNotFound. Если значение с таким
+// ключом уже есть, то возвращается ошибка ErrKeyExists.
+//
+// Значения, удаленные в режиме db.SetSoftDelete, восстанавливаются из корзины
+// до тех пор, пока не будут удалены из нее окончательно.
+func (db *DB) Undelete(key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if db.ro {
+		return ErrReadOnly
+	}
+	if _, ok := db.indexes[key]; ok {
+		return ErrKeyExists
+	}
+	var (
+		slot, retained = db.trash[key]
+		found          = retained
+		head           storedIndex
+		slotSum        uint32
+	)
+	if retained {
+		h, _, sum, err := db.tombstone(slot)
+		if err != nil {
+			return err
+		}
+		head, slotSum = h, sum
+	} else {
+		db.deleted.each(func(index index) {
+			if int(index.KeySize) != len(key) {
+				return
+			}
+			h, k, sum, err := db.tombstone(index)
+			if err == nil && k == key && (!found || h.Time >= head.Time) {
+				found, slot, head, slotSum = true, index, h, sum
+			}
+		})
+	}
+	if !found {
+		return ErrNotFound
+	}
+	data, err := db.read(slot)
+	if err != nil {
+		return err
+	}
+	if db.flags&flagChecksum != 0 && checksum(key, data) != slotSum {
+		return fmt.Errorf("%w at offset %d", ErrChecksum, slot.Offset)
+	}
+	var index = slot
+	index.Flags = head.Flags &^ (recordDeleted | recordRetained)
+	index.Time = uint32(time.Now().Unix())
+	value, err := db.decode(key, data, index.Flags)
+	if err != nil {
+		return err
+	}
+	// снимаем метку об удалении
+	var buf = bufPool.Get().(*bytes.Buffer)
+	buf.Reset() // сбрасываем буфер от возможного предыдущего значения
+	_ = binary.Write(buf, binary.BigEndian, &struct {
+		Time  uint32 // время восстановления
+		Flags uint8  // флаги без метки об удалении
+	}{
+		Time:  index.Time,
+		Flags: index.Flags,
+	})
+	_, err = db.f.WriteAt(buf.Bytes(), int64(index.Offset))
+	bufPool.Put(buf)
+	if err != nil {
+		return err
+	}
+	if retained {
+		delete(db.trash, key)
+	} else {
+		db.unfree(slot)
+	}
+	db.sorted = nil // добавлен новый ключ
+	db.setIndex(key, index)
+	if logger := db.logger(); logger != nil {
+		logger.Debug("undelete", "key", key, "offset", index.Offset)
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	if err := db.reindex(key, nil, value); err != nil {
+		return err
+	}
+	db.notify(EventPut, key, value)
+	return db.flush()
+}
@@ -0,0 +1,78 @@
+package keystore
+
+import (
+	"os"
+	"testing"
+)
+
+func TestUndelete(t *testing.T) {
+	var filename = "db/undelete.db"
+	os.Remove(filename)
+	if err := os.MkdirAll("db", 0777); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filename)
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := db.Put(key, []byte("value "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"b", "d"} {
+		if err := db.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// последняя запись отрезается от файла и не восстанавливается
+	var tombstones = db.Tombstones()
+	if len(tombstones) != 1 || tombstones[0].Key != "b" ||
+		tombstones[0].Offset != uint32(db.start)+uint32(db.recordHeaderSize())+
+			db.indexes["a"].Size() {
+		t.Fatalf("bad tombstones: %+v", tombstones)
+	}
+	if err := db.Undelete("d"); err != ErrNotFound {
+		t.Errorf("bad truncated undelete: %v", err)
+	}
+	if err := db.Undelete("a"); err != ErrKeyExists {
+		t.Errorf("bad existing undelete: %v", err)
+	}
+	// удаленные записи сохраняются в файле
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if tombstones := db.Tombstones(); len(tombstones) != 1 || tombstones[0].Key != "b" {
+		t.Fatalf("bad reopened tombstones: %+v", tombstones)
+	}
+	if err := db.Undelete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("b"); err != nil || string(value) != "value b" {
+		t.Fatalf("bad undeleted value: %q, %v", value, err)
+	}
+	if len(db.Tombstones()) != 0 || db.Count() != 3 {
+		t.Fatal("bad store after undelete:", db.Tombstones(), db.Count())
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	// место, занятое другим значением, уже не восстанавливается
+	if err := db.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("x", []byte("value x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Undelete("b"); err != ErrNotFound {
+		t.Errorf("bad reused undelete: %v", err)
+	}
+	if len(db.Tombstones()) != 0 {
+		t.Error("reused slot in tombstones")
+	}
+}
@@ -0,0 +1,140 @@
+package keystore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrDeleted возвращается db.Get для значений, которые были удалены в режиме
+// db.SetSoftDelete и еще находятся в корзине.
+var ErrDeleted = errors.New("key deleted")
+
+// SetSoftDelete включает или выключает режим, в котором удаленные значения
+// не стираются, а помещаются в корзину. Значения в корзине остаются в файле и
+// не освобождают занимаемое ими место: db.Get для них возвращает ошибку
+// ErrDeleted, db.ListDeleted возвращает их список, db.Undelete восстанавливает
+// их, а db.Purge окончательно удаляет.
+//
+// В корзине хранится только последнее удаленное значение каждого ключа: при
+// повторном удалении, как и при сохранении нового значения с тем же ключом,
+// прежнее значение из корзины удаляется окончательно. Выключение режима не
+// затрагивает значения, которые уже находятся в корзине.
+func (db *DB) SetSoftDelete(soft bool) {
+	db.mu.Lock()
+	db.soft = soft
+	db.mu.Unlock()
+}
+
+// retain удаляет ключ из хранилища, помещая его запись в корзину.
+func (db *DB) retain(key string) error {
+	if db.ro {
+		return ErrReadOnly
+	}
+	slot, ok := db.indexes[key]
+	if !ok {
+		return ErrNotFound
+	}
+	slot.Time = uint32(time.Now().Unix())
+	var buf = bufPool.Get().(*bytes.Buffer)
+	buf.Reset() // сбрасываем буфер от возможного предыдущего значения
+	_ = binary.Write(buf, binary.BigEndian, &struct {
+		Time  uint32 // время удаления
+		Flags uint8  // флаги с меткой об удалении и хранении в корзине
+	}{
+		Time:  slot.Time,
+		Flags: slot.Flags | recordDeleted | recordRetained,
+	})
+	_, err := db.f.WriteAt(buf.Bytes(), int64(slot.Offset))
+	bufPool.Put(buf)
+	if err != nil {
+		return err
+	}
+	db.dropIndex(key) // удаляем информацию об индексе
+	db.sorted = nil   // список ключей изменился
+	if err := db.unretain(key); err != nil {
+		return err
+	}
+	if db.trash == nil {
+		db.trash = make(map[string]index)
+	}
+	db.trash[key] = slot
+	return nil
+}
+
+// unretain окончательно удаляет из корзины запись с указанным ключом, если
+// она там есть.
+func (db *DB) unretain(key string) error {
+	index, ok := db.trash[key]
+	if !ok {
+		return nil
+	}
+	delete(db.trash, key)
+	db.touch(key)
+	return db.discard(index)
+}
+
+// ListDeleted возвращает список значений в корзине (см. db.SetSoftDelete),
+// отсортированный по ключам. Время изменения в описании соответствует
+// времени удаления.
+func (db *DB) ListDeleted() []Tombstone {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var list = make([]Tombstone, 0, len(db.trash))
+	for key, index := range db.trash {
+		list = append(list, Tombstone{
+			Key:     key,
+			ModTime: time.Unix(int64(index.Time), 0),
+			Offset:  index.Offset,
+			Size:    index.Size(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Key < list[j].Key
+	})
+	return list
+}
+
+// Purge окончательно удаляет из корзины значения с указанными ключами, а
+// если ключи не заданы, то все значения в корзине. Занимаемое ими место
+// становится доступным для записи других значений, так же как после удаления
+// без корзины (см. db.Undelete). Возвращает количество удаленных значений:
+// ключи, которых в корзине нет, пропускаются.
+func (db *DB) Purge(keys ...string) (count int, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return 0, ErrClosed
+	}
+	if db.ro {
+		return 0, ErrReadOnly
+	}
+	if len(keys) == 0 {
+		for key := range db.trash {
+			keys = append(keys, key)
+		}
+	}
+	// записи удаляются с конца файла, чтобы последние из них можно было
+	// просто отрезать
+	var list = make([]string, 0, len(keys))
+	for _, key := range keys {
+		if _, ok := db.trash[key]; ok {
+			list = append(list, key)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return db.trash[list[i]].Offset > db.trash[list[j]].Offset
+	})
+	for _, key := range list {
+		if _, ok := db.trash[key]; !ok {
+			continue // повторяющийся ключ
+		}
+		if err := db.unretain(key); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, db.flush()
+}
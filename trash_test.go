@@ -0,0 +1,87 @@
+package keystore
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSoftDelete(t *testing.T) {
+	var filename = "db/softdelete.db"
+	os.Remove(filename)
+	if err := os.MkdirAll("db", 0777); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filename)
+	db, err := OpenWithOptions(filename, &Options{SoftDelete: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := db.Put(key, []byte("value "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Deletes("b", "d"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("b"); err != ErrDeleted {
+		t.Fatalf("bad deleted get: %v", err)
+	}
+	if db.Has("b") || db.Count() != 2 || len(db.DeletedSlots()) != 0 {
+		t.Fatal("bad soft deleted store:", db.Count(), db.DeletedSlots())
+	}
+	// корзина сохраняется в файле
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var list = db.ListDeleted()
+	if len(list) != 2 || list[0].Key != "b" || list[1].Key != "d" {
+		t.Fatalf("bad deleted list: %+v", list)
+	}
+	if err := db.Undelete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("b"); err != nil || string(value) != "value b" {
+		t.Fatalf("bad undeleted value: %q, %v", value, err)
+	}
+	// новое значение удаляет прежнее из корзины
+	db.SetSoftDelete(true)
+	if err := db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("a", []byte("new value a")); err != nil {
+		t.Fatal(err)
+	}
+	if list := db.ListDeleted(); len(list) != 1 || list[0].Key != "d" {
+		t.Fatalf("bad deleted list after put: %+v", list)
+	}
+	if count, err := db.Purge("x", "d", "d"); err != nil || count != 1 {
+		t.Fatalf("bad purge: %d, %v", count, err)
+	}
+	if _, err := db.Get("d"); err != ErrNotFound {
+		t.Fatalf("bad purged get: %v", err)
+	}
+	// окончательно удаленное значение становится обычной удаленной записью
+	if list := db.Tombstones(); len(list) != 2 || list[1].Key != "d" {
+		t.Fatalf("bad tombstones after purge: %+v", list)
+	}
+	if err := db.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := db.Purge(); err != nil || count != 1 || len(db.ListDeleted()) != 0 {
+		t.Fatalf("bad purge all: %d, %v", count, err)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if db.Count() != 2 || len(db.ListDeleted()) != 0 {
+		t.Fatal("bad reloaded store:", db.Count(), db.ListDeleted())
+	}
+}
@@ -1,6 +1,9 @@
 package keystore
 
-import "testing"
+import (
+	"os"
+	"testing"
+)
 
 func TestTruncate(t *testing.T) {
 	var filename = "db/truncate.db"
@@ -19,4 +22,56 @@ func TestTruncate(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Put(key, []byte("value "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	counter, err := db.NextSequence()
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, cancel := db.Watch("")
+	defer cancel()
+	if err := Truncate(filename); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if event := <-events; event.Type != EventDelete {
+			t.Fatalf("bad event: %v", event)
+		}
+	}
+	if db.Count() != 0 || len(db.DeletedSlots()) != 0 || db.Has("a") {
+		t.Fatal("store not truncated")
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != db.start {
+		t.Fatalf("bad file size: %d", info.Size())
+	}
+	// хранилище остается открытым и доступным для записи
+	if err := db.Put("key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(filename); err != nil {
+		t.Fatal(err)
+	}
+	if db.Count() != 1 || !db.Has("key") {
+		t.Fatalf("bad keys: %v", db.Keys("", "", 0, 0, true))
+	}
+	if n, err := db.NextSequence(); err != nil || n != counter+1 {
+		t.Fatalf("counter not preserved: %d, %v", n, err)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
 }
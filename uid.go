@@ -14,11 +14,17 @@ var (
 	// globalCounter содержит текущее значение счетчика, которое увеличивается
 	// после каждого использования
 	globalCounter uint32
+	// lastUID содержит последний выданный NewUID идентификатор
+	lastUID uint64
+	// uidProcess содержит случайный номер процесса, который добавляется к
+	// идентификаторам NewUID
+	uidProcess uint64
 )
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
 	globalCounter = rand.Uint32() // устанавливаем случайное начальное значение
+	uidProcess = uint64(rand.Intn(1 << uidProcessBits))
 }
 
 // UID представляет из себя уникальный идентификатор, основанный на временной
@@ -27,19 +33,74 @@ func init() {
 // значения действительно будут уникальными и монотонно возрастающими, что
 // позволяет использовать сортировку ключей в запросах. В качестве точки
 // отсчета используется дата 2006-01-02T15:04:05Z07:00.
+//
+// Старший бит идентификатора всегда установлен, следующие 43 бита содержат
+// количество миллисекунд от точки отсчета (этого хватит до 2284 года), 8 бит
+// — случайный номер процесса, а младшие 12 бит — значение счетчика, поэтому
+// время, номер процесса и счетчик не пересекаются. В идентификаторах
+// прежнего формата время хранилось в наносекундах и старший бит был сброшен
+// (он установится только через 292 года от точки отсчета), поэтому новые
+// идентификаторы всегда больше выданных ранее и сортируются после них.
+// Time и Counter для идентификаторов прежнего формата возвращают неверные
+// значения.
 type UID uint64
 
-// NewUID возвращает уникальный идентификатор, основанный на времени и
-// внутреннем счетчике. Шесть байт отведено под текущее время, и два байта -
-// под счетчик.
+const (
+	// uidCounterBits задает количество младших бит идентификатора,
+	// отведенных под счетчик.
+	uidCounterBits = 12
+	// uidProcessBits задает количество бит номера процесса, которые идут
+	// сразу за счетчиком.
+	uidProcessBits = 8
+	// uidTimeShift задает сдвиг времени в идентификаторе.
+	uidTimeShift = uidCounterBits + uidProcessBits
+	// uidFormat задает старший бит, отличающий идентификаторы с временем в
+	// миллисекундах от идентификаторов прежнего формата.
+	uidFormat = 1 << 63
+)
+
+// uidTime возвращает часть идентификатора со временем без счетчика.
+func uidTime(date time.Time) uint64 {
+	return uidFormat | uint64(date.Sub(minDate)/time.Millisecond)<<uidTimeShift
+}
+
+// NewUID возвращает уникальный идентификатор, основанный на времени,
+// случайном номере процесса и внутреннем счетчике.
+//
+// В рамках одного процесса идентификаторы всегда уникальны и строго
+// возрастают: если за единицу времени идентификатора (1 мс) запрашивается
+// больше 4096 значений или системное время переводится назад, то следующий
+// идентификатор просто на единицу больше предыдущего, а время в нем немного
+// опережает реальное.
+//
+// Номер процесса и начальное значение счетчика выбираются случайно при
+// запуске процесса, поэтому разные процессы получают разные идентификаторы с
+// высокой вероятностью, но не гарантированно: идентификаторы двух процессов
+// могут совпасть, только если совпали их номера (вероятность 1/256) и оба
+// процесса за одну и ту же миллисекунду выдали по n идентификаторов из
+// пересекающихся диапазонов счетчика (вероятность примерно 2n/4096), т.е.
+// в целом с вероятностью примерно n/524288. Если нужна гарантированная
+// уникальность между процессами, то используйте db.NextUID с общим
+// хранилищем.
 func NewUID() UID {
-	var counter = uint16(atomic.AddUint32(&globalCounter, 1))
-	return UID(uint64(time.Since(minDate)&^0xffff) + uint64(counter))
+	var counter = uint64(atomic.AddUint32(&globalCounter, 1)) &
+		(1<<uidCounterBits - 1)
+	var uid = uidTime(time.Now()) | uidProcess<<uidCounterBits | counter
+	for {
+		var last = atomic.LoadUint64(&lastUID)
+		var next = uid
+		if next <= last {
+			next = last + 1 // сохраняем монотонное возрастание
+		}
+		if atomic.CompareAndSwapUint64(&lastUID, last, next) {
+			return UID(next)
+		}
+	}
 }
 
 // DateUID возвращает уже не совсем уникальный идентификатор для указанных
-// даты и времени, но без учета счетчика. Может использоваться для выборки
-// ключей до или после указанной даты.
+// даты и времени, но без учета номера процесса и счетчика. Может
+// использоваться для выборки ключей до или после указанной даты.
 //
 // Даты до 2006-01-02T15:04:05Z07:00 считаются невалидными и используются
 // как нулевые значения, чтобы не нарушать порядок сортировки.
@@ -47,7 +108,22 @@ func DateUID(date time.Time) UID {
 	if date.IsZero() || date.Before(minDate) {
 		date = minDate
 	}
-	return UID(uint64(date.Sub(minDate) &^ 0xffff))
+	return UID(uidTime(date))
+}
+
+// DateRangeUID возвращает границы идентификаторов, созданных в промежутке
+// времени от from (включительно) до to (не включая его): low — наименьший
+// идентификатор промежутка, а high — наименьший идентификатор, который в
+// него уже не входит. Если to раньше from, то они меняются местами.
+//
+// Строковые представления границ можно сразу использовать в качестве start и
+// end при выборке с помощью db.Range ключей, созданных на основе UID.
+func DateRangeUID(from, to time.Time) (low, high UID) {
+	low, high = DateUID(from), DateUID(to)
+	if high < low {
+		low, high = high, low
+	}
+	return low, high
 }
 
 // Byte возвращает бинарное представление уникального идентификатора.
@@ -69,14 +145,41 @@ func ParseUID(s string) UID {
 	return uid
 }
 
-// Time возвращает информацию о времени создания уникального идентификатора.
+// Time возвращает информацию о времени создания уникального идентификатора с
+// точностью до миллисекунды.
 func (uid UID) Time() time.Time {
-	return minDate.Add(time.Duration(uid &^ 0xffff))
+	return minDate.Add(time.Duration((uid&^uidFormat)>>uidTimeShift) *
+		time.Millisecond)
 }
 
 // Counter возвращает значение счетчика уникального идентификатора.
 func (uid UID) Counter() uint16 {
-	return uint16(uid)
+	return uint16(uid & (1<<uidCounterBits - 1))
+}
+
+// Process возвращает номер процесса, создавшего уникальный идентификатор.
+func (uid UID) Process() uint8 {
+	return uint8(uid >> uidCounterBits)
+}
+
+// Before возвращает true, если идентификатор был создан раньше other.
+func (uid UID) Before(other UID) bool {
+	return uid < other
+}
+
+// After возвращает true, если идентификатор был создан позже other.
+func (uid UID) After(other UID) bool {
+	return uid > other
+}
+
+// Bytes8 возвращает идентификатор в виде восьми байт в формате
+// binary.BigEndian. В отличие от MarshalBinary, результат может
+// использоваться в качестве ключа map, а порядок сортировки таких байт
+// совпадает с порядком идентификаторов.
+func (uid UID) Bytes8() [8]byte {
+	var data [8]byte
+	binary.BigEndian.PutUint64(data[:], uint64(uid))
+	return data
 }
 
 // MarshalText обеспечивает представление уникального идентификатора в виде
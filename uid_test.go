@@ -1,7 +1,9 @@
 package keystore
 
 import (
+	"bytes"
 	"fmt"
+	"os"
 	"testing"
 	"time"
 )
@@ -43,12 +45,181 @@ func TestUID(t *testing.T) {
 }
 
 func TestDateUID(t *testing.T) {
-	if DateUID(minDate) != 0 {
+	if DateUID(minDate) != uidFormat {
 		t.Fatal("bad UID for min date")
 	}
+	// идентификаторы прежнего формата с временем в наносекундах меньше новых
+	var old = UID(time.Since(minDate)) &^ 0xffff
+	if !old.Before(DateUID(minDate)) {
+		t.Fatal("old format UID sorted after new one:", old)
+	}
 	// fmt.Println(DateUID(minDate.Add(-time.Hour)))
 	for i := 0; i < 20; i++ {
 		uid := DateUID(minDate.Add(time.Hour * 12 * time.Duration(i)))
 		fmt.Println(uid, uid.Counter(), uid.Time())
 	}
 }
+
+func TestNextUID(t *testing.T) {
+	var filename = "db/uid.db"
+	os.Remove(filename)
+	defer os.Remove(filename)
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last UID
+	for i := 0; i < 1000; i++ {
+		uid, err := db.NextUID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uid <= last {
+			t.Fatalf("%d: not monotonic: %d <= %d", i, uid, last)
+		}
+		last = uid
+	}
+	if since := time.Since(last.Time()); since < -time.Second || since > time.Minute {
+		t.Errorf("bad uid time: %v", last.Time())
+	}
+	seq, err := db.NextSequence()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq <= uint64(last) {
+		t.Fatalf("sequence not after uid: %d <= %d", seq, last)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// после повторного открытия значения продолжают возрастать, даже если
+	// счетчик опережает время
+	db, err = Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.ReserveSequence(1 << 40); err != nil {
+		t.Fatal(err)
+	}
+	uid, err := db.NextUID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint64(uid) != seq+1<<40+1 {
+		t.Fatalf("bad uid after reserve: %d", uid)
+	}
+}
+
+func TestNewUIDMonotonic(t *testing.T) {
+	const workers, count = 4, 50000
+	var results = make(chan []UID, workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			var uids = make([]UID, count)
+			for i := range uids {
+				uids[i] = NewUID()
+			}
+			results <- uids
+		}()
+	}
+	var seen = make(map[UID]bool, workers*count)
+	for w := 0; w < workers; w++ {
+		var uids = <-results
+		for i, uid := range uids {
+			if i > 0 && uid <= uids[i-1] {
+				t.Fatalf("not monotonic: %d <= %d", uid, uids[i-1])
+			}
+			if seen[uid] {
+				t.Fatalf("duplicate uid: %d", uid)
+			}
+			seen[uid] = true
+		}
+	}
+}
+
+func TestUIDLayout(t *testing.T) {
+	var date = time.Date(2024, 2, 29, 23, 59, 59, 999999999, time.UTC)
+	var want = date.Truncate(time.Millisecond)
+	for _, counter := range []uint16{0, 1, 0x7ff, 0xffe, 0xfff} {
+		for _, process := range []uint8{0, 1, 0x7f, 0xff} {
+			var uid = DateUID(date) | UID(process)<<uidCounterBits | UID(counter)
+			if !uid.Time().Equal(want) {
+				t.Errorf("%d/%d: bad time %v", process, counter, uid.Time())
+			}
+			if uid.Counter() != counter || uid.Process() != process {
+				t.Errorf("%d/%d: bad counter %d or process %d", process,
+					counter, uid.Counter(), uid.Process())
+			}
+		}
+	}
+	// соседние миллисекунды не пересекаются
+	var next = DateUID(date.Add(time.Millisecond))
+	if next != DateUID(date)+1<<uidTimeShift {
+		t.Errorf("bad next millisecond uid: %d", next)
+	}
+	var uid = NewUID()
+	if since := time.Since(uid.Time()); since < -time.Second || since > time.Second {
+		t.Errorf("bad uid time: %v", uid.Time())
+	}
+	// время до 2284 года помещается в идентификатор
+	var last = time.Date(2284, 1, 1, 0, 0, 0, 0, time.UTC)
+	if uid := DateUID(last); !uid.Time().Equal(last) || uid.Before(DateUID(date)) {
+		t.Errorf("bad last date uid: %v", uid.Time())
+	}
+}
+
+func TestUIDCompare(t *testing.T) {
+	var first, second = NewUID(), NewUID()
+	if !first.Before(second) || first.After(second) {
+		t.Error("bad order of first and second")
+	}
+	if !second.After(first) || second.Before(first) {
+		t.Error("bad order of second and first")
+	}
+	if first.Before(first) || first.After(first) {
+		t.Error("uid compared with itself")
+	}
+	var b1, b2 = first.Bytes8(), second.Bytes8()
+	if bytes.Compare(b1[:], b2[:]) >= 0 {
+		t.Error("bad bytes order")
+	}
+	data, _ := first.MarshalBinary()
+	if !bytes.Equal(b1[:], data) {
+		t.Errorf("bad bytes: %x vs %x", b1, data)
+	}
+}
+
+func TestDateRangeUID(t *testing.T) {
+	db, err := OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var day = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, date := range []time.Time{
+		day.Add(-time.Millisecond),               // последняя миллисекунда прошлого дня
+		day,                                      // начало дня
+		day.Add(12 * time.Hour),                  // середина дня
+		day.Add(24*time.Hour - time.Millisecond), // конец дня
+		day.Add(24 * time.Hour),                  // начало следующего дня
+	} {
+		var uid = DateUID(date) | 0xffff
+		if err := db.Put(uid.String(), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	low, high := DateRangeUID(day, day.Add(24*time.Hour))
+	var keys = db.Range(low.String(), high.String(), true)
+	if len(keys) != 3 {
+		t.Fatalf("bad keys in range: %v", keys)
+	}
+	for _, key := range keys {
+		if date := ParseUID(key).Time(); date.Before(day) || !date.Before(day.Add(24*time.Hour)) {
+			t.Errorf("key out of range: %v", date)
+		}
+	}
+	if l, h := DateRangeUID(day.Add(24*time.Hour), day); l != low || h != high {
+		t.Error("bad swapped range")
+	}
+}
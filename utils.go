@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding"
 	"encoding/binary"
+	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 )
 
@@ -13,6 +15,19 @@ import (
 // и всех остальных, кто поддерживает encoding.BinaryMarshaler,
 // encoding.TextMarshaler, json.Marshaler или fmt.Stringer. Возвращает ошибку,
 // если преобразование не получилось.
+//
+// Если значение поддерживает сразу несколько интерфейсов, то используется
+// первый подходящий в следующем порядке:
+//
+//  1. nil, []byte, string, json.RawMessage и byte — как есть;
+//  2. encoding.BinaryMarshaler — MarshalBinary;
+//  3. encoding.TextMarshaler — MarshalText;
+//  4. json.Marshaler — MarshalJSON;
+//  5. fmt.Stringer — String;
+//  6. все остальные значения — binary.Write. Для значений, размер которых
+//     не фиксирован, возвращается ошибка ErrUnsupportedType.
+//
+// Чтобы отдать предпочтение json.Marshaler, используйте BytesJSON.
 func Bytes(v interface{}) ([]byte, error) {
 	switch v := v.(type) {
 	case nil:
@@ -34,13 +49,81 @@ func Bytes(v interface{}) ([]byte, error) {
 	case fmt.Stringer:
 		return []byte(v.String()), nil
 	default:
+		// binary.Write поддерживает только значения фиксированного размера
+		if binary.Size(v) < 0 {
+			return nil, fmt.Errorf("%w %T: use PutJSON", ErrUnsupportedType, v)
+		}
 		var buf = bufPool.Get().(*bytes.Buffer)
 		buf.Reset() // сбрасываем буфер от возможного предыдущего значения
 		defer bufPool.Put(buf)
 		err := binary.Write(buf, binary.BigEndian, v)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%T: %w", v, err)
 		}
-		return buf.Bytes(), nil
+		// буфер возвращается в пул, поэтому данные из него копируются
+		return append([]byte(nil), buf.Bytes()...), nil
+	}
+}
+
+// ErrUnsupportedType возвращается Bytes для значений, которые не могут быть
+// преобразованы в бинарный формат, например, map или структур со строками.
+// Такие значения можно сохранить в формате JSON с помощью PutJSON.
+var ErrUnsupportedType = errors.New("unsupported value type")
+
+// BytesJSON преобразует данные в бинарный формат так же, как и Bytes, но
+// если значение поддерживает json.Marshaler, то для него всегда используется
+// MarshalJSON, даже если оно поддерживает и другие интерфейсы.
+func BytesJSON(v interface{}) ([]byte, error) {
+	if m, ok := v.(json.Marshaler); ok {
+		return m.MarshalJSON()
 	}
+	return Bytes(v)
+}
+
+// Codec описывает формат сериализации значений для сохранения в хранилище.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSON реализует сериализацию значений в формате JSON.
+var JSON Codec = jsonCodec{}
+
+// DefaultCodec задает формат сериализации, используемый методами PutCodec и
+// GetCodec, если формат явно не указан.
+var DefaultCodec = JSON
+
+// jsonCodec реализует Codec для формата JSON.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// Gob реализует сериализацию значений в формате encoding/gob. В отличие от
+// JSON, он сохраняет типы значений, которые JSON не поддерживает (например,
+// комплексные числа или ключи словарей произвольного типа), и обычно
+// компактнее, но такие значения могут быть прочитаны только программами на Go.
+// Значения интерфейсных типов должны быть предварительно зарегистрированы с
+// помощью gob.Register.
+var Gob Codec = gobCodec{}
+
+// gobCodec реализует Codec для формата encoding/gob. Каждое значение
+// кодируется отдельно вместе с описанием своего типа.
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
 }
@@ -0,0 +1,87 @@
+package keystore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Типы, поддерживающие разные наборы интерфейсов преобразования.
+type (
+	binaryValue  struct{}
+	textValue    struct{}
+	jsonValue    struct{}
+	stringValue  struct{}
+	allValue     struct{}
+	textStringer struct{}
+)
+
+func (binaryValue) MarshalBinary() ([]byte, error) { return []byte("binary"), nil }
+func (textValue) MarshalText() ([]byte, error)     { return []byte("text"), nil }
+func (jsonValue) MarshalJSON() ([]byte, error)     { return []byte(`"json"`), nil }
+func (stringValue) String() string                 { return "string" }
+
+func (allValue) MarshalBinary() ([]byte, error) { return []byte("binary"), nil }
+func (allValue) MarshalText() ([]byte, error)   { return []byte("text"), nil }
+func (allValue) MarshalJSON() ([]byte, error)   { return []byte(`"json"`), nil }
+func (allValue) String() string                 { return "string" }
+
+func (textStringer) MarshalText() ([]byte, error) { return []byte("text"), nil }
+func (textStringer) String() string               { return "string" }
+
+func TestBytes(t *testing.T) {
+	for _, test := range []struct {
+		value     interface{}
+		bytes, js string
+	}{
+		{nil, "", ""},
+		{[]byte("raw"), "raw", "raw"},
+		{"str", "str", "str"},
+		{json.RawMessage(`{}`), "{}", "{}"},
+		{byte(7), "\x07", "\x07"},
+		{binaryValue{}, "binary", "binary"},
+		{textValue{}, "text", "text"},
+		{jsonValue{}, `"json"`, `"json"`},
+		{stringValue{}, "string", "string"},
+		{allValue{}, "binary", `"json"`},
+		{textStringer{}, "text", "text"},
+		{uint16(0x0102), "\x01\x02", "\x01\x02"},
+	} {
+		data, err := Bytes(test.value)
+		if err != nil {
+			t.Errorf("%T: %v", test.value, err)
+		} else if string(data) != test.bytes {
+			t.Errorf("%T: bad bytes %q", test.value, data)
+		}
+		data, err = BytesJSON(test.value)
+		if err != nil {
+			t.Errorf("%T: %v", test.value, err)
+		} else if string(data) != test.js {
+			t.Errorf("%T: bad json bytes %q", test.value, data)
+		}
+	}
+}
+
+func TestBytesUnsupported(t *testing.T) {
+	for _, value := range []interface{}{
+		map[string]int{"a": 1},
+		[]string{"a"},
+		struct{ Name string }{"a"},
+		func() {},
+	} {
+		_, err := Bytes(value)
+		if !errors.Is(err, ErrUnsupportedType) {
+			t.Errorf("%T: bad error %v", value, err)
+		} else if !strings.Contains(err.Error(), fmt.Sprintf("%T", value)) {
+			t.Errorf("%T: no type in error %v", value, err)
+		}
+	}
+	// данные не должны зависеть от последующих вызовов
+	first, _ := Bytes(uint32(1))
+	second, _ := Bytes(uint32(2))
+	if first[3] != 1 || second[3] != 2 {
+		t.Errorf("shared buffer: %v %v", first, second)
+	}
+}
@@ -0,0 +1,176 @@
+package keystore
+
+import (
+	"crypto/cipher"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Verify проверяет целостность файла хранилища: последовательно читает все
+// записи и сверяет контрольные суммы действующих записей с их содержимым.
+// Файл при этом никак не изменяется.
+//
+// Если найдены записи с несовпадающей контрольной суммой, то возвращается
+// ошибка ErrChecksum со списком смещений таких записей от начала файла. Для
+// файлов в старом формате, где контрольные суммы не сохраняются, проверяется
+// только целостность структуры записей.
+func (db *DB) Verify() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	size, err := db.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size < db.size {
+		return &os.PathError{Op: "verify", Path: db.f.Name(),
+			Err: fmt.Errorf("%w at offset %d", errTruncated, size)}
+	}
+	// записи читаются только до конца данных
+	var (
+		reader = newRecordReader(
+			io.NewSectionReader(db.f, db.start, db.size-db.start),
+			db.start, db.flags)
+		record  = new(record)
+		corrupt []int64 // смещения записей с неверной контрольной суммой
+	)
+	reader.size = db.size
+	for {
+		if err = reader.next(record); err != nil {
+			break
+		}
+		if !record.Valid {
+			corrupt = append(corrupt, record.Offset)
+		}
+	}
+	if err == io.EOF && reader.offset != db.size {
+		err, record.Offset = errDataEnd, reader.offset
+	}
+	if err != io.EOF {
+		return &os.PathError{Op: "verify", Path: db.f.Name(),
+			Err: fmt.Errorf("%w at offset %d", err, record.Offset)}
+	}
+	if len(corrupt) > 0 {
+		return &os.PathError{Op: "verify", Path: db.f.Name(),
+			Err: fmt.Errorf("%w at offsets %v", ErrChecksum, corrupt)}
+	}
+	return nil
+}
+
+// Recover восстанавливает поврежденное хранилище в указанном файле и
+// возвращает открытое хранилище вместе с количеством восстановленных записей.
+// Если хранилище было открыто, то оно предварительно закрывается.
+//
+// Записи файла читаются последовательно до тех пор, пока не встретится
+// запись, выходящая за пределы файла или с несовпадающей контрольной суммой.
+// Эта запись и все записи за ней отбрасываются, а из предшествующих им
+// действующих записей создается новый файл хранилища, который заменяет собой
+// поврежденный.
+//
+// Для восстановления зашифрованного хранилища используйте RecoverWithOptions
+// с ключом шифрования.
+func Recover(filename string) (db *DB, recovered int, err error) {
+	return RecoverWithOptions(filename, nil)
+}
+
+// RecoverWithOptions восстанавливает хранилище так же, как Recover, и
+// открывает его с указанными параметрами.
+//
+// На время восстановления на файл устанавливается такая же блокировка, как
+// при открытии хранилища, поэтому файл, открытый другим процессом, не
+// изменяется, а возвращается ошибка ErrLocked. Ключ шифрования проверяется
+// до замены файла: без ключа для зашифрованного хранилища возвращается
+// ошибка ErrEncrypted, а с неверным ключом — ErrBadKey.
+func RecoverWithOptions(filename string, opts *Options) (db *DB, recovered int, err error) {
+	if opts == nil {
+		opts = new(Options)
+	}
+	aead, err := opts.cipher()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err = Close(filename); err != nil {
+		return nil, 0, err
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err = lockFile(file, true); err != nil {
+		_ = file.Close()
+		if err == errWouldBlock {
+			err = ErrLocked
+		}
+		return nil, 0, &os.PathError{Op: "lock", Path: filename, Err: err}
+	}
+	// блокировка снимается при закрытии файла после его замены
+	var tmpname = filename + ".recover"
+	tmp, err := os.OpenFile(tmpname, os.O_CREATE|os.O_TRUNC|os.O_WRONLY,
+		opts.fileMode())
+	if err != nil {
+		_ = closeLocked(file)
+		return nil, 0, err
+	}
+	err = recoverRecords(tmp, file, aead)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmpname, filename)
+	}
+	_ = closeLocked(file)
+	if err != nil {
+		_ = os.Remove(tmpname)
+		return nil, 0, &os.PathError{Op: "recover", Path: filename, Err: err}
+	}
+	if db, err = OpenWithOptions(filename, opts); err != nil {
+		return nil, 0, err
+	}
+	return db, int(db.Count()), nil
+}
+
+// recoverRecords копирует в w все действующие записи файла хранилища r до
+// первой поврежденной записи. Перед копированием проверяет, что ключ
+// шифрования подходит к заголовку файла.
+func recoverRecords(w io.Writer, r io.Reader, aead cipher.AEAD) error {
+	var head = new(header)
+	if err := head.read(r); err != nil {
+		return err
+	}
+	if err := verifyCheck(aead, head); err != nil {
+		return err
+	}
+	if err := head.current().write(w); err != nil {
+		return err
+	}
+	var (
+		reader = newRecordReader(r, head.Size(), head.Flags)
+		record = new(record)
+	)
+	reader.data = true
+	for {
+		err := reader.next(record)
+		if err == io.EOF || err == io.ErrUnexpectedEOF ||
+			(err == nil && !record.Valid) {
+			return nil // дальше данные повреждены
+		}
+		if err != nil {
+			return err
+		}
+		if record.Deleted() {
+			continue
+		}
+		// возможные дубликаты ключей будут разрешены при открытии
+		err = writeRecord(w, string(record.Key), record.Data, record.Time,
+			record.Flags)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,647 @@
+package keystore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// writeV1 создает файл хранилища в исходном формате без контрольных сумм.
+func writeV1(filename string, values map[string]string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var head = &header{Signature: signatureV1, Counter: 7}
+	if err := head.write(file); err != nil {
+		return err
+	}
+	for key, value := range values {
+		err := binary.Write(file, binary.BigEndian, &storedIndex{
+			KeySize:  uint8(len(key)),
+			DataSize: uint32(len(value)),
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := file.WriteString(key + value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestFormatV1(t *testing.T) {
+	var filename = "db/v1.db"
+	os.MkdirAll("db", 0777)
+	err := writeV1(filename, map[string]string{"a": "value a", "b": "value b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(filename)
+	if db.flags != 0 || db.start != 12 || db.counter != 7 {
+		t.Fatal("bad v1 format detection")
+	}
+	if err := db.Put("c", []byte("value c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := db.Keys("", "", 0, 0, true)
+	if len(keys) != 2 || keys[0] != "b" || keys[1] != "c" {
+		t.Fatalf("bad v1 keys: %q", keys)
+	}
+	value, err := db.Get("c")
+	if err != nil || string(value) != "value c" {
+		t.Fatalf("bad v1 value: %q, %v", value, err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	var filename = "db/verify.db"
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(filename)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Put(key, []byte("value "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	// портим данные второй записи
+	var index = db.indexes["b"]
+	if _, err := db.f.WriteAt([]byte("X"), db.dataOffset(index)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Verify(); !errors.Is(err, ErrChecksum) {
+		t.Fatal("bad verify error:", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(filename); !errors.Is(err, ErrChecksum) {
+		t.Fatal("bad open error:", err)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	var filename = "db/recover.db"
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(filename)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := db.Put(key, []byte("value "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	// портим данные третьей записи
+	var index = db.indexes["c"]
+	if _, err := db.f.WriteAt([]byte("X"), db.dataOffset(index)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, recovered, err := Recover(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered != 1 || !db.Has("b") {
+		t.Fatalf("bad recovered records: %d %q", recovered,
+			db.Keys("", "", 0, 0, true))
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverEncrypted(t *testing.T) {
+	var (
+		filename = "db/recover_encrypted.db"
+		secret   = []byte("0123456789abcdef")
+	)
+	os.Remove(filename)
+	db, err := OpenEncrypted(filename, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(filename)
+	if err := db.Put("key", []byte("secret value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// без ключа или с неверным ключом файл не заменяется
+	if _, _, err := Recover(filename); !errors.Is(err, ErrEncrypted) {
+		t.Fatal("bad recover without key:", err)
+	}
+	_, _, err = RecoverWithOptions(filename,
+		&Options{EncryptionKey: []byte("fedcba9876543210")})
+	if !errors.Is(err, ErrBadKey) {
+		t.Fatal("bad recover with wrong key:", err)
+	}
+	if after, err := os.ReadFile(filename); err != nil || !bytes.Equal(after, data) {
+		t.Fatal("store file changed:", err)
+	}
+	// файл, открытый другим процессом, не изменяется
+	reader, err := OpenWithOptions(filename,
+		&Options{ReadOnly: true, EncryptionKey: secret})
+	if err == nil {
+		_, _, err = RecoverWithOptions(filename, &Options{EncryptionKey: secret})
+		reader.Close()
+	}
+	if !errors.Is(err, ErrLocked) {
+		t.Fatal("bad recover of locked file:", err)
+	}
+	db, recovered, err := RecoverWithOptions(filename,
+		&Options{EncryptionKey: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("key"); recovered != 1 || err != nil ||
+		string(value) != "secret value" {
+		t.Fatalf("bad recovered value: %d, %q, %v", recovered, value, err)
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	var filename = "db/errors.db"
+	os.Remove(filename)
+	defer os.Remove(filename)
+	if err := os.WriteFile(filename, []byte("not a keystore file"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(filename); !errors.Is(err, ErrBadSignature) {
+		t.Fatal("bad signature error:", err)
+	}
+	os.Remove(filename)
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	var offset = db.indexes["key"].Offset
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// обрезанная запись
+	if err := os.Truncate(filename, info.Size()-2); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open(filename)
+	if !errors.Is(err, ErrCorruptIndex) {
+		t.Fatal("bad corrupt index error:", err)
+	}
+	if want := fmt.Sprintf("at offset %d", offset); !strings.Contains(err.Error(), want) {
+		t.Fatal("bad error offset:", err)
+	}
+	// обрезанный заголовок
+	if err := os.Truncate(filename, 6); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(filename); !errors.Is(err, ErrCorruptIndex) {
+		t.Fatal("bad corrupt header error:", err)
+	}
+}
+
+func TestTruncatedRecord(t *testing.T) {
+	var filename = "db/truncated.db"
+	for _, cut := range []struct {
+		name   string
+		size   func(index) int64 // размер обрезанного файла
+		bounds bool              // ошибка выхода записи за пределы файла
+	}{
+		{"header", func(i index) int64 { return int64(i.Offset) + 5 }, false},
+		{"key", func(i index) int64 { return int64(i.Offset) + 19 }, true},
+		{"data", func(i index) int64 { return int64(i.Offset) + 25 }, true},
+	} {
+		os.Remove(filename)
+		db, err := Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("first", []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("second", []byte("long value")); err != nil {
+			t.Fatal(err)
+		}
+		var last = db.indexes["second"]
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Truncate(filename, cut.size(last)); err != nil {
+			t.Fatal(err)
+		}
+		_, err = Open(filename)
+		if !errors.Is(err, ErrCorruptIndex) {
+			t.Fatalf("%s: bad error: %v", cut.name, err)
+		}
+		if want := fmt.Sprintf("at offset %d", last.Offset); !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: bad error offset: %v", cut.name, err)
+		}
+		if got := errors.Is(err, errOutOfBounds); got != cut.bounds {
+			t.Errorf("%s: bad bounds error: %v", cut.name, err)
+		}
+		db, n, err := Recover(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 || !db.Has("first") {
+			t.Errorf("%s: bad recovered store: %d", cut.name, n)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Remove(filename)
+}
+
+func TestZeroPadded(t *testing.T) {
+	// нули в конце файла, в том числе короче заголовка записи
+	for _, pad := range []int64{1, 5, storedIndexSize, 100, 5000} {
+		var file = newMemFile("padded")
+		db, err := loadFile(context.Background(), file, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"a", "b"} {
+			if err := db.Put(key, []byte("value "+key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		size, _ := file.Seek(0, io.SeekEnd)
+		if err := file.Truncate(size + pad); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = loadFile(context.Background(), file, false, nil); err != nil {
+			t.Fatalf("%d: %v", pad, err)
+		}
+		if db.Count() != 2 || db.Has("") {
+			t.Fatalf("%d: bad keys: %v", pad, db.Keys("", "", 0, 0, true))
+		}
+		if err := db.Verify(); err != nil {
+			t.Fatalf("%d: %v", pad, err)
+		}
+		// новая запись добавляется сразу за последней
+		if err := db.Put("c", []byte("value c")); err != nil {
+			t.Fatal(err)
+		}
+		if offset := db.indexes["c"].Offset; int64(offset) != size {
+			t.Fatalf("%d: bad offset: %d", pad, offset)
+		}
+		if db, err = loadFile(context.Background(), file, true, nil); err != nil {
+			t.Fatalf("%d: %v", pad, err)
+		}
+		if db.Count() != 3 {
+			t.Fatalf("%d: bad count: %d", pad, db.Count())
+		}
+	}
+
+	// файл в исходном формате без контрольных сумм
+	var filename = "db/padded.db"
+	if err := writeV1(filename, map[string]string{"key": "value"}); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filename)
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(filename, info.Size()+64); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenReadOnly(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.Count() != 1 || !db.Has("key") {
+		t.Fatalf("bad v1 keys: %v", db.Keys("", "", 0, 0, true))
+	}
+}
+
+func TestLoadWarnings(t *testing.T) {
+	var file = newMemFile("dup")
+	db, err := loadFile(context.Background(), file, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.LoadWarnings()) != 0 {
+		t.Fatal("unexpected warnings:", db.LoadWarnings())
+	}
+	// дописываем в конец файла более новую запись с тем же ключом
+	var buf bytes.Buffer
+	var timestamp = db.indexes["key"].Time + 1
+	if err := writeRecord(&buf, "key", []byte("new"), timestamp, 0); err != nil {
+		t.Fatal(err)
+	}
+	size, _ := file.Seek(0, io.SeekEnd)
+	if _, err := file.WriteAt(buf.Bytes(), size); err != nil {
+		t.Fatal(err)
+	}
+	// и сдвигаем конец данных в заголовке, чтобы запись не была отброшена
+	if _, err := file.WriteAt(endSlot(size+int64(buf.Len())), db.endAt); err != nil {
+		t.Fatal(err)
+	}
+	db, err = loadFile(context.Background(), file, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var warnings = db.LoadWarnings()
+	if len(warnings) != 1 || !strings.Contains(warnings[0], `duplicate key "key"`) {
+		t.Fatalf("bad warnings: %v", warnings)
+	}
+	if value, err := db.Get("key"); err != nil || string(value) != "new" {
+		t.Fatalf("bad value: %q, %v", value, err)
+	}
+}
+
+func TestDataEnd(t *testing.T) {
+	var file = newMemFile("end")
+	db, err := loadFile(context.Background(), file, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Put(key, []byte("value "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	var head = new(header)
+	if err := head.read(io.NewSectionReader(file, 0, 1<<10)); err != nil {
+		t.Fatal(err)
+	}
+	size, _ := file.Seek(0, io.SeekEnd)
+	if head.Signature != signatureV3 || head.End != size || db.size != size {
+		t.Fatalf("bad data end: %d, %d, %d", head.End, db.size, size)
+	}
+
+	// запись, для которой не успели сохранить конец данных, отбрасывается
+	var buf bytes.Buffer
+	if err := writeRecord(&buf, "lost", []byte("value"), 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt(buf.Bytes(), size); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = loadFile(context.Background(), file, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if db.Has("lost") || db.Count() != 2 {
+		t.Fatalf("bad keys: %v", db.Keys("", "", 0, 0, true))
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("c", []byte("value c")); err != nil {
+		t.Fatal(err)
+	}
+	if offset := db.indexes["c"].Offset; int64(offset) != size {
+		t.Fatalf("bad offset: %d", offset)
+	}
+	size = db.size // за новой записью остался хвост отброшенной
+
+	// обрезанный по границе записи файл
+	var last = db.indexes["c"]
+	if err := file.Truncate(int64(last.Offset)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadFile(context.Background(), file, false, nil)
+	if !errors.Is(err, errTruncated) || !errors.Is(err, ErrCorruptIndex) {
+		t.Fatalf("bad truncated error: %v", err)
+	}
+	if err := db.Verify(); !errors.Is(err, ErrCorruptIndex) {
+		t.Fatalf("bad verify error: %v", err)
+	}
+
+	// при поврежденном слоте конец данных определяется по концу файла
+	if _, err := file.WriteAt([]byte{0xff}, db.endAt); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = loadFile(context.Background(), file, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if db.Count() != 2 || db.stored != 0 {
+		t.Fatalf("bad store: %d, %d", db.Count(), db.stored)
+	}
+	// и сохраняется заново при изменении
+	if err := db.Put("c", []byte("value c")); err != nil {
+		t.Fatal(err)
+	}
+	if db.stored != size {
+		t.Fatalf("bad stored data end: %d", db.stored)
+	}
+}
+
+func TestFormatV2(t *testing.T) {
+	// файл во второй версии формата без конца данных в заголовке
+	var (
+		file = newMemFile("v2")
+		head = &header{Signature: signatureV2, Flags: flagChecksum | flagCounterSlots}
+		buf  bytes.Buffer
+	)
+	if err := head.write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeRecord(&buf, "key", []byte("value"), 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt(buf.Bytes(), 0); err != nil {
+		t.Fatal(err)
+	}
+	db, err := loadFile(context.Background(), file, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("next", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = loadFile(context.Background(), file, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if db.Count() != 2 || db.endAt != 0 {
+		t.Fatalf("bad v2 store: %d, %d", db.Count(), db.endAt)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCounterSlots(t *testing.T) {
+	var filename = "db/counter.db"
+	os.Remove(filename)
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(filename)
+	for i := 0; i < 5; i++ {
+		if _, err := db.NextSequence(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var slot = db.slot
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// портим слот с последним значением, как при обрыве записи
+	file, err := os.OpenFile(filename, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.WriteAt([]byte{0xff, 0xff}, counterSlotsOffset+
+		int64(slot)*counterSlotSize+6)
+	if err2 := file.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.counter != 4 || db.slot == slot {
+		t.Fatal("bad recovered counter:", db.counter, db.slot)
+	}
+	// следующее значение записывается на место поврежденного
+	if id, err := db.NextSequence(); err != nil || id != 5 {
+		t.Fatal("bad next sequence:", id, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.counter != 5 {
+		t.Fatal("bad counter after reopen:", db.counter)
+	}
+}
+
+func TestReserveSequence(t *testing.T) {
+	var filename = "db/reserve.db"
+	os.Remove(filename)
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(filename)
+	if id, err := db.NextSequence(); err != nil || id != 1 {
+		t.Fatal("bad sequence:", id, err)
+	}
+	start, err := db.ReserveSequence(100)
+	if err != nil || start != 2 {
+		t.Fatal("bad reserved start:", start, err)
+	}
+	if start, err := db.ReserveSequence(0); err != nil || start != 102 {
+		t.Fatal("bad empty reserve:", start, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// зарезервированные значения не выдаются повторно после открытия
+	db, err = Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := db.NextSequence(); err != nil || id != 102 {
+		t.Fatal("bad sequence after reserve:", id, err)
+	}
+}
+
+func FuzzOpen(f *testing.F) {
+	// исходные данные: файл хранилища с действующими и удаленными записями
+	var file = newMemFile("seed")
+	db, err := loadFile(context.Background(), file, false, nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Put(key, bytes.Repeat([]byte(key), 10)); err != nil {
+			f.Fatal(err)
+		}
+	}
+	if err := db.Delete("b"); err != nil {
+		f.Fatal(err)
+	}
+	var seed = append([]byte(nil), file.data...)
+	f.Add(seed)
+	f.Add(seed[:len(seed)-5])
+	f.Add(seed[:db.start])
+	var v1 = new(bytes.Buffer)
+	_ = (&header{Signature: signatureV1}).write(v1)
+	_ = binary.Write(v1, binary.BigEndian, &storedIndex{KeySize: 1,
+		DataSize: 0xFFFFFFF0})
+	v1.WriteString("k")
+	f.Add(v1.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var file = newMemFile("fuzz")
+		if _, err := file.WriteAt(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		db, err := loadFile(context.Background(), file, true, nil)
+		if err == nil {
+			// данные всех загруженных записей должны присутствовать в файле
+			for key, index := range db.indexes {
+				if _, err := db.read(index); err != nil {
+					t.Fatalf("read %q: %v", key, err)
+				}
+			}
+			_ = db.Verify()
+		}
+		// загрузка копии не должна выделять память по размерам из заголовков
+		_ = copyBackup(io.Discard, bytes.NewReader(data), nil)
+	})
+}
@@ -0,0 +1,133 @@
+package keystore
+
+import "strings"
+
+// EventType описывает тип изменения данных в хранилище.
+type EventType uint8
+
+// Типы изменений данных в хранилище.
+const (
+	EventPut    EventType = iota + 1 // значение сохранено
+	EventDelete                      // значение удалено
+)
+
+// String возвращает строковое представление типа изменения.
+func (t EventType) String() string {
+	switch t {
+	case EventPut:
+		return "put"
+	case EventDelete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+// Event описывает изменение данных в хранилище.
+type Event struct {
+	Type  EventType // тип изменения
+	Key   string    // ключ
+	Value []byte    // новое значение для EventPut
+	// Dropped взводится, если перед этим событием часть событий была
+	// пропущена из-за того, что подписчик не успевал их обрабатывать.
+	Dropped bool
+}
+
+// watchBuffer задает размер буфера канала с событиями.
+const watchBuffer = 64
+
+// watch описывает подписку на изменения.
+type watch struct {
+	prefix  string     // префикс отслеживаемых ключей
+	events  chan Event // канал для отправки событий
+	dropped bool       // флаг пропущенных событий
+}
+
+// Watch возвращает канал с уведомлениями об изменениях ключей, начинающихся с
+// указанного префикса, и функцию для отмены подписки. Пустой префикс позволяет
+// получать уведомления об изменении любых ключей.
+//
+// Канал с событиями буферизован и отправка в него событий никогда не
+// блокирует запись в хранилище: если подписчик не успевает обрабатывать
+// события и буфер заполнен, то новые события отбрасываются, а у следующего
+// доставленного события будет взведен флаг Dropped.
+//
+// После вызова функции отмены подписки или закрытия хранилища канал
+// закрывается. Для уже закрытого хранилища возвращается закрытый канал.
+// Повторный вызов функции отмены ничего не делает.
+//
+// Каждый подписчик получает собственную копию значения в Event.Value и
+// может ее изменять.
+func (db *DB) Watch(prefix string) (<-chan Event, func()) {
+	var w = &watch{
+		prefix: prefix,
+		events: make(chan Event, watchBuffer),
+	}
+	// закрытие хранилища отменяет подписки с той же блокировкой
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		close(w.events)
+		return w.events, func() {}
+	}
+	db.wmu.Lock()
+	if db.watches == nil {
+		db.watches = make(map[*watch]bool)
+	}
+	db.watches[w] = true
+	db.wmu.Unlock()
+	return w.events, func() {
+		db.wmu.Lock()
+		if db.watches[w] {
+			delete(db.watches, w)
+			close(w.events)
+		}
+		db.wmu.Unlock()
+	}
+}
+
+// notify отправляет уведомление об изменении всем подписчикам.
+func (db *DB) notify(t EventType, key string, value []byte) {
+	db.wmu.Lock()
+	defer db.wmu.Unlock()
+	if len(db.watches) == 0 {
+		return
+	}
+	if value == nil && t == EventPut {
+		value = []byte{}
+	}
+	for w := range db.watches {
+		if !strings.HasPrefix(key, w.prefix) {
+			continue
+		}
+		var event = Event{Type: t, Key: key, Dropped: w.dropped}
+		if value != nil {
+			// копируем значение для каждого подписчика, т.к. исходный массив
+			// может быть изменен, а подписчики не должны влиять друг на друга
+			event.Value = append(make([]byte, 0, len(value)), value...)
+		}
+		select {
+		case w.events <- event:
+			w.dropped = false
+		default:
+			w.dropped = true
+		}
+	}
+}
+
+// watched возвращает true, если на изменения хранилища есть подписки.
+func (db *DB) watched() bool {
+	db.wmu.Lock()
+	defer db.wmu.Unlock()
+	return len(db.watches) > 0
+}
+
+// unwatchAll отменяет все подписки и закрывает их каналы.
+func (db *DB) unwatchAll() {
+	db.wmu.Lock()
+	for w := range db.watches {
+		delete(db.watches, w)
+		close(w.events)
+	}
+	db.wmu.Unlock()
+}
@@ -0,0 +1,96 @@
+package keystore
+
+import "testing"
+
+func TestWatch(t *testing.T) {
+	var filename = "db/watch.db"
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(filename)
+	db.SetSync(false)
+
+	events, cancel := db.Watch("user:")
+	all, cancelAll := db.Watch("")
+	defer cancelAll()
+	if err := db.Put("user:1", []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("item:1", []byte("item")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("user:1", []byte("two")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("user:1"); err != nil {
+		t.Fatal(err)
+	}
+	var want = []Event{
+		{Type: EventPut, Key: "user:1", Value: []byte("one")},
+		{Type: EventPut, Key: "user:1", Value: []byte("two")},
+		{Type: EventDelete, Key: "user:1"},
+	}
+	for _, w := range want {
+		e := <-events
+		if e.Type != w.Type || e.Key != w.Key || string(e.Value) != string(w.Value) {
+			t.Errorf("bad event: %v %q %q", e.Type, e.Key, e.Value)
+		}
+	}
+	if len(all) != 4 {
+		t.Errorf("bad events count: %d", len(all))
+	}
+	cancel()
+	cancel() // повторная отмена не должна приводить к панике
+	if _, ok := <-events; ok {
+		t.Error("events channel not closed")
+	}
+
+	// переполнение буфера не блокирует запись
+	for i := 0; i < watchBuffer*2; i++ {
+		if err := db.Put("key", []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for len(all) > 0 {
+		<-all
+	}
+	if err := db.Put("key", []byte("last")); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-all; !e.Dropped || string(e.Value) != "last" {
+		t.Errorf("bad dropped event: %v %q", e.Dropped, e.Value)
+	}
+}
+
+func TestWatchClosed(t *testing.T) {
+	db, err := OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// подписчики получают отдельные копии значения
+	first, cancelFirst := db.Watch("")
+	defer cancelFirst()
+	second, cancelSecond := db.Watch("")
+	defer cancelSecond()
+	if err := db.Put("key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	var e = <-first
+	e.Value[0] = 'X'
+	if e := <-second; string(e.Value) != "value" {
+		t.Errorf("shared event value: %q", e.Value)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-first; ok {
+		t.Error("events channel not closed on close")
+	}
+	// подписка на закрытое хранилище сразу возвращает закрытый канал
+	events, cancel := db.Watch("")
+	if _, ok := <-events; ok {
+		t.Error("events channel of closed store not closed")
+	}
+	cancel()
+}